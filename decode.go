@@ -58,6 +58,16 @@ import (
 	"time"
 	// "runtime/debug"
 	"encoding/binary"
+	"strconv"
+	"errors"
+	"io/ioutil"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"unicode/utf8"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
 )
 
 // Some tagging information for error messages.
@@ -67,6 +77,10 @@ var (
 	msgBadDesc = "Unrecognized descriptor byte: "
 )
 
+// ErrInvalidByte is returned when the reserved descriptor byte 0xc1 is read.
+// It is never valid in msgpack, and usually means the data is corrupt or not msgpack.
+var ErrInvalidByte = errors.New(msgTagDec + ": Invalid descriptor byte: 0xc1")
+
 // Default DecoderContainerResolver used when a nil parameter is passed to NewDecoder().
 // Sample Usage:
 //   opts := msgpack.DefaultDecoderContainerResolver // makes a copy
@@ -80,12 +94,258 @@ var DefaultDecoderContainerResolver = SimpleDecoderContainerResolver {
 	BytesStringMapValue: true,
 }
 
+// Default DecoderOptions used when a nil parameter is passed to NewDecoderWithOptions().
+// The zero value is lenient, and matches the behaviour of NewDecoder().
+var DefaultDecoderOptions = DecoderOptions{}
+
+// DecoderOptions holds options which control how a Decoder decodes a stream 
+// into typed values. It complements the DecoderContainerResolver, which only 
+// handles decoding into a nil interface{}.
+type DecoderOptions struct {
+	// If set, error on lossy numeric conversions: a float with a fraction decoded into 
+	// an integer (see FloatToInt), or a float64 out of the range of a float32 target
+	// (which is stored as an infinity by default). 
+	// Overflowing an integer target (e.g. 300 into an int8) is always an error.
+	StrictNumericConversion bool
+	// If set, a float in the stream can be decoded into an integer: its fraction is 
+	// truncated (or it is an error, with StrictNumericConversion). 
+	// By default, decoding a float into an integer is an error.
+	FloatToInt bool
+	// If set, when decoding a map into a struct, a key which doesn't exactly match
+	// the encoded name of a field is matched ignoring case (like encoding/json). 
+	// An exact match is always preferred.
+	CaseInsensitiveFieldMatch bool
+	// If set, integers and floats decoded into a nil interface{} are stored as a Number,
+	// so their exact value can be parsed later (like json.Decoder.UseNumber).
+	UseNumber bool
+	// If set, error if a value is not in its smallest (canonical) format, 
+	// e.g. a small integer written as a uint64, or a short string written with a 32-bit length.
+	// It is useful to validate that a producer writes minimal encodings.
+	Strict bool
+	// If set, NewFunc is called to allocate a value when decoding into a nil pointer 
+	// (e.g. elements of a []*T, values of a map[K]*T, or a *T struct field).
+	// It is passed the type T, and must return a *T (or nil to allocate as usual).
+	// This allows values to be obtained from a pool, to reduce garbage when streaming.
+	NewFunc func(rt reflect.Type) interface{}
+	// What to do if a map in the stream has duplicate keys, when decoding into 
+	// a map or struct. Default is DuplicateKeyLastWins.
+	DuplicateKeyPolicy DuplicateKeyPolicy
+	// If set, raw bytes decoded into a non-nil []byte with enough capacity are 
+	// copied into its backing array (which is resliced to the length), instead of 
+	// allocating a new []byte. The decoded slice then aliases the original one.
+	ReuseByteSlices bool
+	// Layout used to parse raw bytes (a string) decoded into a time.Time, 
+	// for producers which send timestamps as strings. If empty, time.RFC3339 is used.
+	// The [seconds, nanoseconds] array written by the Encoder is always accepted.
+	TimeLayout string
+	// If set, a bool in the stream can be decoded into an integer (as 0 or 1) 
+	// or a string (as "false" or "true"), and an integer into a bool (true if not 0),
+	// e.g. as written with EncoderOptions.BoolAsInt. Else it is an error.
+	LenientBool bool
+	// If set, Decode returns a *TrailingBytesError if the stream has bytes left after 
+	// the value, which usually indicates corruption. It is meant for a stream holding 
+	// a single value: it reads the reader to the end (unless it has a Len() method, like 
+	// bytes.Reader), so must not be used with a connection. Unmarshal always sets it.
+	ErrorOnTrailingBytes bool
+	// If set, the Decoder counts the values it allocates (e.g. slices, maps, pointers,
+	// strings) and their approximate size, while decoding. See Decoder.Stats.
+	CollectStats bool
+	// If > 0, the maximum number of entries of a map, or elements of an array, in the stream.
+	// A larger length declared in a header is an error, returned before anything is allocated.
+	// It bounds the memory a malicious or corrupt stream can make the Decoder allocate.
+	MaxMapLen int
+	MaxArrayLen int
+	// If > 0, the maximum approximate total size (in bytes) of the values allocated 
+	// during one Decode (as counted for DecodeStats), or one BatchDecode (across its 
+	// goroutines). Exceeding it is an error. 
+	// Unlike MaxMapLen and MaxArrayLen, it bounds a stream of many small values. 
+	// It is checked before each slice, map, string or []byte is allocated. 
+	MaxTotalAlloc int
+	// If set, integers decoded into a nil interface{} are stored as a float64 
+	// (like encoding/json), e.g. for consumers in JavaScript, which lacks 64-bit integers.
+	// Integers beyond 2^53 lose precision. UseNumber takes precedence.
+	IntAsFloat bool
+	// The registry of the types which a map with a "_type" entry is decoded into, when 
+	// decoding into a nil interface (see RegisterName). If nil, DefaultTypeRegistry is used, 
+	// as by the Encoder. Set it to an empty registry (NewTypeRegistry()) to decode such maps as maps.
+	Types *TypeRegistry
+	// If set, a map with one entry whose key is a name registered in Types, 
+	// e.g. {"circle": {...}}, is decoded into a value of that type when decoding into 
+	// a nil interface (e.g. an interface field). It supports tagged unions (oneof) 
+	// encoded as {typeName: value}, with a known set of variant types.
+	DiscriminatorMap bool
+	// If set, raw bytes shorter than a byte array (e.g. [32]byte) are decoded into it, 
+	// and the rest of the array is zeroed. Else the lengths must match exactly 
+	// (e.g. so a truncated hash is an error). Longer raw bytes are always an error.
+	LenientByteArrayLen bool
+	// If set, decoding a map into a struct with several fields of the same name 
+	// (e.g. two fields with the same name in their tag) is an error, as the map key is ambiguous.
+	// Else the key is decoded into the first of those fields (in declaration order, 
+	// with embedded structs inlined where they are declared).
+	StrictTags bool
+	// If set, a negative integer decoded into an unsigned type is stored as its two's complement 
+	// in the size of the type (e.g. -1 into a uint8 is 255), for producers which write unsigned 
+	// values as signed. It is an error if it does not fit the signed type of that size (e.g. int8). 
+	// Else a negative integer into an unsigned type is always an error.
+	LenientUnsigned bool
+	// If set, an array of integers can be decoded into a []byte, for producers which 
+	// send bytes as an array. Each element must be an integer in 0..255. 
+	// Else a []byte can only be decoded from raw bytes.
+	IntArrayAsBytes bool
+	// If set, an integer decoded into a time.Time is taken as a unix timestamp 
+	// in UnixTimeUnit, for producers which send timestamps as plain integers.
+	IntAsUnixTime bool
+	// Unit of the integers decoded into a time.Time if IntAsUnixTime is set 
+	// (e.g. time.Millisecond). If 0, time.Second is used.
+	UnixTimeUnit time.Duration
+	// If non-nil, map keys are matched to the struct fields without a name in their tag
+	// using the name it returns for their field name. See EncoderOptions.FieldNameTransform.
+	FieldNameTransform func(string) string
+	decFns map[reflect.Type]func(*Decoder, reflect.Value) error // see RegisterDecoder
+}
+
+// DecodeStats holds the allocations made by a Decoder while decoding a value 
+// (see DecoderOptions.CollectStats). Temporary values are not counted.
+type DecodeStats struct {
+	Allocs int // number of values allocated
+	Bytes  int // approximate total size (in bytes) of the values allocated
+}
+
+// RegisterDecoder registers fn to decode values of type rt, instead of the default decoding. 
+// It is passed the Decoder positioned at the value, and a settable reflect.Value of type rt. 
+// It must read exactly one value from the stream, using the Decoder's exported methods 
+// (e.g. decode an int64 with Decode, and set the target from it).
+// Registration must happen before the options are used by a Decoder.
+func (o *DecoderOptions) RegisterDecoder(rt reflect.Type, fn func(d *Decoder, rv reflect.Value) error) {
+	if o.decFns == nil {
+		o.decFns = make(map[reflect.Type]func(*Decoder, reflect.Value) error)
+	}
+	o.decFns[rt] = fn
+}
+
+// A TrailingBytesError is returned when decoding a single value 
+// (see DecoderOptions.ErrorOnTrailingBytes), and bytes remain after it.
+type TrailingBytesError struct {
+	N int // number of bytes remaining
+}
+
+func (e *TrailingBytesError) Error() string {
+	return fmt.Sprintf("%v: %d trailing bytes after value", msgTagDec, e.N)
+}
+
+// A MissingFieldsError is returned when decoding into a struct, and the map in the stream 
+// has no entry for some fields with the "required" tag option (or, for a struct with the 
+// "toarray" option, the array is too short to hold them).
+type MissingFieldsError struct {
+	Type reflect.Type
+	Fields []string // names of the missing fields (as encoded)
+}
+
+func (e *MissingFieldsError) Error() string {
+	return fmt.Sprintf("%v: missing required fields in %v: %s", msgTagDec, e.Type, strings.Join(e.Fields, ", "))
+}
+
+// Validator is implemented by types which check their invariants, e.g. that a value is in range.
+// After decoding into a struct which implements it (or whose pointer does), the Decoder 
+// calls Validate, and returns a *ValidationError if it returns an error.
+type Validator interface {
+	Validate() error
+}
+
+// A ValidationError is returned when the Validate method of a decoded struct returns an error.
+type ValidationError struct {
+	Type reflect.Type
+	Err error // the error returned by Validate
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("%v: validating %v: %v", msgTagDec, e.Type, e.Err)
+}
+
+// A MapFieldNotFoundError is returned by Decoder.DecodeMapField 
+// when the map in the stream has no entry for the key.
+type MapFieldNotFoundError struct {
+	Key string
+}
+
+func (e *MapFieldNotFoundError) Error() string {
+	return fmt.Sprintf("%v: map field not found: %q", msgTagDec, e.Key)
+}
+
+// DuplicateKeyPolicy determines what happens when a map in the stream has duplicate keys.
+type DuplicateKeyPolicy byte
+
+const (
+	// the value of the last occurrence of the key is kept
+	DuplicateKeyLastWins DuplicateKeyPolicy = iota
+	// the value of the first occurrence of the key is kept, and others are skipped
+	DuplicateKeyFirstWins
+	// decoding fails with an error
+	DuplicateKeyError
+)
+
+// Number is a msgpack integer or float, stored as its decimal string.
+// It is used when decoding into a nil interface{} with DecoderOptions.UseNumber.
+// 
+// Floats are formatted with the minimum digits needed to represent them exactly,
+// so no precision is lost. A Number is encoded as an integer if it parses as one, 
+// else as a float64.
+type Number string
+
+// String returns the literal text of the number.
+func (n Number) String() string { return string(n) }
+
+// Int64 returns the number as an int64.
+func (n Number) Int64() (int64, error) {
+	return strconv.ParseInt(string(n), 10, 64)
+}
+
+// Uint64 returns the number as a uint64.
+func (n Number) Uint64() (uint64, error) {
+	return strconv.ParseUint(string(n), 10, 64)
+}
+
+// Float64 returns the number as a float64.
+func (n Number) Float64() (float64, error) {
+	return strconv.ParseFloat(string(n), 64)
+}
+
+// RawMessage is a raw encoded msgpack value (like encoding/json's RawMessage). 
+// Decoding into a RawMessage stores a copy of the bytes of the next value, without 
+// decoding it, and encoding a RawMessage writes its bytes as is (or nil if it is empty).
+// It can be used to delay decoding part of a message, or to pass it through unchanged.
+// 
+// A struct field of type RawMessage with the "self" tag option (e.g. `msgpack:",self"`)
+// is set to the encoded bytes of the whole struct when it is decoded (e.g. to keep the 
+// original message, while decoding some of its fields). It is not encoded. 
+type RawMessage []byte
+
+// RawField is an entry of a map, with its value left encoded. 
+// 
+// A struct field of type []RawField with the "extras" tag option (e.g. `msgpack:",extras"`)
+// collects the entries of the map in the stream whose keys match no other field of the struct, 
+// in the order they appear, instead of skipping them. When the struct is encoded, they are 
+// written after its other fields, so a message can be re-encoded without losing unknown keys.
+type RawField struct {
+	Key string
+	Raw RawMessage
+}
+
 // A Decoder reads and decodes an object from an input stream in the msgpack format.
 type Decoder struct {
 	r io.Reader
 	dam DecoderContainerResolver
+	opts *DecoderOptions
 	x [16]byte        //temp byte array re-used internally for efficiency
 	t1, t2, t4, t8 []byte // use these, so no need to constantly re-slice
+	peeked bool           // if set, pb was read by PeekType, and is the next byte to read
+	pb byte
+	fields map[string]bool // if non-nil, only these keys are decoded into the struct (see DecodeFields)
+	nested int             // depth of calls to DecodeValue (e.g. from a registered decoder)
+	stats DecodeStats
+	batchBytes *int64      // for a BatchDecode worker: the size allocated by the whole batch
+	tnames map[reflect.Type]map[string]*structFieldInfo // struct fields by transformed name
+	types *TypeRegistry    // DecoderOptions.Types, or DefaultTypeRegistry
 }
 
 // DecoderContainerResolver has the DecoderContainer method for getting a usable reflect.Value
@@ -182,10 +442,22 @@ func (d SimpleDecoderContainerResolver) DecoderContainer(
 // NewDecoder returns a Decoder for decoding a stream of bytes into an object.
 // If nil DecoderContainerResolver is passed, we use DefaultDecoderContainerResolver
 func NewDecoder(r io.Reader, dam DecoderContainerResolver) (d *Decoder) {
+	return NewDecoderWithOptions(r, dam, nil)
+}
+
+// NewDecoderWithOptions is like NewDecoder, but also takes DecoderOptions.
+// If nil DecoderOptions is passed, we use DefaultDecoderOptions
+func NewDecoderWithOptions(r io.Reader, dam DecoderContainerResolver, opts *DecoderOptions) (d *Decoder) {
 	if dam == nil {
 		dam = &DefaultDecoderContainerResolver
 	}
-	d = &Decoder{r:r, dam:dam}
+	if opts == nil {
+		opts = &DefaultDecoderOptions
+	}
+	d = &Decoder{r:r, dam:dam, opts:opts, types:opts.Types}
+	if d.types == nil {
+		d.types = DefaultTypeRegistry
+	}
 	d.t1, d.t2, d.t4, d.t8 = d.x[:1], d.x[:2], d.x[:4], d.x[:8]
 	return
 }
@@ -200,6 +472,11 @@ func NewDecoder(r io.Reader, dam DecoderContainerResolver) (d *Decoder) {
 // If you do not know what type of stream it is, pass in a pointer to a nil interface.
 // We will decode and store a value in that nil interface. 
 // 
+// Nil pointers (including elements of slices and values of maps) are allocated as needed, 
+// and a nil in the stream sets a pointer to nil.
+// An empty array, map or raw bytes decodes into an empty (not nil) slice, map or []byte, 
+// so an empty collection can be told from a nil one (see EncoderOptions.NilCollectionAsEmpty).
+// 
 // time.Time is handled transparently, by (en)decoding (to)from a 
 // []int64{Seconds since Epoch, Nanoseconds offset}.
 // 
@@ -216,29 +493,438 @@ func NewDecoder(r io.Reader, dam DecoderContainerResolver) (d *Decoder) {
 //   // To configure default options, see DefaultDecoderContainerResolver usage.
 //   // or write your own DecoderContainerResolver
 func (d *Decoder) Decode(v interface{}) (err error) {
-	return d.DecodeValue(reflectValue(v))
+	return d.decodeTop(v)
+}
+
+// DecodeEach decodes each top-level value in the stream into a nil interface{}, 
+// and calls fn with it, until the end of the stream (io.EOF). 
+// It stops at the first error from decoding or from fn, and returns it. 
+// At the end of the stream, it returns nil.
+func (d *Decoder) DecodeEach(fn func(v interface{}) error) (err error) {
+	for {
+		var v interface{}
+		if err = d.Decode(&v); err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return
+		}
+		if err = fn(v); err != nil {
+			return
+		}
+	}
+}
+
+// DecodeArrayToChan reads an array from the stream, and sends each element 
+// (decoded into a nil interface{}) on ch as soon as it is decoded, so downstream 
+// processing can overlap with decoding. A nil in the stream is treated as an empty array.
+// An element is only sent once it is completely decoded. On error, it stops and returns it.
+// Closing ch is the responsibility of the caller.
+func (d *Decoder) DecodeArrayToChan(ch chan<- interface{}) (err error) {
+	defer panicToErr(&err)
+	bd := d.readDesc()
+	if bd == 0xc0 {
+		return
+	}
+	if !(bd == 0xdc || bd == 0xdd || (bd >= 0x90 && bd <= 0x9f)) {
+		d.err("DecodeArrayToChan: Expecting array descriptor. Got: %x", bd)
+	}
+	containerLen := d.readContainerLen(bd, false, ContainerList)
+	for j := 0; j < containerLen; j++ {
+		var v interface{}
+		d.decodeValueT(0, -1, true, reflect.ValueOf(&v).Elem(), true, true, true)
+		ch <- v
+	}
+	return
+}
+
+// BatchDecode reads an array from the stream into the slice pointed to by v, 
+// decoding its elements in parallel across concurrency goroutines 
+// (if concurrency <= 0, runtime.GOMAXPROCS(0) is used).
+// 
+// The boundaries of the elements are found first (serially, without decoding them), 
+// and the elements are then decoded into a slice of the exact length. 
+// It is faster than Decode for large arrays of elements which are costly to decode 
+// (e.g. structs), and uses more memory (a copy of the encoded array is held).
+// A nil in the stream sets the slice to nil. On error, the first one is returned.
+// DecoderOptions.MaxTotalAlloc applies to the whole batch, and Stats returns its allocations.
+func (d *Decoder) BatchDecode(v interface{}, concurrency int) (err error) {
+	rv := reflectValue(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() || rv.Elem().Kind() != reflect.Slice {
+		return fmt.Errorf("%v: BatchDecode: Expecting valid pointer to slice. Got: %T", msgTagDec, v)
+	}
+	rv = rv.Elem()
+	if d.nested == 0 {
+		d.stats = DecodeStats{}
+	}
+	// find the boundaries of the elements
+	var buf bytes.Buffer
+	var offs []int
+	err = func() (err error) {
+		defer panicToErr(&err)
+		bd := d.readDesc()
+		if bd == 0xc0 {
+			return
+		}
+		if !(bd == 0xdc || bd == 0xdd || (bd >= 0x90 && bd <= 0x9f)) {
+			d.err("BatchDecode: Expecting array descriptor. Got: %x", bd)
+		}
+		containerLen := d.readContainerLen(bd, false, ContainerList)
+		// the offsets and the slice decoded into are counted before either is allocated
+		d.countAllocN(containerLen + 1, reflect.TypeOf(0).Size())
+		d.countAllocN(containerLen, rv.Type().Elem().Size())
+		offs = make([]int, containerLen + 1)
+		for j := 0; j < containerLen; j++ {
+			d.copyValue(&buf)
+			offs[j + 1] = buf.Len()
+		}
+		return
+	}()
+	if err != nil {
+		return
+	}
+	if offs == nil {
+		rv.Set(reflect.Zero(rv.Type()))
+		return
+	}
+	n := len(offs) - 1
+	rv.Set(reflect.MakeSlice(rv.Type(), n, n))
+	if concurrency <= 0 {
+		concurrency = runtime.GOMAXPROCS(0)
+	}
+	if concurrency > n {
+		concurrency = n
+	}
+	bs := buf.Bytes()
+	errs := make([]error, concurrency)
+	stats := make([]DecodeStats, concurrency)
+	batchBytes := int64(d.stats.Bytes)
+	var wg sync.WaitGroup
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			r := bytes.NewReader(nil)
+			dec := NewDecoderWithOptions(r, d.dam, d.opts)
+			dec.batchBytes = &batchBytes
+			// worker w decodes elements w, w+concurrency, ...
+			for j := w; j < n; j += concurrency {
+				r.Reset(bs[offs[j]:offs[j + 1]])
+				errs[w] = dec.DecodeValue(rv.Index(j).Addr())
+				stats[w].Allocs += dec.stats.Allocs
+				stats[w].Bytes += dec.stats.Bytes
+				if errs[w] != nil {
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	for _, st := range stats {
+		d.stats.Allocs += st.Allocs
+		d.stats.Bytes += st.Bytes
+	}
+	for _, err = range errs {
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// DecodeFields is like Decode, but v must be a pointer to a struct, and only 
+// the map keys listed in fields (matched against the encoded field names) are 
+// decoded into it. The values of other keys are skipped without being decoded,
+// which is cheaper when only a few fields of a large map are needed.
+// Structs nested within v are decoded fully.
+func (d *Decoder) DecodeFields(v interface{}, fields []string) (err error) {
+	rv := reflectValue(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("%v: DecodeFields: Expecting valid pointer to struct. Got: %T", msgTagDec, v)
+	}
+	d.fields = make(map[string]bool, len(fields))
+	for _, f := range fields {
+		d.fields[f] = true
+	}
+	defer func() { d.fields = nil }()
+	return d.DecodeValue(rv)
+}
+
+// DecodeMapField reads a map from the stream, and decodes the value of the entry 
+// with the given key into out (which must be a pointer), without building the full map. 
+// The other entries are skipped without decoding them, and the whole map is consumed. 
+// Only string (raw bytes) keys are compared; if there are duplicates, the first one is used.
+// If there is no entry for key, a *MapFieldNotFoundError is returned.
+func (d *Decoder) DecodeMapField(key string, out interface{}) (err error) {
+	rv := reflectValue(out)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return fmt.Errorf("%v: DecodeMapField: Expecting valid pointer to decode into. Got: %T", msgTagDec, out)
+	}
+	defer panicToErr(&err)
+	bd := d.readDesc()
+	if !(bd == 0xde || bd == 0xdf || (bd >= 0x80 && bd <= 0x8f)) {
+		d.err("DecodeMapField: Expecting map descriptor. Got: %x", bd)
+	}
+	containerLen := d.readContainerLen(bd, false, ContainerMap)
+	found := false
+	for j := 0; j < containerLen; j++ {
+		if !found {
+			bd = d.readDesc()
+			if (bd >= 0xa0 && bd <= 0xbf) || bd == 0xda || bd == 0xdb {
+				var k string
+				d.decodeValueT(bd, -1, false, reflect.ValueOf(&k).Elem(), true, true, true)
+				if k == key {
+					d.decodeValueT(0, -1, true, rv.Elem(), true, true, true)
+					found = true
+					continue
+				}
+			} else {
+				d.pb, d.peeked = bd, true
+				d.skipValue()
+			}
+		} else {
+			d.skipValue()
+		}
+		d.skipValue()
+	}
+	if !found {
+		err = &MapFieldNotFoundError{key}
+	}
+	return
 }
 
 // DecodeValue decodes the stream into a reflect.Value.
 // The reflect.Value must be a pointer.
 // See Decoder.Decode documentation. (Decode internally calls DecodeValue).
 func (d *Decoder) DecodeValue(rv reflect.Value) (err error) {
+	return d.decodeTop(rv)
+}
+
+// DecodeAndCapture is like Decode, but also returns the raw bytes of the value it decodes, 
+// e.g. to store or forward the original encoding (for an audit log, or to verify a signature 
+// over it) as well as use the value. On error, the returned bytes are nil.
+func (d *Decoder) DecodeAndCapture(v interface{}) (bs []byte, err error) {
+	var buf bytes.Buffer
+	if d.peeked {
+		buf.WriteByte(d.pb)
+	}
+	r := d.r
+	d.r = io.TeeReader(r, &buf)
+	err = d.decodeTop(v)
+	d.r = r
+	if err == nil {
+		bs = buf.Bytes()
+	}
+	return
+}
+
+// decodeTop decodes into v (which may be a reflect.Value), for Decode and DecodeValue.
+func (d *Decoder) decodeTop(v interface{}) (err error) {
 	defer panicToErr(&err)
-	// We cannot marshal into a non-pointer or a nil pointer 
-	// (at least pass a nil interface so we can marshal into it)
-	if rv.Kind() != reflect.Ptr || rv.IsNil() {
-		var rvi interface{} = rv
-		if rv.IsValid() && rv.CanInterface() {
-			rvi = rv.Interface()
+	if d.nested++; d.nested == 1 {
+		d.stats = DecodeStats{}
+	}
+	defer func() { d.nested-- }()
+	if !d.decodeFast(v) {
+		// We cannot marshal into a non-pointer or a nil pointer 
+		// (at least pass a nil interface so we can marshal into it)
+		rv := reflectValue(v)
+		if rv.Kind() != reflect.Ptr || rv.IsNil() {
+			var rvi interface{} = rv
+			if rv.IsValid() && rv.CanInterface() {
+				rvi = rv.Interface()
+			}
+			err = fmt.Errorf("%v: DecodeValue: Expecting valid pointer to decode into. Got: %v, %T, %v",
+				msgTagDec, rv.Kind(), rvi, rvi)
+			return
+		}
+		d.decodeValueT(0, -1, true, rv.Elem(), true, true, true)
+	}
+	// a nested call decodes part of the value, so the check is left to the outermost one
+	if d.opts.ErrorOnTrailingBytes && d.nested == 1 {
+		if n := d.trailingBytes(); n > 0 {
+			err = &TrailingBytesError{n}
+		}
+	}
+	return
+}
+
+// decodeFast decodes into v without reflection if it is a non-nil pointer to a common type, 
+// and the value in the stream is of the matching family (e.g. an integer for *int). 
+// Else it returns false, with the stream unchanged, and decodeValue is used. 
+// The result (and any error) is the same as via decodeValue.
+func (d *Decoder) decodeFast(v interface{}) bool {
+	if d.opts.decFns != nil {
+		return false
+	}
+	switch v.(type) {
+	case *int, *int64, *string, *bool, *float64, *[]byte:
+	default:
+		return false
+	}
+	if rv := reflect.ValueOf(v); rv.IsNil() {
+		return false
+	}
+	bd := d.readDesc()
+	isInt := bd <= 0x7f || bd >= 0xe0 || (bd >= 0xcc && bd <= 0xd3)
+	isRaw := bd == 0xda || bd == 0xdb || (bd >= 0xa0 && bd <= 0xbf)
+	switch x := v.(type) {
+	case *int:
+		if !isInt {
+			break
+		}
+		i, _ := d.decodeInteger(bd, true)
+		if int64(int(i)) != i {
+			d.err("Overflow int value: %v into kind: %v", i, reflect.Int)
+		}
+		*x = int(i)
+		return true
+	case *int64:
+		if !isInt {
+			break
+		}
+		*x, _ = d.decodeInteger(bd, true)
+		return true
+	case *bool:
+		if bd != 0xc2 && bd != 0xc3 {
+			break
+		}
+		*x = bd == 0xc3
+		return true
+	case *float64:
+		if bd == 0xca {
+			*x = float64(math.Float32frombits(d.readUint32()))
+			return true
+		} else if bd == 0xcb {
+			*x = math.Float64frombits(d.readUint64())
+			return true
+		}
+	case *string:
+		if !isRaw {
+			break
+		}
+		if l := d.readContainerLen(bd, false, ContainerRawBytes); l > 0 {
+			d.countAlloc(l)
+			bs := make([]byte, l)
+			d.readb(l, bs)
+			*x = string(bs)
+		}
+		return true
+	case *[]byte:
+		if !isRaw {
+			break
+		}
+		l := d.readContainerLen(bd, false, ContainerRawBytes)
+		if l == 0 {
+			if *x == nil {
+				*x = []byte{}
+			} else {
+				*x = (*x)[:0]
+			}
+			return true
+		}
+		bs := *x
+		if d.opts.ReuseByteSlices && cap(bs) >= l {
+			bs = bs[:l]
+		} else {
+			d.countAlloc(l)
+			bs = make([]byte, l)
+		}
+		d.readb(l, bs)
+		*x = bs
+		return true
+	}
+	// give the descriptor byte back, for decodeValue
+	d.pb, d.peeked = bd, true
+	return false
+}
+
+// Stats returns the allocations made during the last call to Decode (or DecodeValue), 
+// if DecoderOptions.CollectStats is set.
+func (d *Decoder) Stats() DecodeStats {
+	return d.stats
+}
+
+// record an allocation of size bytes (if collecting stats, or checking MaxTotalAlloc)
+func (d *Decoder) countAlloc(size int) {
+	if d.opts.CollectStats || d.opts.MaxTotalAlloc > 0 {
+		d.stats.Allocs++
+		d.stats.Bytes += size
+		total := int64(d.stats.Bytes)
+		if d.batchBytes != nil {
+			// the limit applies to the whole BatchDecode, across its workers
+			if total = atomic.AddInt64(d.batchBytes, int64(size)); total < 0 {
+				total = math.MaxInt64 // overflowed
+			}
+		}
+		if d.opts.MaxTotalAlloc > 0 && total > int64(d.opts.MaxTotalAlloc) {
+			d.err("Total allocated size: %d exceeds MaxTotalAlloc: %d", total, d.opts.MaxTotalAlloc)
 		}
-		err = fmt.Errorf("%v: DecodeValue: Expecting valid pointer to decode into. Got: %v, %T, %v",
-			msgTagDec, rv.Kind(), rvi, rvi)
+	}
+}
+
+// record the allocation of a container of length l, of the type of rv 
+// (if collecting stats, or checking MaxTotalAlloc)
+func (d *Decoder) countContainer(rv reflect.Value, l int) {
+	if !(d.opts.CollectStats || d.opts.MaxTotalAlloc > 0) || !rv.IsValid() {
+		return
+	}
+	switch rv.Kind() {
+	case reflect.Slice:
+		d.countAllocN(l, rv.Type().Elem().Size())
+	case reflect.Map:
+		d.countAllocN(l, rv.Type().Key().Size() + rv.Type().Elem().Size())
+	case reflect.String:
+		d.countAlloc(l)
+	default:
+		d.countAlloc(int(rv.Type().Size()))
+	}
+}
+
+// record an allocation of n values of size bytes each. 
+// A size too large for an int (e.g. from a corrupt length) is capped, so it still exceeds MaxTotalAlloc.
+func (d *Decoder) countAllocN(n int, size uintptr) {
+	const maxInt = int(^uint(0) >> 1)
+	if size > 0 && n > (maxInt - d.stats.Bytes) / int(size) {
+		d.countAlloc(maxInt - d.stats.Bytes)
 		return
 	}
+	d.countAlloc(n * int(size))
+}
 
-	//if a nil pointer is passed, set rv to the underlying value (not pointer).
-	d.decodeValueT(0, -1, true, rv.Elem(), true, true, true)
-	return
+// get a container from the DecoderContainerResolver (see DecoderContainer).
+// It is counted before it is allocated, so MaxTotalAlloc is checked first: as the resolver's
+// types are not known up front, its size is that of the default types ([]interface{}, 
+// map[interface{}]interface{} and []byte).
+func (d *Decoder) newContainer(parentcontainer reflect.Value, parentkey interface{}, 
+	length int, ct ContainerType) (rv reflect.Value) {
+	if d.opts.CollectStats || d.opts.MaxTotalAlloc > 0 {
+		switch ct {
+		case ContainerList:
+			d.countAllocN(length, intfTyp.Size())
+		case ContainerMap:
+			d.countAllocN(length, 2 * intfTyp.Size())
+		default:
+			d.countAlloc(length)
+		}
+	}
+	return d.dam.DecoderContainer(parentcontainer, parentkey, length, ct)
+}
+
+// returns the number of bytes left in the stream (reading it to the end if necessary).
+func (d *Decoder) trailingBytes() (n int) {
+	if d.peeked {
+		d.peeked = false
+		n++
+	}
+	if l, ok := d.r.(interface { Len() int }); ok {
+		return n + l.Len()
+	}
+	n2, err := io.Copy(ioutil.Discard, d.r)
+	if err != nil {
+		d.err("Error: %v", err)
+	}
+	return n + int(n2)
 }
 
 func (d *Decoder) decodeValueT(bd byte, containerLen int, readDesc bool, rve reflect.Value, 
@@ -258,15 +944,30 @@ func (d *Decoder) decodeValueT(bd byte, containerLen int, readDesc bool, rve ref
 	return
 }
 
-func (d *Decoder) nilIntfDecode(bd0 byte, containerLen0 int, readDesc bool, setContainers bool, rv0 reflect.Value) (
+// parentcontainer and parentkey are passed to the DecoderContainerResolver (see DecoderContainer).
+func (d *Decoder) nilIntfDecode(bd0 byte, containerLen0 int, readDesc bool, setContainers bool, rv0 reflect.Value,
+	parentcontainer reflect.Value, parentkey interface{}) (
 	rv reflect.Value, bd byte, ct ContainerType, containerLen int, handled bool) {
 	rv, bd, containerLen = rv0, bd0, containerLen0
 	if readDesc {
-		d.readb(1, d.t1)
-		bd = d.t1[0]
+		bd = d.readDesc()
 	}
 	//if we set the reflect.Value to an primitive value, consider it handled and return.
 	handled = true
+	if d.opts.UseNumber {
+		if n, ok := d.decodeNumber(bd); ok {
+			rv.Set(reflect.ValueOf(n))
+			return
+		}
+	}
+	if d.opts.IntAsFloat && (bd <= 0x7f || bd >= 0xe0 || (bd >= 0xcc && bd <= 0xd3)) {
+		if i, ui := d.decodeInteger(bd, bd < 0xcc || bd > 0xcf); i != 0 {
+			rv.Set(reflect.ValueOf(float64(i)))
+		} else {
+			rv.Set(reflect.ValueOf(float64(ui)))
+		}
+		return
+	}
 	switch {
 	case bd == 0xc0:
 	case bd == 0xc2:
@@ -280,22 +981,38 @@ func (d *Decoder) nilIntfDecode(bd0 byte, containerLen0 int, readDesc bool, setC
 		rv.Set(reflect.ValueOf(math.Float64frombits(d.readUint64())))
 		
 	case bd == 0xcc:
-		rv.Set(reflect.ValueOf(d.readUint8()))
+		v := d.readUint8()
+		d.checkIntFormat(bd, 0, uint64(v))
+		rv.Set(reflect.ValueOf(v))
 	case bd == 0xcd:
-		rv.Set(reflect.ValueOf(d.readUint16()))
+		v := d.readUint16()
+		d.checkIntFormat(bd, 0, uint64(v))
+		rv.Set(reflect.ValueOf(v))
 	case bd == 0xce:
-		rv.Set(reflect.ValueOf(d.readUint32()))
+		v := d.readUint32()
+		d.checkIntFormat(bd, 0, uint64(v))
+		rv.Set(reflect.ValueOf(v))
 	case bd == 0xcf:
-		rv.Set(reflect.ValueOf(d.readUint64()))
+		v := d.readUint64()
+		d.checkIntFormat(bd, 0, v)
+		rv.Set(reflect.ValueOf(v))
 		
 	case bd == 0xd0:
-		rv.Set(reflect.ValueOf(int8(d.readUint8())))
+		v := int8(d.readUint8())
+		d.checkIntFormat(bd, int64(v), 0)
+		rv.Set(reflect.ValueOf(v))
 	case bd == 0xd1:
-		rv.Set(reflect.ValueOf(int16(d.readUint16())))
+		v := int16(d.readUint16())
+		d.checkIntFormat(bd, int64(v), 0)
+		rv.Set(reflect.ValueOf(v))
 	case bd == 0xd2:
-		rv.Set(reflect.ValueOf(int32(d.readUint32())))
+		v := int32(d.readUint32())
+		d.checkIntFormat(bd, int64(v), 0)
+		rv.Set(reflect.ValueOf(v))
 	case bd == 0xd3:
-		rv.Set(reflect.ValueOf(int64(d.readUint64())))
+		v := int64(d.readUint64())
+		d.checkIntFormat(bd, v, 0)
+		rv.Set(reflect.ValueOf(v))
 
 	case bd == 0xda, bd == 0xdb, bd >= 0xa0 && bd <= 0xbf:
 		ct = ContainerRawBytes
@@ -303,7 +1020,7 @@ func (d *Decoder) nilIntfDecode(bd0 byte, containerLen0 int, readDesc bool, setC
 			containerLen = d.readContainerLen(bd, false, ct)
 		}
 		if setContainers {
-			rv.Set(d.dam.DecoderContainer(reflect.Value{}, nil, containerLen, ct))
+			rv.Set(d.newContainer(reflect.Value{}, nil, containerLen, ct))
 			rv = rv.Elem()
 		}
 		handled = false
@@ -313,7 +1030,7 @@ func (d *Decoder) nilIntfDecode(bd0 byte, containerLen0 int, readDesc bool, setC
 			containerLen = d.readContainerLen(bd, false, ct)
 		}
 		if setContainers {
-			rv.Set(d.dam.DecoderContainer(reflect.Value{}, nil, containerLen, ct))
+			rv.Set(d.newContainer(reflect.Value{}, nil, containerLen, ct))
 		}
 		handled = false
 	case bd == 0xde, bd == 0xdf, bd >= 0x80 && bd <= 0x8f:
@@ -321,8 +1038,19 @@ func (d *Decoder) nilIntfDecode(bd0 byte, containerLen0 int, readDesc bool, setC
 		if containerLen < 0 {
 			containerLen = d.readContainerLen(bd, false, ct)
 		}
+		if d.opts.DiscriminatorMap && containerLen == 1 && d.types.hasTypes() {
+			if d.decodeDiscriminated(rv, parentcontainer, parentkey) {
+				return
+			}
+		}
+		if d.types.hasTypes() {
+			if rvm := d.newContainer(parentcontainer, parentkey, containerLen, ct); rvm.Kind() == reflect.Map {
+				d.decodeRegistered(bd, containerLen, rvm, rv)
+				return
+			}
+		}
 		if setContainers {
-			rv.Set(d.dam.DecoderContainer(reflect.Value{}, nil, containerLen, ct))
+			rv.Set(d.newContainer(reflect.Value{}, nil, containerLen, ct))
 		}
 		handled = false
 	case bd >= 0xe0 && bd <= 0xff, bd >= 0x00 && bd <= 0x7f:
@@ -335,6 +1063,81 @@ func (d *Decoder) nilIntfDecode(bd0 byte, containerLen0 int, readDesc bool, setC
 	return
 }
 
+// decode a 1-entry map (whose length is already read) into the nil interface rv, 
+// if its key is a registered name (see DecoderOptions.DiscriminatorMap). 
+// If the key is raw bytes which is not a registered name, the map is decoded into rv.
+// Else it returns false, with the stream unchanged.
+func (d *Decoder) decodeDiscriminated(rv reflect.Value, parentcontainer reflect.Value, parentkey interface{}) (
+	handled bool) {
+	bd := d.readDesc()
+	if !(bd == 0xda || bd == 0xdb || (bd >= 0xa0 && bd <= 0xbf)) {
+		d.pb, d.peeked = bd, true
+		return false
+	}
+	var name string
+	d.decodeValue(bd, -1, false, reflect.ValueOf(&name).Elem())
+	if rt := d.types.typeOf(name); rt != nil {
+		if !rt.AssignableTo(rv.Type()) {
+			d.err("Registered type: %v, is not assignable to: %v", rt, rv.Type())
+		}
+		rvn := reflect.New(rt).Elem()
+		d.decodeValueT(0, -1, true, rvn, true, true, true)
+		rv.Set(rvn)
+		return true
+	}
+	rvm := d.newContainer(parentcontainer, parentkey, 1, ContainerMap)
+	if rvm.Kind() != reflect.Map {
+		rvm = reflect.MakeMap(mapIntfIntfTyp)
+	}
+	rvk := reflect.ValueOf(name)
+	if !rvk.Type().ConvertibleTo(rvm.Type().Key()) {
+		d.err("Cannot decode map key: %q, into map type: %v", name, rvm.Type())
+	}
+	rvv := reflect.New(rvm.Type().Elem()).Elem()
+	rvv = d.decodeValueT(0, -1, true, rvv, true, true, true)
+	rvm.SetMapIndex(rvk.Convert(rvm.Type().Key()), rvv)
+	rv.Set(rvm)
+	return true
+}
+
+// decode a map of containerLen entries into the nil interface rv, when types are registered.
+// If the first key is registeredTypeKey, and its value is a registered name (see RegisterName), 
+// a value of that type is decoded from the rest of the map. Else the map is decoded into rvm.
+func (d *Decoder) decodeRegistered(bd byte, containerLen int, rvm reflect.Value, rv reflect.Value) {
+	if containerLen > 0 {
+		d.decodeValue(bd, 1, false, rvm)
+		var name string
+		if rvk := reflect.ValueOf(registeredTypeKey); rvk.Type().AssignableTo(rvm.Type().Key()) {
+			if rvv := rvm.MapIndex(rvk); rvv.IsValid() {
+				switch v := rvv.Interface().(type) {
+				case string:
+					name = v
+				case []byte:
+					name = string(v)
+				}
+			}
+		}
+		if rt := d.types.typeOf(name); rt != nil {
+			var rvn, rvs reflect.Value
+			if rt.Kind() == reflect.Ptr {
+				rvn = reflect.New(rt.Elem())
+				rvs = rvn.Elem()
+			} else {
+				rvs = reflect.New(rt).Elem()
+				rvn = rvs
+			}
+			if !rt.AssignableTo(rv.Type()) {
+				d.err("Registered type: %v, is not assignable to: %v", rt, rv.Type())
+			}
+			d.decodeValue(bd, containerLen - 1, false, rvs)
+			rv.Set(rvn)
+			return
+		}
+		d.decodeValue(bd, containerLen - 1, false, rvm)
+	}
+	rv.Set(rvm)
+}
+
 func (d *Decoder) decodeValue(bd byte, containerLen int, readDesc bool, rv0 reflect.Value) (
 	wasNilIntf bool, rv reflect.Value) {
 	//log(".. enter decode: rv: %v, %T, %v", rv0, rv0.Interface(), rv0.Interface())
@@ -343,19 +1146,66 @@ func (d *Decoder) decodeValue(bd byte, containerLen int, readDesc bool, rv0 refl
 	//}()
 	
 	rv = rv0
+	if d.opts.decFns != nil && containerLen < 0 && rv.IsValid() {
+		if fn := d.opts.decFns[rv.Type()]; fn != nil {
+			if !readDesc {
+				// give the descriptor byte back, so fn reads the whole value
+				d.pb, d.peeked = bd, true
+			}
+			if err := fn(d, rv); err != nil {
+				panic(err)
+			}
+			return
+		}
+	}
+	if containerLen < 0 && rv.IsValid() && rv.Type() == rawMessageTyp {
+		if !readDesc {
+			d.pb, d.peeked = bd, true
+		}
+		var buf bytes.Buffer
+		d.copyValue(&buf)
+		rv.SetBytes(buf.Bytes())
+		return
+	}
 	if readDesc {
-		d.readb(1, d.t1)
-		bd = d.t1[0]
+		bd = d.readDesc()
 	}
 
 	rk := rv.Kind()
+	//an error interface is decoded from a string (see EncoderOptions.EncodeErrorAsString)
+	if rk == reflect.Interface && rv.Type() == errorTyp {
+		if bd == 0xc0 {
+			rv.Set(reflect.Zero(errorTyp))
+			return
+		}
+		var s string
+		d.decodeValue(bd, containerLen, false, reflect.ValueOf(&s).Elem())
+		rv.Set(reflect.ValueOf(errors.New(s)))
+		return
+	}
+	//if interface holds a non-nil pointer or map, decode into it (reusing it), like encoding/json.
+	//else discard whatever it holds, and decode as if it was a nil interface.
+	//an interface with methods (e.g. an embedded interface) can't hold a generically decoded value, 
+	//so a non-pointer value it holds is decoded into (via a copy) to keep its concrete type.
+	if rk == reflect.Interface && !rv.IsNil() {
+		if rve := rv.Elem(); !((rve.Kind() == reflect.Ptr || rve.Kind() == reflect.Map) && !rve.IsNil()) {
+			if bd != 0xc0 && rv.NumMethod() > 0 {
+				rvc := reflect.New(rve.Type()).Elem()
+				rvc.Set(rve)
+				d.decodeValue(bd, containerLen, false, rvc)
+				rv.Set(rvc)
+				return
+			}
+			rv.Set(reflect.Zero(rv.Type()))
+		}
+	}
 	wasNilIntf = rk == reflect.Interface && rv.IsNil()
 
 	//if nil interface, use some hieristics to set the nil interface to an 
 	//appropriate value based on the first byte read (byte descriptor bd)
 	if wasNilIntf {
 		var handled bool
-		rv, bd, _, containerLen, handled = d.nilIntfDecode(bd, containerLen, false, true, rv)
+		rv, bd, _, containerLen, handled = d.nilIntfDecode(bd, containerLen, false, true, rv, reflect.Value{}, nil)
 		if handled {
 			return
 		}
@@ -368,6 +1218,25 @@ func (d *Decoder) decodeValue(bd byte, containerLen int, readDesc bool, rv0 refl
 		return
 	}
 	
+	if (bd == 0xc2 || bd == 0xc3) && d.opts.LenientBool {
+		switch rk {
+		case reflect.Int, reflect.Int64, reflect.Int32, reflect.Int8, reflect.Int16:
+			rv.SetInt(int64(bd - 0xc2))
+			return
+		case reflect.Uint8, reflect.Uint64, reflect.Uint, reflect.Uint32, reflect.Uint16:
+			rv.SetUint(uint64(bd - 0xc2))
+			return
+		case reflect.String:
+			rv.SetString(strconv.FormatBool(bd == 0xc3))
+			return
+		}
+	}
+	if rk == reflect.Bool && d.opts.LenientBool && (bd <= 0x7f || bd >= 0xe0 || (bd >= 0xcc && bd <= 0xd3)) {
+		i, ui := d.decodeInteger(bd, bd < 0xcc || bd > 0xcf)
+		rv.SetBool(i != 0 || ui != 0)
+		return
+	}
+
 	// cases are arranged in sequence of most probable ones
 	switch rk {
 	default:
@@ -381,7 +1250,11 @@ func (d *Decoder) decodeValue(bd byte, containerLen int, readDesc bool, rv0 refl
 		case 0xca:
 			rv.SetFloat(float64(math.Float32frombits(d.readUint32())))
 		case 0xcb:
-			rv.SetFloat(math.Float64frombits(d.readUint64()))
+			f := math.Float64frombits(d.readUint64())
+			if d.opts.StrictNumericConversion && rk == reflect.Float32 && rv.OverflowFloat(f) {
+				d.err("Overflow float value: %v into kind: %v", f, rk)
+			}
+			rv.SetFloat(f)
 			
 		default:
 			d.err("Unhandled single-byte value: %s: %x", msgBadDesc, bd)
@@ -393,12 +1266,18 @@ func (d *Decoder) decodeValue(bd byte, containerLen int, readDesc bool, rv0 refl
 		if containerLen == 0 {
 			break
 		}		
+		d.countAlloc(containerLen)
 		bs := make([]byte, containerLen)
 		d.readb(containerLen, bs)
 		rv.SetString(string(bs))
 	case reflect.Slice:
 		rvtype := rv.Type()
 		rawbytes := rvtype == byteSliceTyp
+		if rawbytes && containerLen < 0 && d.opts.IntArrayAsBytes && 
+			(bd == 0xdc || bd == 0xdd || (bd >= 0x90 && bd <= 0x9f)) {
+			// decode each element as a uint8 
+			rawbytes = false
+		}
 		
 		if containerLen < 0 {
 			if rawbytes {
@@ -408,28 +1287,46 @@ func (d *Decoder) decodeValue(bd byte, containerLen int, readDesc bool, rv0 refl
 			} 
 		}
 		if containerLen == 0 {
+			if rawbytes && rv.Len() > 0 && rv.CanSet() {
+				rv.SetLen(0)
+			} else if rv.IsNil() && rv.CanSet() {
+				// an empty array (or empty raw bytes) decodes into an empty (not nil) slice
+				rv.Set(reflect.MakeSlice(rvtype, 0, 0))
+			}
 			break
 		}
 		
 		if rawbytes {
-			var bs []byte= rv.Bytes()
-			rvlen := len(bs)
-			if rvlen == containerLen {
-			} else if rvlen > containerLen {
+			bs := rv.Bytes()
+			// a []byte which is not settable (e.g. from the DecoderContainerResolver) 
+			// can only be decoded into in place.
+			if !rv.CanSet() {
+				if len(bs) < containerLen {
+					d.err("[]byte len: %d must be >= container Len: %d", len(bs), containerLen)
+				}
+				d.readb(containerLen, bs[:containerLen])
+				break
+			}
+			// decode into a new []byte, unless we can reuse the existing one (if allowed)
+			if d.opts.ReuseByteSlices && cap(bs) >= containerLen {
 				bs = bs[:containerLen]
 			} else {
+				d.countAlloc(containerLen)
 				bs = make([]byte, containerLen)
-				rv.Set(reflect.ValueOf(bs))
 			}
 			d.readb(containerLen, bs)
+			rv.SetBytes(bs)
 			break
 		}
 		
+		// allocations are counted first, so MaxTotalAlloc is checked before allocating
 		if rv.IsNil() {
+			d.countContainer(rv, containerLen)
 			rv.Set(reflect.MakeSlice(rvtype, containerLen, containerLen))
 		} else {
 			rvlen := rv.Len()
 			if containerLen > rv.Cap() {
+				d.countContainer(rv, containerLen)
 				rv2 := reflect.MakeSlice(rvtype, containerLen, containerLen)
 				if rvlen > 0 {
 					reflect.Copy(rv2, rv)
@@ -452,23 +1349,25 @@ func (d *Decoder) decodeValue(bd byte, containerLen int, readDesc bool, rv0 refl
 				containerLen = d.readContainerLen(bd, false, ContainerList)
 			} 
 		}
-		if containerLen == 0 {
-			break
-		}
-		
 		if rawbytes {
+			// e.g. a [32]byte hash must be exactly 32 bytes, unless LenientByteArrayLen is set
+			if containerLen > rvlen || (containerLen < rvlen && !d.opts.LenientByteArrayLen) {
+				d.err("Byte array len: %d does not match raw bytes len: %d", rvlen, containerLen)
+			}
 			var bs []byte = rv.Slice(0, rvlen).Bytes()
-			if rvlen == containerLen {
-				d.readb(containerLen, bs)
-			} else if rvlen > containerLen {
+			if containerLen > 0 {
 				d.readb(containerLen, bs[:containerLen])
-			} else {
-				d.err("Array len: %d must be >= container Len: %d", rvlen, containerLen)
-			} 
+			}
+			for j := containerLen; j < rvlen; j++ {
+				bs[j] = 0
+			}
 			break
 		}
-		
-		rvelemtype := rvtype.Elem()
+		if containerLen == 0 {
+			break
+		}
+		
+		rvelemtype := rvtype.Elem()
 		if rvlen < containerLen {
 			d.err("Array len: %d must be >= container Len: %d", rvlen, containerLen)
 		} else if rvlen > containerLen {
@@ -480,59 +1379,188 @@ func (d *Decoder) decodeValue(bd byte, containerLen int, readDesc bool, rv0 refl
 	case reflect.Struct:
 		rvtype := rv.Type()
 		if rvtype == timeTyp {
+			if bd == 0xda || bd == 0xdb || (bd >= 0xa0 && bd <= 0xbf) {
+				var ts string
+				d.decodeValue(bd, containerLen, false, reflect.ValueOf(&ts).Elem())
+				layout := d.opts.TimeLayout
+				if layout == "" {
+					layout = time.RFC3339
+				}
+				t, err := time.Parse(layout, ts)
+				if err != nil {
+					d.err("Error parsing time: %q: %v", ts, err)
+				}
+				rv.Set(reflect.ValueOf(t))
+				break
+			}
+			if d.opts.IntAsUnixTime && (bd <= 0x7f || bd >= 0xe0 || (bd >= 0xcc && bd <= 0xd3)) {
+				var n int64
+				d.decodeValue(bd, -1, false, reflect.ValueOf(&n).Elem())
+				rv.Set(reflect.ValueOf(unixTime(n, d.opts.UnixTimeUnit)))
+				break
+			}
 			tt := [2]int64{}
 			d.decodeValue(bd, -1, false, reflect.ValueOf(&tt).Elem())
 			rv.Set(reflect.ValueOf(time.Unix(tt[0], tt[1]).UTC()))
 			break
 		}
 		
+		sis := getStructFieldInfos(rvtype)
+		if sis.self != nil && containerLen < 0 {
+			// capture the bytes of the struct as they are read, from its descriptor byte 
+			buf := new(bytes.Buffer)
+			buf.WriteByte(bd)
+			r := d.r
+			d.r = io.TeeReader(r, buf)
+			defer func() {
+				d.r = r
+				sis.self.field(rv).SetBytes(buf.Bytes())
+			}()
+		}
+		if sis.toArray != nil && containerLen < 0 && (bd == 0xdc || bd == 0xdd || (bd >= 0x90 && bd <= 0x9f)) {
+			d.decodeStructArray(bd, rv, sis.toArray)
+			d.validate(rv, sis)
+			break
+		}
+		if sis.dupNames != nil && d.opts.StrictTags {
+			d.err("Struct: %v has several fields named: %s", rvtype, strings.Join(sis.dupNames, ", "))
+		}
 		if containerLen < 0 {
 			containerLen = d.readContainerLen(bd, false, ContainerMap)
 		}
-		if containerLen == 0 {
+		if containerLen == 0 && !sis.hasRequired && !sis.hasDefault {
+			d.validate(rv, sis)
 			break
 		}
+		// the allowlist only applies to the top-level struct
+		fields := d.fields
+		d.fields = nil
+		seen := d.newSeenKeys()
+		var found map[*structFieldInfo]bool
+		// required fields are not checked with an allowlist (the other fields are skipped), 
+		// nor are defaults set.
+		if (sis.hasRequired || sis.hasDefault) && fields == nil {
+			found = make(map[*structFieldInfo]bool, len(sis.sis))
+		}
+		if sis.extras != nil && fields == nil {
+			// the extras are those of this map, not appended to those of a previous decode
+			sis.extras.field(rv).Set(reflect.Zero(rawFieldSliceTyp))
+		}
 		for j := 0; j < containerLen; j++ {
 			rvkencname := ""
 			rvk := reflect.ValueOf(&rvkencname).Elem()
 			d.decodeValue(0, -1, true, rvk)
-			rvksi := getStructFieldInfos(rvtype).getForEncName(rvkencname)
-			if rvksi == nil {
+			if fields != nil && !fields[rvkencname] {
+				d.skipValue()
+				continue
+			}
+			if seen != nil && d.seenKey(seen, rvkencname) {
+				continue
+			}
+			var rvksi *structFieldInfo
+			if d.opts.FieldNameTransform != nil {
+				rvksi = d.getForTransformedName(rvtype, sis, rvkencname)
+			} else {
+				rvksi = sis.getForEncName(rvkencname)
+			}
+			if rvksi == nil && d.opts.CaseInsensitiveFieldMatch {
+				rvksi = sis.getForEncNameFold(rvkencname)
+			}
+			if rvksi == nil && sis.extras != nil && fields == nil {
+				var buf bytes.Buffer
+				d.copyValue(&buf)
+				rvx := sis.extras.field(rv)
+				rvx.Set(reflect.Append(rvx, reflect.ValueOf(RawField{rvkencname, buf.Bytes()})))
+			} else if rvksi == nil {
 				// d.err("DecodeValue: Invalid Enc Field: %s", rvkencname) (skip it)
-				var nilintf0 interface{}
-				d.decodeValueT(0, -1, true, reflect.ValueOf(&nilintf0), true, true, true)
+				d.skipValue()
 			} else {
-				d.decodeValueT(0, -1, true, rvksi.field(rv), true, true, true)
+				if found != nil {
+					found[rvksi] = true
+				}
+				if rvksi.toString {
+					d.decodeFromString(rvksi.field(rv))
+				} else {
+					d.decodeValueT(0, -1, true, rvksi.field(rv), true, true, true)
+				}
+			}
+		}
+		if found != nil {
+			var missing []string
+			for _, si := range sis.sis {
+				if found[si] {
+					continue
+				}
+				if si.required {
+					missing = append(missing, si.encName)
+				} else if si.hasDefault {
+					si.field(rv).Set(si.defaultVal)
+				}
+			}
+			if len(missing) > 0 {
+				panic(&MissingFieldsError{rvtype, missing})
 			}
 		}
+		d.validate(rv, sis)
 	case reflect.Map:
+		// an array of [key, value] arrays (see EncoderOptions.MapAsPairArray)
+		pairs := false
 		if containerLen < 0 {
-			containerLen = d.readContainerLen(bd, false, ContainerMap)
+			if bd == 0xdc || bd == 0xdd || (bd >= 0x90 && bd <= 0x9f) {
+				pairs = true
+				containerLen = d.readContainerLen(bd, false, ContainerList)
+			} else {
+				containerLen = d.readContainerLen(bd, false, ContainerMap)
+			}
 		}
 		if containerLen == 0 {
+			// an empty map decodes into an empty (not nil) map
+			if rv.IsNil() && rv.CanSet() {
+				rv.Set(reflect.MakeMap(rv.Type()))
+			}
 			break
 		}
 		rvtype := rv.Type()
 		ktype, vtype := rvtype.Key(), rvtype.Elem()			
 		if rv.IsNil() {
-			rvn := reflect.MakeMap(rvtype)
-			rv.Set(rvn)
+			d.countContainer(rv, containerLen)
+			rv.Set(reflect.MakeMap(rvtype))
 		}
+		seen := d.newSeenKeys()
 		for j := 0; j < containerLen; j++ {
+			if pairs {
+				if l := d.readContainerLen(0, true, ContainerList); l != 2 {
+					d.err("Map entry: expecting [key, value] array. Got array of length: %d", l)
+				}
+			}
 			rvk := reflect.New(ktype).Elem()
 			rvk = d.decodeValueT(0, -1, true, rvk, true, true, false)
 			
 			if ktype == intfTyp && rvk.Type() == byteSliceTyp {
 				rvk = reflect.ValueOf(string(rvk.Bytes()))
 			}
-			rvv := rv.MapIndex(rvk)
-			if !rvv.IsValid() {
-				rvv = reflect.New(vtype).Elem()
+			// e.g. a struct key (encoded as a map) decoded into a map[interface{}]...
+			if rvk0 := rvk; ktype.Kind() == reflect.Interface {
+				if rvk0.Kind() == reflect.Interface && !rvk0.IsNil() {
+					rvk0 = rvk0.Elem()
+				}
+				if rvk0.IsValid() && !rvk0.Type().Comparable() {
+					d.err("Map key of type: %v cannot be a key of: %v. Decode into a map with the key type", 
+						rvk0.Type(), rvtype)
+				}
+			}
+			if seen != nil && d.seenKey(seen, rvk.Interface()) {
+				continue
+			}
+			//values from MapIndex are not settable, so decode into a settable copy.
+			rvv := reflect.New(vtype).Elem()
+			if rvv0 := rv.MapIndex(rvk); rvv0.IsValid() {
+				rvv.Set(rvv0)
 			}
 			if vtype == intfTyp && rvv.IsNil() {
-				rvv, bd0, ct0, containerLen0, handled0 := d.nilIntfDecode(0, -1, true, false, rvv)
+				rvv, bd0, ct0, containerLen0, handled0 := d.nilIntfDecode(0, -1, true, false, rvv, rv, rvk)
 				if !handled0 {
-					if rvv2 := d.dam.DecoderContainer(rv, rvk, containerLen0, ct0); rvv2.IsValid() {
+					if rvv2 := d.newContainer(rv, rvk, containerLen0, ct0); rvv2.IsValid() {
 						rvv2 = d.decodeValueT(bd0, containerLen0, false, rvv2, false, true, false)
 						rvv.Set(rvv2)
 					} else {
@@ -544,22 +1572,46 @@ func (d *Decoder) decodeValue(bd byte, containerLen int, readDesc bool, rv0 refl
 			}
 			rv.SetMapIndex(rvk, rvv)
 		}
+	case reflect.Complex64, reflect.Complex128:
+		// encoded as a 2-element array: [real, imaginary]
+		var parts [2]float64
+		d.decodeValue(bd, containerLen, false, reflect.ValueOf(&parts).Elem())
+		rv.SetComplex(complex(parts[0], parts[1]))
 	case reflect.Ptr:
 		if rv.IsNil() {
-			rv.Set(reflect.New(rv.Type().Elem()))
+			rv.Set(d.newPtr(rv.Type()))
 		}
 		d.decodeValue(bd, containerLen, false, rv.Elem())
 	case reflect.Interface:
 		d.decodeValue(bd, containerLen, false, rv.Elem())
 	case reflect.Int, reflect.Int64, reflect.Int32, reflect.Int8, reflect.Int16:
-		i, _ := d.decodeInteger(bd, true)
+		var i int64
+		if (bd == 0xca || bd == 0xcb) && d.opts.FloatToInt {
+			i, _ = d.decodeFloatAsInteger(bd, true)
+		} else {
+			i, _ = d.decodeInteger(bd, true)
+		}
 		if rv.OverflowInt(i) {
 			d.err("Overflow int value: %v into kind: %v", i, rk)
 		} else {
 			rv.SetInt(i)
 		}
 	case reflect.Uint8, reflect.Uint64, reflect.Uint, reflect.Uint32, reflect.Uint16:
-		_, ui := d.decodeInteger(bd, false)
+		var ui uint64
+		if (bd == 0xca || bd == 0xcb) && d.opts.FloatToInt {
+			_, ui = d.decodeFloatAsInteger(bd, false)
+		} else if d.opts.LenientUnsigned && ((bd >= 0xd0 && bd <= 0xd3) || bd >= 0xe0) {
+			i, _ := d.decodeInteger(bd, true)
+			ui = uint64(i)
+			if bits := uint(rv.Type().Bits()); i < 0 && bits < 64 {
+				if i < -1<<(bits-1) {
+					d.err("Overflow int value: %v into kind: %v", i, rk)
+				}
+				ui &= 1<<bits - 1
+			}
+		} else {
+			_, ui = d.decodeInteger(bd, false)
+		}
 		if rv.OverflowUint(ui) {
 			d.err("Overflow unsigned int value: %v into kind: %v", ui, rk)
 		} else {
@@ -573,10 +1625,10 @@ func (d *Decoder) decodeValuePostList(rv reflect.Value, containerLen int, elemIs
 	for j := 0; j < containerLen; j++ {
 		rvj := rv.Index(j)
 		if elemIsIntf && rvj.IsNil() {
-			rvj, bd0, ct0, containerLen0, handled0 := d.nilIntfDecode(0, -1, true, false, rvj)
+			rvj, bd0, ct0, containerLen0, handled0 := d.nilIntfDecode(0, -1, true, false, rvj, rv, j)
 			// fmt.Printf("intfTyp: %v, %v, %v, %v, %v\n", rvj.Interface(), bd0, ct0, containerLen0, handled0)
 			if !handled0 {
-				if rvj2 := d.dam.DecoderContainer(rv, j, containerLen0, ct0); rvj2.IsValid() {
+				if rvj2 := d.newContainer(rv, j, containerLen0, ct0); rvj2.IsValid() {
 					rvj2 = d.decodeValueT(bd0, containerLen0, false, rvj2, false, true, false)
 					rvj.Set(rvj2)
 				} else {
@@ -589,6 +1641,313 @@ func (d *Decoder) decodeValuePostList(rv reflect.Value, containerLen int, elemIs
 	}
 }
 	
+// PeekType returns the type of the next value in the stream, without consuming it.
+// It reads the descriptor byte of the value, and holds on to it for the next read. 
+func (d *Decoder) PeekType() (mt MsgpackType, err error) {
+	defer panicToErr(&err)
+	if !d.peeked {
+		d.readb(1, d.t1)
+		d.pb, d.peeked = d.t1[0], true
+	}
+	switch bd := d.pb; {
+	case bd == 0xc0:
+		mt = MsgpackNil
+	case bd == 0xc2, bd == 0xc3:
+		mt = MsgpackBool
+	case bd == 0xca, bd == 0xcb:
+		mt = MsgpackFloat
+	case bd >= 0xcc && bd <= 0xcf:
+		mt = MsgpackUint
+	case bd >= 0xd0 && bd <= 0xd3, bd >= 0xe0, bd <= 0x7f:
+		mt = MsgpackInt
+	case bd == 0xda, bd == 0xdb, bd >= 0xa0 && bd <= 0xbf:
+		mt = MsgpackRawBytes
+	case bd == 0xdc, bd == 0xdd, bd >= 0x90 && bd <= 0x9f:
+		mt = MsgpackArray
+	case bd == 0xde, bd == 0xdf, bd >= 0x80 && bd <= 0x8f:
+		mt = MsgpackMap
+	case bd == 0xc1:
+		err = ErrInvalidByte
+	default:
+		err = fmt.Errorf("%s: PeekType: %s: hex: %x, dec: %d", msgTagDec, msgBadDesc, bd, bd)
+	}
+	return
+}
+
+// CopyValue copies the raw bytes of the next value in the stream to dst,
+// without decoding it. Containers (maps and arrays) are copied in full.
+// 
+// It is useful for relaying msgpack values (e.g. between connections) without
+// having to decode and re-encode them.
+func (d *Decoder) CopyValue(dst io.Writer) (err error) {
+	defer panicToErr(&err)
+	d.copyValue(dst)
+	return
+}
+
+// SkipValue reads and discards the next value in the stream, without decoding it. 
+// Containers (maps and arrays) are skipped in full. 
+// 
+// The stream must be at a value boundary (e.g. after a successful Decode, or PeekType). 
+// It allows recovering from a value which cannot be decoded into the expected type 
+// (e.g. one of an unexpected type, as reported by PeekType), by skipping it and 
+// continuing with the next value. A Decode which fails partway leaves the stream 
+// within the value, so it cannot be skipped.
+func (d *Decoder) SkipValue() (err error) {
+	defer panicToErr(&err)
+	d.skipValue()
+	return
+}
+
+// call the Validate method of the decoded struct rv, if it implements Validator.
+func (d *Decoder) validate(rv reflect.Value, sis *structFieldInfos) {
+	var v Validator
+	if !rv.CanInterface() {
+		return
+	} else if sis.validator {
+		v = rv.Interface().(Validator)
+	} else if sis.ptrValidator && rv.CanAddr() {
+		v = rv.Addr().Interface().(Validator)
+	} else {
+		return
+	}
+	if err := v.Validate(); err != nil {
+		panic(&ValidationError{rv.Type(), err})
+	}
+}
+
+// unixTime returns the time n units after the unix epoch (in UTC).
+func unixTime(n int64, unit time.Duration) time.Time {
+	if unit <= 0 {
+		unit = time.Second
+	}
+	// any unit (e.g. 1500ms) is split into seconds and nanoseconds. n*nsecs nanoseconds
+	// may not fit an int64, so it is added as (n/1e9)*nsecs seconds and (n%1e9)*nsecs nanoseconds.
+	secs, nsecs := int64(unit/time.Second), int64(unit%time.Second)
+	return time.Unix(n*secs + n/1e9*nsecs, n%1e9*nsecs).UTC()
+}
+
+// decode an array into the fields fsis of the struct rv, by position (see the "toarray" option). 
+// Extra elements are skipped, and fields beyond the length of the array are left as is.
+func (d *Decoder) decodeStructArray(bd byte, rv reflect.Value, fsis []*structFieldInfo) {
+	containerLen := d.readContainerLen(bd, false, ContainerList)
+	for j := 0; j < containerLen; j++ {
+		if j >= len(fsis) {
+			d.skipValue()
+		} else if fsis[j].toString {
+			d.decodeFromString(fsis[j].field(rv))
+		} else {
+			d.decodeValueT(0, -1, true, fsis[j].field(rv), true, true, true)
+		}
+	}
+	// the fields past the end of a shorter array are absent
+	var missing []string
+	for j := containerLen; j < len(fsis); j++ {
+		if fsis[j].required {
+			missing = append(missing, fsis[j].encName)
+		} else if fsis[j].hasDefault {
+			fsis[j].field(rv).Set(fsis[j].defaultVal)
+		}
+	}
+	if len(missing) > 0 {
+		panic(&MissingFieldsError{rv.Type(), missing})
+	}
+}
+
+// decode a number or bool (or pointer to one) from a string, for fields with the 
+// "string" tag option. Other values (in the stream or target) are decoded as usual.
+func (d *Decoder) decodeFromString(rv reflect.Value) {
+	bd := d.readDesc()
+	rt := rv.Type()
+	if rt.Kind() == reflect.Ptr {
+		rt = rt.Elem()
+	}
+	switch rt.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int64, reflect.Int32, reflect.Int16, 
+		reflect.Uint8, reflect.Uint64, reflect.Uint, reflect.Uint32, reflect.Uint16,
+		reflect.Float32, reflect.Float64, reflect.Bool:
+	default:
+		d.decodeValueT(bd, -1, false, rv, true, true, true)
+		return
+	}
+	if !(bd == 0xda || bd == 0xdb || (bd >= 0xa0 && bd <= 0xbf)) {
+		d.decodeValueT(bd, -1, false, rv, true, true, true)
+		return
+	}
+	var s string
+	d.decodeValue(bd, -1, false, reflect.ValueOf(&s).Elem())
+	if rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			rv.Set(d.newPtr(rv.Type()))
+		}
+		rv = rv.Elem()
+	}
+	var err error
+	switch rk := rv.Kind(); rk {
+	case reflect.Int, reflect.Int8, reflect.Int64, reflect.Int32, reflect.Int16:
+		var i int64
+		if i, err = strconv.ParseInt(s, 10, rt.Bits()); err == nil {
+			rv.SetInt(i)
+		}
+	case reflect.Uint8, reflect.Uint64, reflect.Uint, reflect.Uint32, reflect.Uint16:
+		var ui uint64
+		if ui, err = strconv.ParseUint(s, 10, rt.Bits()); err == nil {
+			rv.SetUint(ui)
+		}
+	case reflect.Float32, reflect.Float64:
+		var f float64
+		if f, err = strconv.ParseFloat(s, rt.Bits()); err == nil {
+			rv.SetFloat(f)
+		}
+	case reflect.Bool:
+		var b bool
+		if b, err = strconv.ParseBool(s); err == nil {
+			rv.SetBool(b)
+		}
+	}
+	if err != nil {
+		d.err("Error decoding string into %v: %v", rt, err)
+	}
+}
+
+// get the struct field for a key, with names of untagged fields transformed 
+// by DecoderOptions.FieldNameTransform. The transformed names are cached per type.
+func (d *Decoder) getForTransformedName(rt reflect.Type, sis *structFieldInfos, name string) *structFieldInfo {
+	tn, ok := d.tnames[rt]
+	if !ok {
+		tn = make(map[string]*structFieldInfo, len(sis.sis))
+		for _, si := range sis.sis {
+			if si.tagged {
+				tn[si.encName] = si
+			} else {
+				tn[d.opts.FieldNameTransform(si.name)] = si
+			}
+		}
+		if d.tnames == nil {
+			d.tnames = make(map[reflect.Type]map[string]*structFieldInfo)
+		}
+		d.tnames[rt] = tn
+	}
+	return tn[name]
+}
+
+// skip the next value in the stream, without decoding it.
+func (d *Decoder) skipValue() {
+	d.copyValue(ioutil.Discard)
+}
+
+// copy the next value from the stream into w.
+func (d *Decoder) copyValue(w io.Writer) {
+	bd := d.readDesc()
+	d.writeb(w, d.t1)
+	var n int
+	switch {
+	case bd <= 0x7f, bd >= 0xe0, bd == 0xc0, bd == 0xc2, bd == 0xc3:
+	case bd == 0xcc, bd == 0xd0:
+		d.copyb(w, 1)
+	case bd == 0xcd, bd == 0xd1:
+		d.copyb(w, 2)
+	case bd == 0xca, bd == 0xce, bd == 0xd2:
+		d.copyb(w, 4)
+	case bd == 0xcb, bd == 0xcf, bd == 0xd3:
+		d.copyb(w, 8)
+	case bd >= 0xa0 && bd <= 0xbf:
+		d.copyb(w, int(bd & 0x1f))
+	case bd == 0xda, bd == 0xdb:
+		n = d.readContainerLen(bd, false, ContainerRawBytes)
+		d.writeContainerLenBytes(w, bd)
+		d.copyb(w, n)
+	case bd >= 0x90 && bd <= 0x9f, bd == 0xdc, bd == 0xdd:
+		n = d.readContainerLen(bd, false, ContainerList)
+		d.writeContainerLenBytes(w, bd)
+		for j := 0; j < n; j++ {
+			d.copyValue(w)
+		}
+	case bd >= 0x80 && bd <= 0x8f, bd == 0xde, bd == 0xdf:
+		n = d.readContainerLen(bd, false, ContainerMap)
+		d.writeContainerLenBytes(w, bd)
+		for j := 0; j < 2*n; j++ {
+			d.copyValue(w)
+		}
+	default:
+		d.err("copyValue: %s: hex: %x, dec: %d", msgBadDesc, bd, bd)
+	}
+}
+
+// write the length bytes just read by readContainerLen (for a 16 or 32-bit length).
+func (d *Decoder) writeContainerLenBytes(w io.Writer, bd byte) {
+	switch bd {
+	case 0xda, 0xdc, 0xde:
+		d.writeb(w, d.t2)
+	case 0xdb, 0xdd, 0xdf:
+		d.writeb(w, d.t4)
+	}
+}
+
+// copy a number of bytes from the stream into w
+func (d *Decoder) copyb(w io.Writer, numbytes int) {
+	// small copies (e.g. numbers) go through the scratch array, to avoid io.CopyN's allocations
+	var err error
+	if numbytes <= len(d.x) {
+		bs := d.x[:numbytes]
+		if _, err = io.ReadFull(d.r, bs); err == nil {
+			d.writeb(w, bs)
+		}
+	} else {
+		_, err = io.CopyN(w, d.r, int64(numbytes))
+	}
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		d.err("Error: %v", err)
+	}
+}
+
+// write bs into w
+func (d *Decoder) writeb(w io.Writer, bs []byte) {
+	if _, err := w.Write(bs); err != nil {
+		d.err("Error: %v", err)
+	}
+}
+	
+// returns a set to track the keys of a map in the stream (to detect duplicates), 
+// or nil if not needed (LastWins just overwrites).
+func (d *Decoder) newSeenKeys() (seen map[interface{}]bool) {
+	if d.opts.DuplicateKeyPolicy != DuplicateKeyLastWins {
+		seen = make(map[interface{}]bool)
+	}
+	return
+}
+
+// track a map key just decoded. If it is a duplicate, handle it per DuplicateKeyPolicy
+// (skipping its value for FirstWins) and return true.
+func (d *Decoder) seenKey(seen map[interface{}]bool, k interface{}) bool {
+	if !seen[k] {
+		seen[k] = true
+		return false
+	}
+	if d.opts.DuplicateKeyPolicy == DuplicateKeyError {
+		d.err("Duplicate map key: %v", k)
+	}
+	d.skipValue()
+	return true
+}
+
+// allocate a new value for a nil pointer of type ptrType.
+func (d *Decoder) newPtr(ptrType reflect.Type) (rv reflect.Value) {
+	if d.opts.NewFunc != nil {
+		if v := d.opts.NewFunc(ptrType.Elem()); v != nil {
+			if rv = reflect.ValueOf(v); rv.Type() != ptrType {
+				d.err("NewFunc: Expecting type: %v, Got: %v", ptrType, rv.Type())
+			}
+			return
+		}
+	}
+	d.countAlloc(int(ptrType.Elem().Size()))
+	return reflect.New(ptrType.Elem())
+}
+
 // decode an integer from the stream
 func (d *Decoder) decodeInteger(bd byte, sign bool) (i int64, ui uint64) {
 	switch {
@@ -664,11 +2023,109 @@ func (d *Decoder) decodeInteger(bd byte, sign bool) (i int64, ui uint64) {
 	default:
 		d.err("Unhandled single-byte unsigned integer value: %s: %x", msgBadDesc, bd)
 	}
+	d.checkIntFormat(bd, i, ui)
+	return
+}
+
+// In Strict mode, error if an integer is not written in the smallest format
+// which can hold it (amongst the fixnums, and the signed or unsigned formats).
+func (d *Decoder) checkIntFormat(bd byte, i int64, ui uint64) {
+	if !d.opts.Strict {
+		return
+	}
+	ok := true
+	switch bd {
+	case 0xcc:
+		ok = ui > math.MaxInt8
+	case 0xcd:
+		ok = ui > math.MaxUint8
+	case 0xce:
+		ok = ui > math.MaxUint16
+	case 0xcf:
+		ok = ui > math.MaxUint32
+	case 0xd0:
+		ok = i < -32
+	case 0xd1:
+		ok = i < math.MinInt8 || i > math.MaxInt8
+	case 0xd2:
+		ok = i < math.MinInt16 || i > math.MaxInt16
+	case 0xd3:
+		ok = i < math.MinInt32 || i > math.MaxInt32
+	}
+	if !ok {
+		var v interface{} = i
+		if bd <= 0xcf {
+			v = ui
+		}
+		d.err("Strict: integer not in smallest format: hex: %x, value: %v", bd, v)
+	}
+}
+
+// decode a number from the stream as a Number. ok is false if bd is not a number.
+func (d *Decoder) decodeNumber(bd byte) (n Number, ok bool) {
+	ok = true
+	switch {
+	case bd == 0xca:
+		n = Number(strconv.FormatFloat(float64(math.Float32frombits(d.readUint32())), 'g', -1, 32))
+	case bd == 0xcb:
+		n = Number(strconv.FormatFloat(math.Float64frombits(d.readUint64()), 'g', -1, 64))
+	case bd >= 0xcc && bd <= 0xcf:
+		_, ui := d.decodeInteger(bd, false)
+		n = Number(strconv.FormatUint(ui, 10))
+	case bd >= 0xd0 && bd <= 0xd3, bd >= 0xe0 && bd <= 0xff, bd >= 0x00 && bd <= 0x7f:
+		i, _ := d.decodeInteger(bd, true)
+		n = Number(strconv.FormatInt(i, 10))
+	default:
+		ok = false
+	}
+	return
+}
+
+// decode a float from the stream into an integer (if FloatToInt is set).
+// The fraction is truncated, unless StrictNumericConversion is set (then it's an error).
+func (d *Decoder) decodeFloatAsInteger(bd byte, sign bool) (i int64, ui uint64) {
+	var f float64
+	if bd == 0xca {
+		f = float64(math.Float32frombits(d.readUint32()))
+	} else {
+		f = math.Float64frombits(d.readUint64())
+	}
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		d.err("Cannot convert float value: %v to integer", f)
+	}
+	if ft := math.Trunc(f); ft != f {
+		if d.opts.StrictNumericConversion {
+			d.err("Lossy conversion of float value: %v to integer", f)
+		}
+		f = ft
+	}
+	if sign {
+		// float64(math.MaxInt64) rounds up to 2^63, which overflows
+		if f < math.MinInt64 || f >= math.MaxInt64 {
+			d.err("Overflow float value: %v into signed integer", f)
+		}
+		i = int64(f)
+	} else {
+		if f < 0 {
+			d.err("Assigning negative float value: %v, to unsigned type", f)
+		} else if f >= math.MaxUint64 {
+			d.err("Overflow float value: %v into unsigned integer", f)
+		}
+		ui = uint64(f)
+	}
 	return
 }
 
 // read a number of bytes into bs
 func (d *Decoder) readb(numbytes int, bs []byte) {
+	if d.peeked {
+		d.peeked = false
+		bs[0] = d.pb
+		if numbytes == 1 {
+			return
+		}
+		bs, numbytes = bs[1:], numbytes - 1
+	}
 	n, err := io.ReadAtLeast(d.r, bs, numbytes) 
 	if err != nil {
 		// propagage io.EOF upwards (it's special, and must be returned AS IS)
@@ -682,6 +2139,15 @@ func (d *Decoder) readb(numbytes int, bs []byte) {
 	}
 }
 
+// read the descriptor byte of the next value
+func (d *Decoder) readDesc() (bd byte) {
+	d.readb(1, d.t1)
+	if bd = d.t1[0]; bd == 0xc1 {
+		panic(ErrInvalidByte)
+	}
+	return
+}
+
 func (d *Decoder) readUint8() uint8 {
 	d.readb(1, d.t1)
 	return d.t1[0]
@@ -705,30 +2171,332 @@ func (d *Decoder) readUint64() uint64 {
 func (d *Decoder) readContainerLen(bd byte, readDesc bool, ct ContainerType) (l int) {
 	// bd is the byte descriptor. First byte is always descriptive.
 	if readDesc {
-		d.readb(1, d.t1)
-		bd = d.t1[0]
+		bd = d.readDesc()
 	}
-	_, b0, b1, b2 := getContainerByteDesc(ct)
+	cutoff, b0, b1, b2 := getContainerByteDesc(ct)
 
 	switch {
 	case bd == b1:
 		l = int(d.readUint16())
+		if d.opts.Strict && l < cutoff {
+			d.err("Strict: container length: %d not in smallest format: hex: %x", l, bd)
+		}
 	case bd == b2:
-		l = int(d.readUint32())
+		l32 := d.readUint32()
+		var ok bool
+		if l, ok = uint32ToInt(l32, strconv.IntSize); !ok {
+			d.err("readContainerLen: length: %d overflows int", l32)
+		}
+		if d.opts.Strict && l < 65536 {
+			d.err("Strict: container length: %d not in smallest format: hex: %x", l, bd)
+		}
 	case (b0 & bd) == b0:
 		l = int(b0 ^ bd)
 	default:
 		d.err("readContainerLen: %s: hex: %x, dec: %d", msgBadDesc, bd, bd)
 	}
+	switch {
+	case ct == ContainerMap && d.opts.MaxMapLen > 0 && l > d.opts.MaxMapLen:
+		d.err("Map length: %d exceeds MaxMapLen: %d", l, d.opts.MaxMapLen)
+	case ct == ContainerList && d.opts.MaxArrayLen > 0 && l > d.opts.MaxArrayLen:
+		d.err("Array length: %d exceeds MaxArrayLen: %d", l, d.opts.MaxArrayLen)
+	}
 	return	
 }
 
+// uint32ToInt converts a 32-bit length from the stream to an int (of intBitsize bits).
+// ok is false if it overflows (as a large length can on 32-bit platforms), 
+// so we never use a negative length.
+func uint32ToInt(l uint32, intBitsize int) (i int, ok bool) {
+	if intBitsize < 64 && uint64(l) > (uint64(1) << uint(intBitsize - 1)) - 1 {
+		return
+	}
+	return int(l), true
+}
+
 func (d *Decoder) err(format string, params ...interface{}) {
 	doPanic(msgTagDec, format, params)
 }
 
 // Unmarshal is a convenience function which decodes a stream of bytes into v.
+// data must hold a single value: bytes left after it are a *TrailingBytesError.
 // It delegates to Decoder.Decode.
 func Unmarshal(data []byte, v interface{}, dam DecoderContainerResolver) error {
-	return NewDecoder(bytes.NewBuffer(data), dam).Decode(v)
+	opts := DefaultDecoderOptions
+	opts.ErrorOnTrailingBytes = true
+	return NewDecoderWithOptions(bytes.NewReader(data), dam, &opts).Decode(v)
+}
+
+// ErrBadMagic is returned by a WrappedDecoder when a header does not start with its magic bytes.
+var ErrBadMagic = errors.New(msgTagDec + ": Bad magic bytes in header")
+
+// A VersionMismatchError is returned by a WrappedDecoder when 
+// the version in a header is not the one it expects.
+type VersionMismatchError struct {
+	Expected, Got uint8
+}
+
+func (e *VersionMismatchError) Error() string {
+	return fmt.Sprintf("%v: version mismatch: expected: %d, got: %d", msgTagDec, e.Expected, e.Got)
+}
+
+// A WrappedDecoder reads values written by a WrappedEncoder, each after a header 
+// of magic bytes and a version byte. The header is validated and stripped before 
+// each value is decoded: a header with other magic bytes is ErrBadMagic, and a header 
+// with another version is a *VersionMismatchError. 
+// Only the methods which read a header are exposed, so the stream cannot get out of step.
+type WrappedDecoder struct {
+	d *Decoder
+	r io.Reader
+	magic []byte
+	version uint8
+	header []byte
+}
+
+// NewWrappedDecoder returns a WrappedDecoder which reads values from r, 
+// each after a header of magic and version.
+// If nil DecoderOptions is passed, we use DefaultDecoderOptions.
+func NewWrappedDecoder(r io.Reader, magic []byte, version uint8, dam DecoderContainerResolver, 
+	opts *DecoderOptions) *WrappedDecoder {
+	return &WrappedDecoder{
+		d: NewDecoderWithOptions(r, dam, opts), 
+		r: r, 
+		magic: magic, 
+		version: version, 
+		header: make([]byte, len(magic) + 1),
+	}
+}
+
+// Decode reads and validates the header, then decodes the value after it into v 
+// (see Decoder.Decode). At the end of the stream, it returns io.EOF.
+func (d *WrappedDecoder) Decode(v interface{}) (err error) {
+	if err = d.readHeader(); err != nil {
+		return
+	}
+	return d.d.Decode(v)
+}
+
+// DecodeValue reads and validates the header, then decodes the value after it into rv 
+// (see Decoder.DecodeValue).
+func (d *WrappedDecoder) DecodeValue(rv reflect.Value) (err error) {
+	if err = d.readHeader(); err != nil {
+		return
+	}
+	return d.d.DecodeValue(rv)
+}
+
+// read and validate the header of the next value.
+func (d *WrappedDecoder) readHeader() (err error) {
+	if _, err = io.ReadFull(d.r, d.header); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = ErrBadMagic
+		}
+		return
+	}
+	if !bytes.Equal(d.header[:len(d.magic)], d.magic) {
+		return ErrBadMagic
+	}
+	if ver := d.header[len(d.magic)]; ver != d.version {
+		return &VersionMismatchError{d.version, ver}
+	}
+	return
+}
+
+// Dump writes a human-readable, indented representation of the values in data to w, 
+// showing the type and value of each (and the length of containers), e.g. for 
+// inspecting unknown payloads while debugging. Raw bytes are shown as a quoted string 
+// if they are valid UTF-8, else in hex. A sample output:
+//   map(2) {
+//     raw(1) "a": int 1
+//     raw(1) "b": array(2) [
+//       float64 1.5
+//       raw(2) 0xc1ff
+//     ]
+//   }
+func Dump(data []byte, w io.Writer) (err error) {
+	defer panicToErr(&err)
+	d := NewDecoder(bytes.NewReader(data), nil)
+	for {
+		if _, err = d.PeekType(); err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return
+		}
+		d.dumpValue(w, "", "")
+	}
+}
+
+func (d *Decoder) dumpValue(w io.Writer, indent string, prefix string) {
+	mt, err := d.PeekType()
+	if err != nil {
+		panic(err)
+	}
+	switch mt {
+	case MsgpackArray:
+		l := d.readContainerLen(0, true, ContainerList)
+		d.dumpf(w, "%s%sarray(%d) [\n", indent, prefix, l)
+		for j := 0; j < l; j++ {
+			d.dumpValue(w, indent + "  ", "")
+		}
+		d.dumpf(w, "%s]\n", indent)
+	case MsgpackMap:
+		l := d.readContainerLen(0, true, ContainerMap)
+		d.dumpf(w, "%s%smap(%d) {\n", indent, prefix, l)
+		for j := 0; j < l; j++ {
+			// scalar keys are shown inline, before their value
+			if mt, err = d.PeekType(); err != nil {
+				panic(err)
+			}
+			if mt == MsgpackArray || mt == MsgpackMap {
+				d.dumpValue(w, indent + "  ", "key: ")
+				d.dumpValue(w, indent + "  ", "val: ")
+			} else {
+				d.dumpValue(w, indent + "  ", d.dumpScalar(mt) + ": ")
+			}
+		}
+		d.dumpf(w, "%s}\n", indent)
+	default:
+		d.dumpf(w, "%s%s%s\n", indent, prefix, d.dumpScalar(mt))
+	}
+}
+
+// returns the next value in the stream (not a container) as a string.
+func (d *Decoder) dumpScalar(mt MsgpackType) string {
+	switch v := d.decodeScalar(mt).(type) {
+	case nil:
+		return "nil"
+	case []byte:
+		if utf8.Valid(v) {
+			return fmt.Sprintf("raw(%d) %q", len(v), v)
+		}
+		return fmt.Sprintf("raw(%d) 0x%x", len(v), v)
+	default:
+		return fmt.Sprintf("%T %v", v, v)
+	}
+}
+
+// decodes the next value in the stream (not a container) into its natural type: 
+// nil, bool, int64, uint64, float32, float64 or []byte.
+func (d *Decoder) decodeScalar(mt MsgpackType) interface{} {
+	var v interface{}
+	switch mt {
+	case MsgpackNil:
+		d.readDesc()
+		return nil
+	case MsgpackRawBytes:
+		v = new([]byte)
+	case MsgpackBool:
+		v = new(bool)
+	case MsgpackInt:
+		v = new(int64)
+	case MsgpackUint:
+		v = new(uint64)
+	case MsgpackFloat:
+		if d.pb == 0xca {
+			v = new(float32)
+		} else {
+			v = new(float64)
+		}
+	default:
+		d.err("decodeScalar: Unexpected type: %v", mt)
+	}
+	rv := reflect.ValueOf(v).Elem()
+	d.decodeValueT(0, -1, true, rv, true, true, true)
+	return rv.Interface()
+}
+
+func (d *Decoder) dumpf(w io.Writer, format string, params ...interface{}) {
+	if _, err := fmt.Fprintf(w, format, params...); err != nil {
+		panic(err)
+	}
+}
+
+// DecodeToJSON reads the next value from the stream, and writes its JSON equivalent to w, 
+// without decoding it into Go values first (e.g. for a gateway translating msgpack to JSON).
+// 
+// Raw bytes are written as a string if they are valid UTF-8, else as a base64-encoded 
+// (standard encoding) string. Map keys which are not raw bytes are written as strings 
+// of their value (e.g. 1 as "1", nil as "null"). A map key which is a container, 
+// or a float which is NaN or infinite, is an error (as JSON cannot represent it).
+func (d *Decoder) DecodeToJSON(w io.Writer) (err error) {
+	defer panicToErr(&err)
+	d.jsonValue(w, false)
+	return
+}
+
+func (d *Decoder) jsonValue(w io.Writer, isKey bool) {
+	mt, err := d.PeekType()
+	if err != nil {
+		panic(err)
+	}
+	switch mt {
+	case MsgpackArray, MsgpackMap:
+		if isKey {
+			d.err("DecodeToJSON: Map key cannot be a container: %v", mt)
+		}
+		if mt == MsgpackArray {
+			l := d.readContainerLen(0, true, ContainerList)
+			d.dumpf(w, "[")
+			for j := 0; j < l; j++ {
+				if j > 0 {
+					d.dumpf(w, ",")
+				}
+				d.jsonValue(w, false)
+			}
+			d.dumpf(w, "]")
+		} else {
+			l := d.readContainerLen(0, true, ContainerMap)
+			d.dumpf(w, "{")
+			for j := 0; j < l; j++ {
+				if j > 0 {
+					d.dumpf(w, ",")
+				}
+				d.jsonValue(w, true)
+				d.dumpf(w, ":")
+				d.jsonValue(w, false)
+			}
+			d.dumpf(w, "}")
+		}
+		return
+	}
+	var s string
+	quote := isKey
+	switch v := d.decodeScalar(mt).(type) {
+	case nil:
+		s = "null"
+	case bool:
+		s = strconv.FormatBool(v)
+	case int64:
+		s = strconv.FormatInt(v, 10)
+	case uint64:
+		s = strconv.FormatUint(v, 10)
+	case float32:
+		s = d.jsonFloat(float64(v), 32)
+	case float64:
+		s = d.jsonFloat(v, 64)
+	case []byte:
+		if utf8.Valid(v) {
+			s = string(v)
+		} else {
+			s = base64.StdEncoding.EncodeToString(v)
+		}
+		quote = true
+	}
+	if quote {
+		bs, err := json.Marshal(s)
+		if err != nil {
+			panic(err)
+		}
+		d.writeb(w, bs)
+	} else {
+		d.dumpf(w, "%s", s)
+	}
+}
+
+func (d *Decoder) jsonFloat(f float64, bitSize int) string {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		d.err("DecodeToJSON: Unsupported float value: %v", f)
+	}
+	return strconv.FormatFloat(f, 'g', -1, bitSize)
 }
@@ -48,6 +48,13 @@ import (
 	"math"
 	"time"
 	"encoding/binary"
+	"strconv"
+	"sort"
+	"strings"
+	"fmt"
+	"encoding"
+	"encoding/base64"
+	"encoding/json"
 )
 
 var (
@@ -55,16 +62,211 @@ var (
 	msgTagEnc = "msgpack.encoder"
 ) 
 
+// Default EncoderOptions used when a nil parameter is passed to NewEncoderWithOptions().
+var DefaultEncoderOptions = EncoderOptions{}
+
+// EncoderOptions holds options which control how an Encoder encodes values.
+// The zero value matches the behaviour of NewEncoder().
+type EncoderOptions struct {
+	// If set, map keys are sorted by their encoded bytes, so that a map always 
+	// encodes to the same bytes regardless of iteration order (even for 
+	// map[interface{}]... with keys of mixed types).
+	Canonical bool
+	// Maximum depth of nested values (containers, pointers, etc) to encode, 
+	// beyond which an error is returned. It is a cheap guard against cyclic data 
+	// structures, which would otherwise recurse until the stack overflows.
+	// If 0, defaultEncMaxDepth is used.
+	MaxDepth int
+	// If set, map keys which implement encoding.TextMarshaler (or else fmt.Stringer)
+	// are encoded as their text (a string), e.g. for consumers which need string keys.
+	MapKeyAsString bool
+	// If set, complex numbers are encoded as a 2-element array: [real, imaginary]
+	// (as float32 for complex64, and float64 for complex128). Else they are unsupported.
+	// The Decoder always decodes such an array into a complex number.
+	EncodeComplex bool
+	// If set, and the writer has a Flush() error method (e.g. bufio.Writer), 
+	// it is flushed after each call to Encode or EncodeValue (and to EncodeEnd, 
+	// for an array of unknown length, which is written then).
+	AutoFlush bool
+	// If set, values of static type error (e.g. a struct field declared as error) 
+	// are encoded as the string returned by their Error() method, and a nil error as nil.
+	// Else the concrete value held by the error is encoded.
+	EncodeErrorAsString bool
+	// If non-nil, it is called for each struct field (with the Go field name and value), 
+	// and the field is omitted if it returns true. A field is omitted if either 
+	// OmitFunc or the omitempty tag option says so.
+	OmitFunc func(fieldName string, v reflect.Value) bool
+	// If set, a nil interface (e.g. Encode(nil), or a nil interface{} field) is encoded 
+	// as an empty map, for consumers which expect an object. Else it is encoded as nil.
+	// A typed nil (e.g. a nil pointer held in an interface) is always encoded as nil.
+	NilInterfaceAsEmpty bool
+	// If set, a uintptr is encoded as an unsigned integer. Else it is an UnsupportedTypeError,
+	// as a pointer value is almost always a bug to encode (it is meaningless in another process).
+	AllowUintptr bool
+	// If set, bools are encoded as the integers 0 and 1, for consumers which expect them.
+	// They can be decoded back into a bool with DecoderOptions.LenientBool.
+	BoolAsInt bool
+	// If non-nil, map keys are sorted with it (it reports whether key a sorts before b),
+	// e.g. to order keys by a rule of the protocol. It takes precedence over Canonical.
+	MapKeySort func(a, b reflect.Value) bool
+	// If set, struct fields without a name in their tag are encoded with their name 
+	// lowercased (e.g. "UserID" as "userid"). Decode them with DecoderOptions.CaseInsensitiveFieldMatch.
+	LowerCaseFieldNames bool
+	// If non-nil, struct fields without a name in their tag are encoded with the name 
+	// it returns for their field name (e.g. to convert "UserID" to "user_id").
+	// Use the same function in DecoderOptions.FieldNameTransform to decode them.
+	// It takes precedence over LowerCaseFieldNames.
+	FieldNameTransform func(string) string
+	// If set, a time.Time is encoded as a string formatted with TimeLayout, 
+	// instead of a [seconds, nanoseconds] array. 
+	// It is decoded back with the same layout in DecoderOptions.TimeLayout.
+	TimeAsString bool
+	// Layout used to format a time.Time if TimeAsString is set. If empty, time.RFC3339 is used.
+	TimeLayout string
+	// If non-nil, EncodeFromJSON decodes JSON strings from base64 (standard encoding), 
+	// and writes the decoded bytes, if they are the value of an object key for which 
+	// it returns true (or the elements of an array which is such a value).
+	JSONBase64Field func(key string) bool
+	// If > 0, encoding a string longer than this (in bytes) is an error, 
+	// e.g. to enforce the limits of a protocol before a message is sent.
+	MaxStringLen int
+	// If > 0, encoding a []byte (or byte array) longer than this is an error.
+	MaxBinLen int
+	// If set, a nil slice or map is encoded as an empty array or map 
+	// (and a nil []byte as empty raw bytes). Else it is encoded as nil, 
+	// so consumers can tell an absent collection from an empty one.
+	NilCollectionAsEmpty bool
+	// If set, maps are encoded as an array of [key, value] arrays (ordered as 
+	// for a map, e.g. by MapKeySort), for consumers which expect arrays 
+	// (e.g. for ordered maps, or keys which are not strings). 
+	// The Decoder rebuilds the map when decoding such an array into a typed map 
+	// (or a struct field of a map type). Decoded into a nil interface{}, it stays 
+	// an array of 2-element arrays, as nothing in the stream marks it as a map.
+	MapAsPairArray bool
+	// If non-nil, it is called with the struct type and (Go) field name of each field 
+	// dropped by the omitempty (or omitnil) tag option, e.g. to debug why a field is missing from the output.
+	DroppedFieldsCallback func(structType reflect.Type, fieldName string)
+	// If non-nil, only the map entries for which it returns true are encoded 
+	// (e.g. to drop entries with a nil value, or internal keys), without copying the map. 
+	// It is called once per entry. It does not apply to struct fields (see OmitFunc).
+	MapEntryFilter func(k, v reflect.Value) bool
+	// If set, a slice whose elements implement MapEntry is encoded as a map of 
+	// their keys to their values, in the order of the slice (without building a map first), 
+	// unless ordered by MapKeySort or Canonical. MapEntryFilter applies to the entries. 
+	// Duplicate keys are written as they are: decoding them into a map follows 
+	// DecoderOptions.DuplicateKeyPolicy. It can be decoded into a map.
+	MapEntrySliceAsMap bool
+	// If set, encoding a struct with several fields of the same name 
+	// (e.g. two fields with the same name in their tag) is an error. 
+	// Else only the first of those fields is encoded, as it is the one decoded into 
+	// (see DecoderOptions.StrictTags).
+	StrictTags bool
+	// The registry of the types whose name is written when they are encoded within an
+	// interface (see RegisterName). If nil, DefaultTypeRegistry is used.
+	Types *TypeRegistry
+	// The version of the msgpack spec to write, which sets how strings, []byte and 
+	// time.Time are encoded (see SpecVersion). The zero value is V2013. 
+	// The other options apply on top of it (e.g. TimeAsString).
+	SpecVersion SpecVersion
+	// If set, an empty (zero) struct field with the "default=value" tag option is encoded 
+	// as the value instead, for protocols with non-zero defaults. 
+	// Such a field can then not be encoded as its zero value (e.g. false, for default=true).
+	EncodeDefaults bool
+	encFns map[reflect.Type]func(*Encoder, reflect.Value) error // see RegisterEncoder
+}
+
+// SpecVersion selects a version of the msgpack spec, as a bundle of encoding behaviours.
+type SpecVersion byte
+
+const (
+	// the original (2013) spec: strings and []byte are both written as raw bytes, 
+	// there are no ext types, and a time.Time is a [seconds, nanoseconds] array.
+	V2013 SpecVersion = iota
+	// the current spec, with the str/bin split, ext types and the timestamp ext. 
+	// It is not supported yet (this package has no str8, bin or ext encodings): 
+	// encoding with it returns an error.
+	Current
+)
+
+// RegisterEncoder registers fn to encode values of type rt, instead of the default encoding
+// (e.g. to encode a Money type as an integer number of cents). 
+// It is passed the Encoder and the value, and must write exactly one value 
+// using the Encoder's exported methods (e.g. Encode). 
+// Registration must happen before the options are used by an Encoder.
+func (o *EncoderOptions) RegisterEncoder(rt reflect.Type, fn func(e *Encoder, rv reflect.Value) error) {
+	if o.encFns == nil {
+		o.encFns = make(map[reflect.Type]func(*Encoder, reflect.Value) error)
+	}
+	o.encFns[rt] = fn
+}
+
+// A LazyValue is encoded as the value returned by calling it, when it is encoded
+// (e.g. as a struct field, to only compute an expensive value if it is not omitted).
+// If it returns an error, encoding stops and returns it. A nil LazyValue encodes as nil.
+type LazyValue func() (interface{}, error)
+
+// An UnsupportedTypeError is returned by Encode when attempting to encode 
+// a value of an unsupported type (e.g. a chan, func, or uintptr).
+type UnsupportedTypeError struct {
+	Type reflect.Type
+}
+
+func (e *UnsupportedTypeError) Error() string {
+	return msgTagEnc + ": Unsupported type: " + e.Type.String()
+}
+
+// default EncoderOptions.MaxDepth. Far deeper than any reasonable data structure.
+const defaultEncMaxDepth = 1024
+
 // An Encoder writes an object to an output stream in the msgpack format.
 type Encoder struct {
 	w io.Writer
+	opts *EncoderOptions
+	depth, maxDepth int
+	field string      // name of the struct field being encoded (for error messages)
+	streams []encStream // containers started with EncodeMapStart or EncodeArrayStart (innermost last)
+	nested int          // depth of calls to Encode (e.g. from a registered encoder)
+	types *TypeRegistry // EncoderOptions.Types, or DefaultTypeRegistry
 	x [16]byte        //temp byte array re-used internally for efficiency
 	t1, t2, t3, t31, t5, t51, t9, t91 []byte // use these, so no need to constantly re-slice
 }
 
+// a container started with EncodeMapStart or EncodeArrayStart, whose values are encoded by later calls.
+type encStream struct {
+	isMap bool
+	length int    // declared length (number of entries for a map)
+	remaining int // number of values left to encode (2 per map entry)
+	// for an array of unknown length: its elements are buffered in buf, 
+	// and written to w (with the header) by EncodeEnd. length counts them.
+	buf *bytes.Buffer
+	w io.Writer
+}
+
+// MapEntry is implemented by the elements of a slice which can be encoded as a map
+// (see EncoderOptions.MapEntrySliceAsMap), e.g. a slice of key/value structs.
+type MapEntry interface {
+	Key() interface{}
+	Value() interface{}
+}
+
 // NewDecoder returns an Encoder for encoding an object.
 func NewEncoder(w io.Writer) (e *Encoder) {	
-	e = &Encoder{w:w}
+	return NewEncoderWithOptions(w, nil)
+}
+
+// NewEncoderWithOptions is like NewEncoder, but also takes EncoderOptions.
+// If nil EncoderOptions is passed, we use DefaultEncoderOptions
+func NewEncoderWithOptions(w io.Writer, opts *EncoderOptions) (e *Encoder) {
+	if opts == nil {
+		opts = &DefaultEncoderOptions
+	}
+	e = &Encoder{w:w, opts:opts, maxDepth:opts.MaxDepth, types:opts.Types}
+	if e.types == nil {
+		e.types = DefaultTypeRegistry
+	}
+	if e.maxDepth <= 0 {
+		e.maxDepth = defaultEncMaxDepth
+	}
 	e.t1, e.t2, e.t3, e.t31, e.t5, e.t51, e.t9, e.t91 = 
 		e.x[:1], e.x[:2], e.x[:3], e.x[1:3], e.x[:5], e.x[1:5], e.x[:9], e.x[1:9]
 	return
@@ -77,11 +279,18 @@ func NewEncoder(w io.Writer) (e *Encoder) {
 // 
 // Struct values encode as maps. Each exported struct field is encoded unless:
 //    - the field's tag is "-", or
-//    - the field is empty and its tag specifies the "omitempty" option.
+//    - the field is empty and its tag specifies the "omitempty" option, or
+//    - the field is a nil pointer or interface and its tag specifies the "omitnil" option.
 //
 // The empty values are false, 0, any nil pointer or interface value, 
 // and any array, slice, map, or string of length zero. 
 // 
+// Pointers (to any depth) and interfaces are encoded as the value they point to.
+// A nil pointer or interface encodes as msgpack nil.
+// 
+// Fields of a sync type (e.g. sync.Mutex, sync.Once) are skipped, as are
+// fields of a sync/atomic type. 
+// 
 // Anonymous fields are encoded inline if no msgpack tag is present.
 // Else they are encoded as regular fields.
 // 
@@ -90,9 +299,31 @@ func NewEncoder(w io.Writer) (e *Encoder) {
 // The "msgpack" key in struct field's tag value is the key name, 
 // followed by an optional comma and options. 
 // 
+// The "string" option encodes a number or bool field as a string (e.g. for 64-bit 
+// IDs consumed by JavaScript), which the Decoder parses back into the field.
+// The "required" option has no effect on encoding: the Decoder returns a 
+// *MissingFieldsError if the field's key is absent from the stream (or, for "toarray", 
+// if the array is too short to hold the field).
+// The "default=value" option (for a string, bool or number field) makes the Decoder set 
+// the field to the value if the field's key is absent from the stream (or, for "toarray", 
+// if the array is too short to hold the field). With omitempty, an empty field is omitted, 
+// so it decodes as the value. An empty field is encoded as is (e.g. false or 0), 
+// unless EncoderOptions.EncodeDefaults is set. The value cannot contain a comma.
+// The "extras" option on a []RawField field collects the map entries with unknown keys 
+// when decoding (see RawField), and writes them after the other fields when encoding.
+// The "self" option on a RawMessage field is set to the bytes of the whole struct 
+// when decoding (see RawMessage). The field is not encoded.
+// 
 // To set an option on all fields (e.g. omitempty on all fields), you 
 // can create a field called _struct, and set flags on it.
 // 
+// The "toarray" option on _struct encodes the struct as an array of its field values
+// (in declaration order), instead of a map. "toarray=Field1,Field2,..." (which must 
+// be the last option) lists the fields in the array, by their Go names, and their order,
+// so the array layout does not depend on the declaration order. 
+// The Decoder decodes such an array back into the struct, by position. 
+// Such a struct cannot be registered (see RegisterName).
+// 
 // Examples:
 //    
 //      type MyStruct struct {
@@ -101,20 +332,374 @@ func NewEncoder(w io.Writer) (e *Encoder) {
 //          Field2 int      `msgpack:"myName"`       //Use key "myName" in encode stream
 //          Field3 int32    `msgpack:",omitempty"`   //use key "Field3". Omit if empty.
 //          Field4 bool     `msgpack:"f4,omitempty"` //use key "f4". Omit if empty.
+//          Field5 int64    `msgpack:"id,string"`    //use key "id". Encode as a string.
 //          ...
 //      }
 //    
 func (e *Encoder) Encode(v interface{}) (err error) {
-	return e.EncodeValue(reflectValue(v))
+	return e.encodeTop(v)
 }
 
 // EncodeValue encodes a reflect.Value.
 func (e *Encoder) EncodeValue(rv reflect.Value) (err error) {
+	return e.encodeTop(rv)
+}
+
+// encodeTop encodes v (which may be a reflect.Value), for Encode and EncodeValue.
+func (e *Encoder) encodeTop(v interface{}) (err error) {
 	defer panicToErr(&err) 
-	e.encodeValue(rv)
+	// depth is not unwound if encoding panics, so restore it on exit
+	defer func(depth int) { e.depth = depth }(e.depth)
+	// a nested call encodes part of the value, which was counted by the outermost one
+	if e.nested == 0 {
+		e.checkSpecVersion()
+		e.streamValue()
+	}
+	e.nested++
+	defer func() { e.nested-- }()
+	if !e.encodeFast(v) {
+		e.encodeValue(reflectValue(v))
+	}
+	err = e.autoFlush()
+	return
+}
+
+// EncodeMapStart writes the header of a map with n entries, whose keys and values 
+// are written by the next 2*n calls to Encode (or n calls to EncodeMapKeyValue), 
+// e.g. to stream a large map from a database cursor without building it in memory. 
+// Call EncodeEnd after the last entry: it is an error if fewer entries were written.
+// Encoding more values than declared before EncodeEnd is an error.
+func (e *Encoder) EncodeMapStart(n int) (err error) {
+	defer panicToErr(&err)
+	if n < 0 {
+		e.err("EncodeMapStart: invalid length: %d", n)
+	}
+	e.checkSpecVersion()
+	e.streamValue()
+	if e.opts.MapAsPairArray {
+		e.writeContainerLen(ContainerList, n)
+	} else {
+		e.writeContainerLen(ContainerMap, n)
+	}
+	e.streams = append(e.streams, encStream{isMap: true, length: n, remaining: 2 * n})
+	return
+}
+
+// EncodeArrayStart writes the header of an array with n elements, which are written 
+// by the next n calls to Encode, e.g. to stream a large array without building a slice. 
+// It is used like EncodeMapStart (call EncodeEnd after the last element). 
+// Decoder.DecodeArrayToChan reads such an array back one element at a time.
+// 
+// If n < 0, the length is unknown (e.g. for a generator which cannot count its elements 
+// up front): the elements are buffered in memory until EncodeEnd, which writes the header 
+// with their count, followed by them. So the whole encoded array is held in memory,
+// which streaming with a known length avoids. 
+func (e *Encoder) EncodeArrayStart(n int) (err error) {
+	defer panicToErr(&err)
+	e.checkSpecVersion()
+	e.streamValue()
+	if n < 0 {
+		e.streams = append(e.streams, encStream{buf: new(bytes.Buffer), w: e.w})
+		e.w = e.streams[len(e.streams)-1].buf
+		return
+	}
+	e.writeContainerLen(ContainerList, n)
+	e.streams = append(e.streams, encStream{length: n, remaining: n})
+	return
+}
+
+// EncodeMapKeyValue writes an entry of the map started with EncodeMapStart.
+func (e *Encoder) EncodeMapKeyValue(k, v interface{}) (err error) {
+	if l := len(e.streams); l == 0 || !e.streams[l-1].isMap || e.streams[l-1].remaining%2 != 0 {
+		return fmt.Errorf("%s: EncodeMapKeyValue: not at an entry of a map started with EncodeMapStart", 
+			msgTagEnc)
+	}
+	if err = e.encodeTop(k); err == nil {
+		err = e.encodeTop(v)
+	}
+	return
+}
+
+// EncodeEnd ends the innermost container started with EncodeMapStart or EncodeArrayStart. 
+// It is an error if fewer values than declared were encoded into it.
+func (e *Encoder) EncodeEnd() (err error) {
+	defer panicToErr(&err)
+	l := len(e.streams)
+	if l == 0 {
+		e.err("EncodeEnd: no container was started")
+	}
+	s := e.streams[l-1]
+	if s.remaining > 0 {
+		e.err("EncodeEnd: %s with length: %d is missing %d values", s.name(), s.length, s.remaining)
+	}
+	e.streams = e.streams[:l-1]
+	if s.buf != nil {
+		e.w = s.w
+		e.writeContainerLen(ContainerList, s.length)
+		e.writeb(s.buf.Len(), s.buf.Bytes())
+		err = e.autoFlush()
+	}
+	return
+}
+
+// flush the writer if EncoderOptions.AutoFlush is set, and it has a Flush method.
+func (e *Encoder) autoFlush() error {
+	if e.opts.AutoFlush {
+		if f, ok := e.w.(interface { Flush() error }); ok {
+			return f.Flush()
+		}
+	}
+	return nil
+}
+
+// check that EncoderOptions.SpecVersion is one this package can write.
+func (e *Encoder) checkSpecVersion() {
+	switch e.opts.SpecVersion {
+	case V2013:
+	case Current:
+		e.err("SpecVersion Current is unsupported: only V2013 can be written (no str8, bin or ext encodings)")
+	default:
+		e.err("Unknown SpecVersion: %d", e.opts.SpecVersion)
+	}
+}
+
+// count a value about to be encoded at the top level, against the innermost streamed container.
+func (e *Encoder) streamValue() {
+	l := len(e.streams)
+	if l == 0 {
+		return
+	}
+	s := &e.streams[l-1]
+	if s.buf != nil {
+		s.length++
+		return
+	}
+	if s.remaining == 0 {
+		e.err("Encode: %s with length: %d is full. Call EncodeEnd", s.name(), s.length)
+	}
+	if s.isMap && s.remaining%2 == 0 {
+		e.encMapEntryStart()
+	}
+	s.remaining--
+}
+
+func (s *encStream) name() string {
+	if s.isMap {
+		return "map"
+	}
+	return "array"
+}
+
+// EncodeFromJSON reads a JSON value from r, and writes its msgpack equivalent, 
+// without decoding it into Go values first (e.g. for a bridge from JSON to msgpack).
+// Numbers are written as integers if they are integers, else as float64. 
+// See EncoderOptions.JSONBase64Field to write some strings as the bytes they encode.
+// MaxStringLen (for strings and object keys), MaxBinLen and MaxDepth (each value, 
+// and each level of nested arrays and objects) apply as when encoding Go values.
+// 
+// Reading from r is buffered, so data after the JSON value may be consumed. 
+func (e *Encoder) EncodeFromJSON(r io.Reader) (err error) {
+	defer panicToErr(&err)
+	defer func(depth int) { e.depth = depth }(e.depth)
+	if e.nested == 0 {
+		e.checkSpecVersion()
+		e.streamValue()
+	}
+	jd := json.NewDecoder(r)
+	jd.UseNumber()
+	e.encodeJSON(jd, "", nil)
+	err = e.autoFlush()
 	return
 }
 
+// the containers of a JSON value, whose contents are written to buf before their 
+// length is known (see encodeJSON).
+type jsonBuf struct {
+	buf bytes.Buffer
+	hdrs []jsonHdr // in the order the containers start (so by offset)
+}
+
+// the header of a container, to be written at offset off of jsonBuf.buf.
+type jsonHdr struct {
+	off int
+	ct ContainerType
+	n int
+}
+
+// encodes the next JSON value from jd. key is the object key it is the value of (if any).
+// jb is nil, unless within a container. 
+func (e *Encoder) encodeJSON(jd *json.Decoder, key string, jb *jsonBuf) {
+	tok, err := jd.Token()
+	if err != nil {
+		panic(err)
+	}
+	e.incDepth()
+	switch v := tok.(type) {
+	case json.Delim:
+		if jb != nil {
+			e.encodeJSONContainer(jd, v, key, jb)
+			break
+		}
+		// the length of a container is written first, so the contents of the outermost one 
+		// (and those nested in it) are buffered once, and written with the headers inserted.
+		jb = new(jsonBuf)
+		w := e.w
+		e.w = &jb.buf
+		defer func() { e.w = w }()
+		e.encodeJSONContainer(jd, v, key, jb)
+		e.w = w
+		bs, off := jb.buf.Bytes(), 0
+		for _, h := range jb.hdrs {
+			if h.off > off {
+				e.writeb(h.off-off, bs[off:h.off])
+				off = h.off
+			}
+			e.writeContainerLen(h.ct, h.n)
+		}
+		if off < len(bs) {
+			e.writeb(len(bs)-off, bs[off:])
+		}
+	case string:
+		if key != "" && e.opts.JSONBase64Field != nil && e.opts.JSONBase64Field(key) {
+			bs, err := base64.StdEncoding.DecodeString(v)
+			if err != nil {
+				e.err("EncodeFromJSON: Invalid base64 string for key: %q: %v", key, err)
+			}
+			if e.opts.MaxBinLen > 0 && len(bs) > e.opts.MaxBinLen {
+				e.errLen("Bytes", len(bs), "MaxBinLen", e.opts.MaxBinLen)
+			}
+			e.encRawBytes(bs)
+		} else {
+			if e.opts.MaxStringLen > 0 && len(v) > e.opts.MaxStringLen {
+				e.errLen("String", len(v), "MaxStringLen", e.opts.MaxStringLen)
+			}
+			e.encString(v)
+		}
+	case json.Number:
+		e.encNumber(Number(v))
+	case bool:
+		e.encBool(v)
+	case nil:
+		e.encNil()
+	}
+	e.depth--
+}
+
+// encodes the contents of the JSON array or object started by delim v into jb.buf, 
+// and records its header (written later, as its length is not known until its end).
+// key is the object key the container is the value of (if any).
+func (e *Encoder) encodeJSONContainer(jd *json.Decoder, v json.Delim, key string, jb *jsonBuf) {
+	ct, n := ContainerList, 0
+	if v == '{' {
+		ct = ContainerMap
+	}
+	i := len(jb.hdrs)
+	jb.hdrs = append(jb.hdrs, jsonHdr{off: jb.buf.Len(), ct: ct})
+	for ; jd.More(); n++ {
+		if ct == ContainerMap {
+			tok, err := jd.Token()
+			if err != nil {
+				panic(err)
+			}
+			key = tok.(string)
+			if e.opts.MaxStringLen > 0 && len(key) > e.opts.MaxStringLen {
+				e.errLen("String", len(key), "MaxStringLen", e.opts.MaxStringLen)
+			}
+			e.encString(key)
+		}
+		e.encodeJSON(jd, key, jb)
+	}
+	if _, err := jd.Token(); err != nil {
+		panic(err)
+	}
+	jb.hdrs[i].n = n
+}
+
+// encodeFast encodes v without reflection if it is of a common type, 
+// and returns false (having written nothing) if it is not. 
+// The output is the same as via encodeValue (all options which apply are honored).
+func (e *Encoder) encodeFast(v interface{}) bool {
+	if e.opts.encFns != nil {
+		return false
+	}
+	switch v.(type) {
+	case nil, bool, int, int64, float64, string, []byte:
+	case map[string]interface{}:
+		// options which order the entries, or change how the map is written, use encodeValue
+		if e.opts.Canonical || e.opts.MapKeySort != nil || e.opts.MapAsPairArray || e.opts.MapEntryFilter != nil {
+			return false
+		}
+	default:
+		return false
+	}
+	// the value counts against MaxDepth as in encodeValue
+	e.incDepth()
+	switch x := v.(type) {
+	case nil:
+		e.encNilIntf()
+	case bool:
+		e.encBool(x)
+	case int:
+		e.encInt(int64(x))
+	case int64:
+		e.encInt(x)
+	case float64:
+		e.t9[0] = 0xcb
+		binary.BigEndian.PutUint64(e.t91, math.Float64bits(x))
+		e.writeb(9, e.t9)
+	case string:
+		if e.opts.MaxStringLen > 0 && len(x) > e.opts.MaxStringLen {
+			e.errLen("String", len(x), "MaxStringLen", e.opts.MaxStringLen)
+		}
+		e.encString(x)
+	case []byte:
+		if x == nil && !e.opts.NilCollectionAsEmpty {
+			e.encNil()
+			break
+		}
+		if e.opts.MaxBinLen > 0 && len(x) > e.opts.MaxBinLen {
+			e.errLen("Bytes", len(x), "MaxBinLen", e.opts.MaxBinLen)
+		}
+		e.writeContainerLen(ContainerRawBytes, len(x))
+		if len(x) > 0 {
+			e.writeb(len(x), x)
+		}
+	case map[string]interface{}:
+		if x == nil && !e.opts.NilCollectionAsEmpty {
+			e.encNil()
+			break
+		}
+		e.writeContainerLen(ContainerMap, len(x))
+		for k, xv := range x {
+			e.encodeFast(k)
+			// as an interface value, like via encodeValue: the interface counts against 
+			// MaxDepth, then the value it holds
+			if xv == nil {
+				e.incDepth()
+				e.encNilIntf()
+				e.depth--
+				continue
+			}
+			e.incDepth()
+			ok := e.encodeFast(xv)
+			e.depth--
+			if !ok {
+				// e.g. for registered types
+				e.encodeValue(reflect.ValueOf(&xv).Elem())
+			}
+		}
+	}
+	e.depth--
+	return true
+}
+
+// count a level of nesting against MaxDepth. The caller decrements e.depth when done.
+func (e *Encoder) incDepth() {
+	if e.depth++; e.depth > e.maxDepth {
+		e.err("Max depth exceeded: %d (possibly a cyclic data structure)", e.maxDepth)
+	}
+}
+
 func (e *Encoder) encode(v interface{}) {
 	e.encodeValue(reflectValue(v))
 }
@@ -128,11 +713,29 @@ func (e *Encoder) encodeValue(rv reflect.Value) {
 	// Tested with a type assertion for all common types first, but this increased encoding time
 	// sometimes by up to 20% (weird). So just use the reflect.Kind switch alone.
 	
+	e.incDepth()
+	if e.opts.encFns != nil && rv.IsValid() {
+		if fn := e.opts.encFns[rv.Type()]; fn != nil {
+			if err := fn(e, rv); err != nil {
+				panic(err)
+			}
+			e.depth--
+			return
+		}
+	}
+
 	// ensure more common cases appear early in switch.
 	switch rk := rv.Kind(); rk {
 	case reflect.Bool:
 		e.encBool(rv.Bool())
 	case reflect.String:
+		if rv.Type() == numberTyp {
+			e.encNumber(Number(rv.String()))
+			break
+		}
+		if e.opts.MaxStringLen > 0 && rv.Len() > e.opts.MaxStringLen {
+			e.errLen("String", rv.Len(), "MaxStringLen", e.opts.MaxStringLen)
+		}
 		e.encString(rv.String())
 	case reflect.Int, reflect.Int8, reflect.Int64, reflect.Int32, reflect.Int16:
 		e.encInt(rv.Int())
@@ -147,12 +750,27 @@ func (e *Encoder) encodeValue(rv reflect.Value) {
 		binary.BigEndian.PutUint32(e.t51, math.Float32bits(float32(rv.Float())))
 		e.writeb(5, e.t5)
 	case reflect.Slice:
-		if rv.IsNil() {
+		if rv.IsNil() && !e.opts.NilCollectionAsEmpty {
 			e.encNil()
 			break
 		} 
 		l := rv.Len()
+		if e.opts.MapEntrySliceAsMap && rv.Type().Elem().Implements(mapEntryTyp) {
+			e.encodeMapEntries(rv)
+			break
+		}
+		if rv.Type() == rawMessageTyp {
+			if l == 0 {
+				e.encNil()
+			} else {
+				e.writeb(l, rv.Bytes())
+			}
+			break
+		}
 		if rv.Type() == byteSliceTyp {
+			if e.opts.MaxBinLen > 0 && l > e.opts.MaxBinLen {
+				e.errLen("Bytes", l, "MaxBinLen", e.opts.MaxBinLen)
+			}
 			e.writeContainerLen(ContainerRawBytes, l)
 			if l > 0 {
 				e.writeb(l, rv.Bytes())
@@ -173,7 +791,16 @@ func (e *Encoder) encodeValue(rv reflect.Value) {
 		// log("---- %v", rv.Type())
 		// if rv.Type().Elem().Kind == reflect.Uint8 { // surprisingly expensive (check 1st value instead)
 		if rv.Index(0).Kind() == reflect.Uint8 {
+			if e.opts.MaxBinLen > 0 && l > e.opts.MaxBinLen {
+				e.errLen("Bytes", l, "MaxBinLen", e.opts.MaxBinLen)
+			}
 			e.writeContainerLen(ContainerRawBytes, l)
+			// only an addressable array can be sliced (e.g. not one passed by value)
+			if !rv.CanAddr() {
+				rva := reflect.New(rv.Type()).Elem()
+				rva.Set(rv)
+				rv = rva
+			}
 			e.writeb(l, rv.Slice(0, l).Bytes())
 			break
 		}
@@ -182,13 +809,47 @@ func (e *Encoder) encodeValue(rv reflect.Value) {
 			e.encode(rv.Index(j))
 		}
 	case reflect.Map:
-		if rv.IsNil() {
+		if rv.IsNil() && !e.opts.NilCollectionAsEmpty {
 			e.encNil()
 			break
 		}
-		e.writeContainerLen(ContainerMap, rv.Len())
-		for _, mk := range rv.MapKeys() {
-			e.encode(mk)
+		mks := rv.MapKeys()
+		if e.opts.MapEntryFilter != nil {
+			// filter first, as the header holds the number of entries
+			n := 0
+			for _, mk := range mks {
+				if e.opts.MapEntryFilter(mk, rv.MapIndex(mk)) {
+					mks[n] = mk
+					n++
+				}
+			}
+			mks = mks[:n]
+		}
+		if e.opts.MapAsPairArray {
+			e.writeContainerLen(ContainerList, len(mks))
+		} else {
+			e.writeContainerLen(ContainerMap, len(mks))
+		}
+		if e.opts.MapKeySort != nil {
+			sort.SliceStable(mks, func(i, j int) bool { return e.opts.MapKeySort(mks[i], mks[j]) })
+			for _, mk := range mks {
+				e.encMapEntryStart()
+				e.encodeMapKey(mk)
+				e.encode(rv.MapIndex(mk))
+			}
+			break
+		}
+		if e.opts.Canonical {
+			mvs := make([]reflect.Value, len(mks))
+			for j, mk := range mks {
+				mvs[j] = rv.MapIndex(mk)
+			}
+			e.encodeMapCanonical(mks, mvs)
+			break
+		}
+		for _, mk := range mks {
+			e.encMapEntryStart()
+			e.encodeMapKey(mk)
 			e.encode(rv.MapIndex(mk))
 		}
 	case reflect.Struct:
@@ -196,21 +857,80 @@ func (e *Encoder) encodeValue(rv reflect.Value) {
 		//treat time.Time specially
 		if rt == timeTyp {
 			tt := rv.Interface().(time.Time)
+			if e.opts.TimeAsString {
+				layout := e.opts.TimeLayout
+				if layout == "" {
+					layout = time.RFC3339
+				}
+				e.encString(tt.Format(layout))
+				break
+			}
 			e.encode([2]int64{tt.Unix(), int64(tt.Nanosecond())})
 			break
 		}
-		e.encodeStruct(rt, rv)
+		//a reflect.Value (e.g. within an interface{}) encodes as the value it holds
+		if rt == reflectValueTyp && rv.CanInterface() {
+			e.encodeValue(rv.Interface().(reflect.Value))
+			break
+		}
+		e.encodeStruct(rt, rv, "")
 	case reflect.Ptr, reflect.Interface:
 		if rv.IsNil() {
-			e.encNil()
+			if rk == reflect.Interface && !(e.opts.EncodeErrorAsString && rv.Type() == errorTyp) {
+				e.encNilIntf()
+			} else {
+				e.encNil()
+			}
 			break
 		}
+		if e.opts.EncodeErrorAsString && rk == reflect.Interface && rv.Type() == errorTyp {
+			e.encString(rv.Interface().(error).Error())
+			break
+		}
+		if rk == reflect.Interface {
+			if name := e.types.nameOf(rv.Elem().Type()); name != "" {
+				e.encodeRegistered(name, rv.Elem())
+				break
+			}
+		}
 		e.encodeValue(rv.Elem())
 	case reflect.Invalid:
-		e.encNil()
+		e.encNilIntf()
+	case reflect.Complex64, reflect.Complex128:
+		if !e.opts.EncodeComplex {
+			e.err("Unsupported kind: %s, for: %#v (see EncoderOptions.EncodeComplex)", rk, rv)
+		}
+		c := rv.Complex()
+		e.writeContainerLen(ContainerList, 2)
+		if rk == reflect.Complex64 {
+			e.encode(float32(real(c)))
+			e.encode(float32(imag(c)))
+		} else {
+			e.encode(real(c))
+			e.encode(imag(c))
+		}
+	case reflect.Uintptr:
+		if !e.opts.AllowUintptr {
+			panic(&UnsupportedTypeError{rv.Type()})
+		}
+		e.encUint(rv.Uint())
+	case reflect.Func:
+		if rv.Type() != lazyValueTyp {
+			panic(&UnsupportedTypeError{rv.Type()})
+		}
+		if rv.IsNil() {
+			e.encNil()
+			break
+		}
+		v, err := rv.Interface().(LazyValue)()
+		if err != nil {
+			panic(err)
+		}
+		e.encode(v)
 	default:
-		e.err("Unsupported kind: %s, for: %#v", rk, rv)
+		panic(&UnsupportedTypeError{rv.Type()})
 	}
+	e.depth--
 	return
 }
 
@@ -232,6 +952,15 @@ func (e *Encoder) writeContainerLen(ct ContainerType, l int) {
 	}
 }
 
+// encode a nil interface. See EncoderOptions.NilInterfaceAsEmpty.
+func (e *Encoder) encNilIntf() {
+	if e.opts.NilInterfaceAsEmpty {
+		e.writeContainerLen(ContainerMap, 0)
+	} else {
+		e.encNil()
+	}
+}
+
 func (e *Encoder) encNil() {
 	e.t1[0] = 0xc0
 	e.writeb(1, e.t1)
@@ -285,8 +1014,26 @@ func (e *Encoder) encUint(i uint64) {
 	}
 }
 
+func (e *Encoder) encNumber(n Number) {
+	if i, err := n.Int64(); err == nil {
+		e.encInt(i)
+	} else if ui, err := n.Uint64(); err == nil {
+		e.encUint(ui)
+	} else if f, err := n.Float64(); err == nil {
+		e.encode(f)
+	} else {
+		e.err("Invalid Number: %q", n)
+	}
+}
+
 func (e *Encoder) encBool(b bool) {
-	if b {
+	if e.opts.BoolAsInt {
+		if b {
+			e.t1[0] = 1
+		} else {
+			e.t1[0] = 0
+		}
+	} else if b {
 		e.t1[0] = 0xc3
 	} else {
 		e.t1[0] = 0xc2
@@ -294,8 +1041,29 @@ func (e *Encoder) encBool(b bool) {
 	e.writeb(1, e.t1)
 }
 
-func (e *Encoder) encodeStruct(rt reflect.Type, rv reflect.Value) {
+// encode a value of a registered type (see RegisterName), with its type name.
+func (e *Encoder) encodeRegistered(name string, rv reflect.Value) {
+	if rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			e.encNil()
+			return
+		}
+		rv = rv.Elem()
+	}
+	e.encodeStruct(rv.Type(), rv, name)
+}
+
+// encode a struct as a map. If typeName is not empty, it is written first, 
+// as the value of registeredTypeKey.
+func (e *Encoder) encodeStruct(rt reflect.Type, rv reflect.Value, typeName string) {
 	sis := getStructFieldInfos(rt)
+	if sis.toArray != nil {
+		e.encodeStructArray(rv, sis.toArray)
+		return
+	}
+	if sis.dupNames != nil && e.opts.StrictTags {
+		e.err("Struct: %v has several fields named: %s", rt, strings.Join(sis.dupNames, ", "))
+	}
 	// e.writeContainerLen(ContainerMap, len(sis.sis))
 	// for _, si := range sis.sis {
 	// 	e.encode(si.encNameBs)
@@ -303,25 +1071,197 @@ func (e *Encoder) encodeStruct(rt reflect.Type, rv reflect.Value) {
 	// }
 	// return
 	
-	encNames := make([][]byte, len(sis.sis))
+	fsis := make([]*structFieldInfo, len(sis.sis))
 	rvals := make([]reflect.Value, len(sis.sis))
 	newlen := 0
 	for _, si := range sis.sis {
+		if si.dup {
+			continue
+		}
 		rval0 := si.field(rv)
-		if si.omitEmpty && isEmptyValue(rval0) {
+		if si.hasDefault && e.opts.EncodeDefaults && isEmptyValue(rval0) {
+			rval0 = si.defaultVal
+		}
+		if (si.omitEmpty && isEmptyValue(rval0)) || (si.omitNil && isNilPtrOrIntf(rval0)) {
+			if e.opts.DroppedFieldsCallback != nil {
+				e.opts.DroppedFieldsCallback(rt, si.name)
+			}
 			continue
 		}
-		encNames[newlen] = si.encNameBs
+		if e.opts.OmitFunc != nil && e.opts.OmitFunc(si.name, rval0) {
+			continue
+		}
+		fsis[newlen] = si
 		rvals[newlen] = rval0
 		newlen++
 	}
+	var extras []RawField
+	if sis.extras != nil {
+		extras = sis.extras.field(rv).Interface().([]RawField)
+	}
 	
-	e.writeContainerLen(ContainerMap, newlen)
+	if typeName != "" {
+		e.writeContainerLen(ContainerMap, newlen + len(extras) + 1)
+		e.encString(registeredTypeKey)
+		e.encString(typeName)
+	} else {
+		e.writeContainerLen(ContainerMap, newlen + len(extras))
+	}
+	defer func(field string) { e.field = field }(e.field)
 	for j := 0; j < newlen; j++ {
-		e.encode(encNames[j])
-		e.encode(rvals[j])
+		// field names are written directly, so MaxBinLen does not apply to them
+		if e.opts.FieldNameTransform != nil && !fsis[j].tagged {
+			e.encString(e.opts.FieldNameTransform(fsis[j].name))
+		} else if e.opts.LowerCaseFieldNames && fsis[j].lowerNameBs != nil {
+			e.encRawBytes(fsis[j].lowerNameBs)
+		} else {
+			e.encRawBytes(fsis[j].encNameBs)
+		}
+		e.field = fsis[j].name
+		if fsis[j].toString {
+			e.encodeAsString(rvals[j])
+		} else {
+			e.encode(rvals[j])
+		}
+	}
+	for _, x := range extras {
+		e.encString(x.Key)
+		e.encode(x.Raw)
+	}
+}
+
+// encode the fields fsis of the struct rv as an array (see the "toarray" option).
+// All the fields are encoded, as their position in the array is their identity.
+func (e *Encoder) encodeStructArray(rv reflect.Value, fsis []*structFieldInfo) {
+	e.writeContainerLen(ContainerList, len(fsis))
+	defer func(field string) { e.field = field }(e.field)
+	for _, si := range fsis {
+		e.field = si.name
+		rval0 := si.field(rv)
+		if si.hasDefault && e.opts.EncodeDefaults && isEmptyValue(rval0) {
+			rval0 = si.defaultVal
+		}
+		if si.toString {
+			e.encodeAsString(rval0)
+		} else {
+			e.encode(rval0)
+		}
+	}
+}
+
+// encode a number or bool (or pointer to one) as a string, for fields with the 
+// "string" tag option. Other values are encoded as usual.
+func (e *Encoder) encodeAsString(rv reflect.Value) {
+	if rv.Kind() == reflect.Ptr && !rv.IsNil() {
+		rv = rv.Elem()
+	}
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int64, reflect.Int32, reflect.Int16:
+		e.encString(strconv.FormatInt(rv.Int(), 10))
+	case reflect.Uint8, reflect.Uint64, reflect.Uint, reflect.Uint32, reflect.Uint16:
+		e.encString(strconv.FormatUint(rv.Uint(), 10))
+	case reflect.Float32, reflect.Float64:
+		e.encString(strconv.FormatFloat(rv.Float(), 'g', -1, rv.Type().Bits()))
+	case reflect.Bool:
+		e.encString(strconv.FormatBool(rv.Bool()))
+	default:
+		e.encodeValue(rv)
+	}
+}
+
+// encode a map key. With MapKeyAsString, a key which implements 
+// encoding.TextMarshaler (or else fmt.Stringer) is encoded as its text.
+func (e *Encoder) encodeMapKey(mk reflect.Value) {
+	if e.opts.MapKeyAsString && mk.IsValid() && mk.CanInterface() {
+		switch k := mk.Interface().(type) {
+		case encoding.TextMarshaler:
+			bs, err := k.MarshalText()
+			if err != nil {
+				e.err("MarshalText: Error: %v", err)
+			}
+			e.writeContainerLen(ContainerRawBytes, len(bs))
+			e.writeb(len(bs), bs)
+			return
+		case fmt.Stringer:
+			e.encString(k.String())
+			return
+		}
+	}
+	e.encode(mk)
+}
+
+// start a map entry: a [key, value] array if EncoderOptions.MapAsPairArray is set.
+func (e *Encoder) encMapEntryStart() {
+	if e.opts.MapAsPairArray {
+		e.writeContainerLen(ContainerList, 2)
+	}
+}
+
+// encode the slice rv, whose elements implement MapEntry, as a map (see MapEntrySliceAsMap).
+// The entries are filtered and ordered as those of a map. Duplicate keys are not 
+// detected: each entry is written, so the map holds the key more than once.
+func (e *Encoder) encodeMapEntries(rv reflect.Value) {
+	l := rv.Len()
+	ks, vs := make([]reflect.Value, 0, l), make([]reflect.Value, 0, l)
+	for j := 0; j < l; j++ {
+		rvj := rv.Index(j)
+		if (rvj.Kind() == reflect.Ptr || rvj.Kind() == reflect.Interface) && rvj.IsNil() {
+			e.err("MapEntry: nil element at index: %d", j)
+		}
+		me := rvj.Interface().(MapEntry)
+		k, v := me.Key(), me.Value()
+		// MapEntryFilter gets the key and value as in a map[interface{}]interface{}
+		mk, mv := reflect.ValueOf(&k).Elem(), reflect.ValueOf(&v).Elem()
+		if e.opts.MapEntryFilter != nil && !e.opts.MapEntryFilter(mk, mv) {
+			continue
+		}
+		ks, vs = append(ks, mk.Elem()), append(vs, mv.Elem())
+	}
+	if e.opts.MapAsPairArray {
+		e.writeContainerLen(ContainerList, len(ks))
+	} else {
+		e.writeContainerLen(ContainerMap, len(ks))
+	}
+	if e.opts.MapKeySort != nil {
+		idxs := make([]int, len(ks))
+		for j := range idxs {
+			idxs[j] = j
+		}
+		sort.SliceStable(idxs, func(i, j int) bool { return e.opts.MapKeySort(ks[idxs[i]], ks[idxs[j]]) })
+		for _, j := range idxs {
+			e.encMapEntryStart()
+			e.encodeMapKey(ks[j])
+			e.encode(vs[j])
+		}
+		return
+	}
+	if e.opts.Canonical {
+		e.encodeMapCanonical(ks, vs)
+		return
+	}
+	for j := range ks {
+		e.encMapEntryStart()
+		e.encodeMapKey(ks[j])
+		e.encode(vs[j])
+	}
+}
+
+// encode the map entries with keys mks and values mvs, sorted by the encoded bytes of the keys.
+func (e *Encoder) encodeMapCanonical(mks, mvs []reflect.Value) {
+	kbss := make([][]byte, len(mks))
+	idxs := make([]int, len(mks))
+	for j, mk := range mks {
+		kbuf := new(bytes.Buffer)
+		NewEncoderWithOptions(kbuf, e.opts).encodeMapKey(mk)
+		kbss[j] = kbuf.Bytes()
+		idxs[j] = j
+	}
+	sort.SliceStable(idxs, func(i, j int) bool { return bytes.Compare(kbss[idxs[i]], kbss[idxs[j]]) < 0 })
+	for _, j := range idxs {
+		e.encMapEntryStart()
+		e.writeb(len(kbss[j]), kbss[j])
+		e.encode(mvs[j])
 	}
-	
 }
 
 func (e *Encoder) encString(s string) {
@@ -337,6 +1277,11 @@ func (e *Encoder) encString(s string) {
 	}
 }
 
+func (e *Encoder) encRawBytes(bs []byte) {
+	e.writeContainerLen(ContainerRawBytes, len(bs))
+	e.writeb(len(bs), bs)
+}
+
 func (e *Encoder) writeb(numbytes int, bs []byte) {
 	// no sanity checking. Assume callers pass valid arguments. It's pkg-private: we can control it.
 	n, err := e.w.Write(bs)
@@ -357,6 +1302,14 @@ func (e *Encoder) err(format string, params ...interface{}) {
 	doPanic(msgTagEnc, format, params)
 }
 
+// error for a string or bytes of length l exceeding the limit max (named opt).
+func (e *Encoder) errLen(what string, l int, opt string, max int) {
+	if e.field != "" {
+		e.err("%s length: %d exceeds %s: %d (field: %s)", what, l, opt, max, e.field)
+	}
+	e.err("%s length: %d exceeds %s: %d", what, l, opt, max)
+}
+
 // Marshal is a convenience function which encodes v to a stream of bytes. 
 // It delegates to Encoder.Encode.
 func Marshal(v interface{}) (b []byte, err error) {
@@ -367,4 +1320,135 @@ func Marshal(v interface{}) (b []byte, err error) {
 	return
 }
 
+// MarshalAppend is like Marshal, but appends the encoding of v to dst and returns 
+// the extended slice (like append). Reusing a buffer across calls, e.g. 
+//   buf, err = msgpack.MarshalAppend(buf[:0], v, nil)
+// avoids allocating a new []byte for each value. On error, dst is returned unchanged.
+// It delegates to Encoder.Encode.
+func MarshalAppend(dst []byte, v interface{}, opts *EncoderOptions) (b []byte, err error) {
+	aw := appendWriter(dst)
+	if err = NewEncoderWithOptions(&aw, opts).Encode(v); err != nil {
+		return dst, err
+	}
+	return []byte(aw), nil
+}
+
+// appendWriter is an io.Writer which appends the bytes written to it.
+type appendWriter []byte
+
+func (aw *appendWriter) Write(p []byte) (n int, err error) {
+	*aw = append(*aw, p...)
+	return len(p), nil
+}
+
+// Size returns the number of bytes v encodes to, without keeping the encoded bytes.
+// It is useful for pre-allocating buffers or checking size limits before sending.
+// It delegates to Encoder.Encode, writing to a writer which only counts bytes.
+func Size(v interface{}, opts *EncoderOptions) (n int, err error) {
+	var sw sizeWriter
+	if err = NewEncoderWithOptions(&sw, opts).Encode(v); err == nil {
+		n = int(sw)
+	}
+	return
+}
+
+// sizeWriter is an io.Writer which just counts the bytes written to it.
+type sizeWriter int
 
+func (sw *sizeWriter) Write(p []byte) (n int, err error) {
+	*sw += sizeWriter(len(p))
+	return len(p), nil
+}
+
+// Encoded wraps a value, which is encoded on demand when it is written out. 
+// It implements io.WriterTo, encoding the value straight into the writer (e.g. an 
+// http.ResponseWriter), and io.Reader, so it can also be passed to io.Copy or used 
+// as an http request body. An Encoded is read or written once.
+type Encoded struct {
+	v interface{}
+	opts *EncoderOptions
+	buf *bytes.Buffer // the encoded value, once Read is called
+	err error
+}
+
+// NewEncoded returns an Encoded for v. 
+// If nil EncoderOptions is passed, we use DefaultEncoderOptions.
+func NewEncoded(v interface{}, opts *EncoderOptions) *Encoded {
+	return &Encoded{v: v, opts: opts}
+}
+
+// WriteTo encodes the value into w. It returns the number of bytes written, 
+// and any error encoding the value or writing to w. 
+func (x *Encoded) WriteTo(w io.Writer) (n int64, err error) {
+	if x.buf == nil && x.err == nil {
+		cw := countWriter{w: w}
+		x.buf, x.err = new(bytes.Buffer), NewEncoderWithOptions(&cw, x.opts).Encode(x.v)
+		return cw.n, x.err
+	}
+	// Read was called (or the value was written already): write out what is left of the buffer
+	if x.err != nil {
+		return 0, x.err
+	}
+	return x.buf.WriteTo(w)
+}
+
+// Read reads the encoded value. It is encoded into a buffer on the first call.
+func (x *Encoded) Read(p []byte) (n int, err error) {
+	if x.buf == nil && x.err == nil {
+		x.buf = new(bytes.Buffer)
+		x.err = NewEncoderWithOptions(x.buf, x.opts).Encode(x.v)
+	}
+	if x.err != nil {
+		return 0, x.err
+	}
+	return x.buf.Read(p)
+}
+
+// countWriter is an io.Writer which counts the bytes written through it to w.
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countWriter) Write(p []byte) (n int, err error) {
+	n, err = cw.w.Write(p)
+	cw.n += int64(n)
+	return
+}
+
+// A WrappedEncoder writes each value with a small header before it: 
+// the magic bytes and a version byte, for versioned wire formats. 
+// The values are read back with a WrappedDecoder (using the same magic and version), 
+// which detects data of another format or version. 
+// Only the methods which write a header are exposed.
+type WrappedEncoder struct {
+	e *Encoder
+	w io.Writer
+	header []byte
+}
+
+// NewWrappedEncoder returns a WrappedEncoder which writes values to w, 
+// each after a header of magic and version.
+// If nil EncoderOptions is passed, we use DefaultEncoderOptions.
+func NewWrappedEncoder(w io.Writer, magic []byte, version uint8, opts *EncoderOptions) *WrappedEncoder {
+	header := make([]byte, len(magic) + 1)
+	copy(header, magic)
+	header[len(magic)] = version
+	return &WrappedEncoder{NewEncoderWithOptions(w, opts), w, header}
+}
+
+// Encode writes the header, followed by v (see Encoder.Encode).
+func (e *WrappedEncoder) Encode(v interface{}) (err error) {
+	if _, err = e.w.Write(e.header); err != nil {
+		return
+	}
+	return e.e.Encode(v)
+}
+
+// EncodeValue writes the header, followed by rv (see Encoder.EncodeValue).
+func (e *WrappedEncoder) EncodeValue(rv reflect.Value) (err error) {
+	if _, err = e.w.Write(e.header); err != nil {
+		return
+	}
+	return e.e.EncodeValue(rv)
+}
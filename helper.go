@@ -38,6 +38,7 @@ import (
 	"reflect"
 	"sync"
 	"strings"
+	"strconv"
 	"fmt"
 	"time"
 )
@@ -50,6 +51,23 @@ const (
 	ContainerMap = ContainerType('m')
 )
 
+// MsgpackType is the type of a value in a msgpack stream, as returned by Decoder.PeekType.
+type MsgpackType byte
+
+const (
+	MsgpackInvalid MsgpackType = iota
+	MsgpackNil
+	MsgpackBool
+	// signed integers (and all fixnums)
+	MsgpackInt
+	// unsigned integers (uint 8/16/32/64)
+	MsgpackUint
+	MsgpackFloat
+	MsgpackRawBytes
+	MsgpackArray
+	MsgpackMap
+)
+
 var (
 	structInfoFieldName = "_struct"
 	
@@ -61,6 +79,14 @@ var (
 	intfTyp = intfSliceTyp.Elem()
 	byteSliceTyp = reflect.TypeOf([]byte(nil))
 	timeTyp = reflect.TypeOf(time.Time{})
+	numberTyp = reflect.TypeOf(Number(""))
+	errorTyp = reflect.TypeOf((*error)(nil)).Elem()
+	reflectValueTyp = reflect.TypeOf(reflect.Value{})
+	lazyValueTyp = reflect.TypeOf(LazyValue(nil))
+	validatorTyp = reflect.TypeOf((*Validator)(nil)).Elem()
+	rawMessageTyp = reflect.TypeOf(RawMessage(nil))
+	rawFieldSliceTyp = reflect.TypeOf([]RawField(nil))
+	mapEntryTyp = reflect.TypeOf((*MapEntry)(nil)).Elem()
 	mapStringIntfTyp = reflect.TypeOf(map[string]interface{}(nil))
 	mapIntfIntfTyp = reflect.TypeOf(map[interface{}]interface{}(nil))
 )
@@ -70,13 +96,33 @@ type structFieldInfo struct {
 	is        []int
 	tag       string
 	omitEmpty bool
+	omitNil   bool     // omit the field if it is a nil pointer or interface (tag option "omitnil")
+	toString  bool     // encode a number or bool as a string (tag option "string")
+	extras    bool     // the field holds the unknown keys of the map (tag option "extras")
+	self      bool     // the field holds the encoded bytes of the struct (tag option "self")
+	required  bool     // decoding errors if the field is absent (tag option "required")
+	hasDefault bool    // the field has a default value (tag option "default=...")
+	defaultStr string  // the default value, as in the tag
+	defaultVal reflect.Value // the default value, parsed for the type of the field
 	encName   string   // encode name
 	encNameBs []byte
+	lowerNameBs []byte // encNameBs lowercased, if the name is not from the tag (else nil)
+	tagged    bool     // if the encode name is from the tag
 	name      string   // field name
+	toArray   bool     // (_struct field only) encode the struct as an array (tag option "toarray")
+	arrayNames []string // (_struct field only) names of the fields in the array, in order (if set)
+	dup       bool     // a field before it has the same encode name (it is not encoded)
 }
 
 type structFieldInfos struct {
 	sis []*structFieldInfo
+	hasRequired bool // if any field has the "required" tag option
+	hasDefault bool // if any field has the "default" tag option
+	toArray []*structFieldInfo // if non-nil, the fields of the array the struct is encoded as
+	validator, ptrValidator bool // if the struct (or a pointer to it) implements Validator
+	extras *structFieldInfo // the []RawField field with the "extras" tag option (if any)
+	self *structFieldInfo   // the RawMessage field with the "self" tag option (if any)
+	dupNames []string // encode names shared by several fields (the first of them is decoded into)
 }
 
 func (si *structFieldInfo) field(struc reflect.Value) (rv reflect.Value) {
@@ -99,6 +145,17 @@ func (sis *structFieldInfos) getForEncName(name string) (si *structFieldInfo) {
 	return
 }
 
+// like getForEncName, but matches the name ignoring case.
+func (sis *structFieldInfos) getForEncNameFold(name string) (si *structFieldInfo) {
+	for _, si = range sis.sis {
+		if strings.EqualFold(si.encName, name) {
+			return
+		}
+	}
+	si = nil
+	return
+}
+
 func getStructFieldInfos(rt reflect.Type) (sis *structFieldInfos) {
 	sis, ok := cachedStructFieldInfos[rt]
 	if ok {
@@ -115,6 +172,32 @@ func getStructFieldInfos(rt reflect.Type) (sis *structFieldInfos) {
 		siInfo = parseStructFieldInfo(structInfoFieldName, f.Tag.Get("msgpack"))
 	}
 	rgetStructFieldInfos(rt, nil, sis, siInfo)
+	seen := make(map[string]int, len(sis.sis))
+	for _, si := range sis.sis {
+		if seen[si.encName]++; seen[si.encName] == 2 {
+			sis.dupNames = append(sis.dupNames, si.encName)
+		}
+		si.dup = seen[si.encName] > 1
+	}
+	sis.validator = rt.Implements(validatorTyp)
+	sis.ptrValidator = !sis.validator && reflect.PtrTo(rt).Implements(validatorTyp)
+	if siInfo != nil && siInfo.toArray {
+		sis.toArray = sis.sis
+		if siInfo.arrayNames != nil {
+			sis.toArray = make([]*structFieldInfo, len(siInfo.arrayNames))
+			for j, name := range siInfo.arrayNames {
+				for _, si := range sis.sis {
+					if si.name == name {
+						sis.toArray[j] = si
+						break
+					}
+				}
+				if sis.toArray[j] == nil {
+					panic(fmt.Errorf("%s: %v: toarray: Unknown field: %q", msgTagEnc, rt, name))
+				}
+			}
+		}
+	}
 	cachedStructFieldInfos[rt] = sis
 	return
 }
@@ -131,14 +214,31 @@ func rgetStructFieldInfos(rt reflect.Type, indexstack []int, sis *structFieldInf
 			continue
 		} 
 
+		if isSyncType(f.Type) {
+			continue
+		}
+
 		if f.Anonymous {
-			//if anonymous, inline it if there is no msgpack tag, else treat as regular field
-			if stag == "" {
+			//if anonymous, inline it if there is no msgpack tag, else treat as regular field.
+			//only structs are inlined (e.g. an embedded interface is a regular field named by its type).
+			if stag == "" && f.Type.Kind() == reflect.Struct {
 				rgetStructFieldInfos(f.Type, append2Is(indexstack, j), sis, siInfo)
 				continue
 			}
 		}
 		si := parseStructFieldInfo(f.Name, stag)
+		if si.extras {
+			if f.Type != rawFieldSliceTyp {
+				panic(fmt.Errorf("%s: %v: extras field %s must be a []RawField. Got: %v", msgTagEnc, rt, f.Name, f.Type))
+			}
+		}
+		if si.self && f.Type != rawMessageTyp {
+			panic(fmt.Errorf("%s: %v: self field %s must be a RawMessage. Got: %v", msgTagEnc, rt, f.Name, f.Type))
+		}
+		if si.hasDefault {
+			si.defaultVal = parseDefaultValue(rt, f, si.defaultStr)
+			sis.hasDefault = true
+		}
 		
 		if len(indexstack) == 0 {
 			si.i = j
@@ -151,11 +251,62 @@ func rgetStructFieldInfos(rt reflect.Type, indexstack []int, sis *structFieldInf
 			if siInfo.omitEmpty {
 				si.omitEmpty = true
 			}
+			if siInfo.omitNil {
+				si.omitNil = true
+			}
+		}
+		if si.required {
+			sis.hasRequired = true
+		}
+		if si.extras {
+			// it is not encoded under its own name: it holds other entries of the map
+			sis.extras = si
+			continue
+		}
+		if si.self {
+			// it is not encoded: it is only set when decoding
+			sis.self = si
+			continue
 		}
 		sis.sis = append(sis.sis, si)
 	}
 }
 
+// sync types (e.g. sync.Mutex, sync.Once, atomic.Int64) hold no exported state, 
+// and must not be copied, so struct fields of these types are skipped.
+func isSyncType(rt reflect.Type) bool {
+	if rt.Kind() != reflect.Struct {
+		return false
+	}
+	pkgPath := rt.PkgPath()
+	return pkgPath == "sync" || pkgPath == "sync/atomic"
+}
+
+// parse the default value s of the field f of struct rt (see the "default" tag option).
+// Only fields of a string, bool or numeric kind can have a default.
+func parseDefaultValue(rt reflect.Type, f reflect.StructField, s string) reflect.Value {
+	var v interface{}
+	var err error
+	switch f.Type.Kind() {
+	case reflect.String:
+		v = s
+	case reflect.Bool:
+		v, err = strconv.ParseBool(s)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		v, err = strconv.ParseInt(s, 10, f.Type.Bits())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		v, err = strconv.ParseUint(s, 10, f.Type.Bits())
+	case reflect.Float32, reflect.Float64:
+		v, err = strconv.ParseFloat(s, f.Type.Bits())
+	default:
+		err = fmt.Errorf("unsupported type: %v", f.Type)
+	}
+	if err != nil {
+		panic(fmt.Errorf("%s: %v: default of field %s: %v", msgTagEnc, rt, f.Name, err))
+	}
+	return reflect.ValueOf(v).Convert(f.Type)
+}
+
 func append2Is(indexstack []int, j int) (indexstack2 []int) {
 	// istack2 := indexstack //make copy (not sufficient ... since it'd still share array)
 	indexstack2 = make([]int, len(indexstack)+1)
@@ -176,18 +327,181 @@ func parseStructFieldInfo(fname string, stag string) (si *structFieldInfo) {
 	
 	if stag != "" {
 		for i, s := range strings.Split(si.tag, ",") {
+			if si.arrayNames != nil {
+				// the names after "toarray=" are the fields of the array, in order
+				si.arrayNames = append(si.arrayNames, s)
+				continue
+			}
 			if i == 0 {
 				if s != "" {
 					si.encName = s
+					si.tagged = true
 				}
 			} else {
-				if s == "omitempty" {
+				switch s {
+				case "omitempty":
 					si.omitEmpty = true
+				case "omitnil":
+					si.omitNil = true
+				case "string":
+					si.toString = true
+				case "required":
+					si.required = true
+				case "extras":
+					si.extras = true
+				case "self":
+					si.self = true
+				case "toarray":
+					si.toArray = true
+				default:
+					if strings.HasPrefix(s, "toarray=") {
+						si.toArray = true
+						si.arrayNames = []string{s[len("toarray="):]}
+					} else if strings.HasPrefix(s, "default=") {
+						si.hasDefault = true
+						si.defaultStr = s[len("default="):]
+					}
 				}
 			}
 		}
 	}
 	si.encNameBs = []byte(si.encName)
+	if !si.tagged {
+		si.lowerNameBs = []byte(strings.ToLower(fname))
+	}
+	return
+}
+
+// registeredTypeKey is the map key holding the type name of a registered type, 
+// written as the first entry when a registered struct is encoded within an interface.
+const registeredTypeKey = "_type"
+
+// A TypeRegistry records struct types under names, so values of those types 
+// encoded within an interface can be decoded back into their type (see RegisterName).
+// It is safe for concurrent use. 
+// 
+// An Encoder writes the names of the types in EncoderOptions.Types, and a Decoder 
+// creates values of the types in DecoderOptions.Types (in DefaultTypeRegistry if nil), 
+// so a stream can only make it create types which were registered.
+type TypeRegistry struct {
+	mu    sync.RWMutex
+	names map[reflect.Type]string
+	types map[string]reflect.Type
+}
+
+// DefaultTypeRegistry is the registry of the package-level Register, RegisterName 
+// and Unregister functions, used by Encoders and Decoders whose options have no Types.
+var DefaultTypeRegistry = NewTypeRegistry()
+
+// NewTypeRegistry returns an empty TypeRegistry.
+func NewTypeRegistry() *TypeRegistry {
+	return &TypeRegistry{names: make(map[reflect.Type]string), types: make(map[string]reflect.Type)}
+}
+
+// Register records the type of value (a struct, or pointer to a struct) in DefaultTypeRegistry. 
+// See TypeRegistry.Register.
+func Register(value interface{}) {
+	DefaultTypeRegistry.Register(value)
+}
+
+// RegisterName records the type of value under name in DefaultTypeRegistry.
+// See TypeRegistry.RegisterName.
+func RegisterName(name string, value interface{}) {
+	DefaultTypeRegistry.RegisterName(name, value)
+}
+
+// Unregister removes the type of value from DefaultTypeRegistry.
+func Unregister(value interface{}) {
+	DefaultTypeRegistry.Unregister(value)
+}
+
+// Register records the type of value (a struct, or pointer to a struct) under its name,
+// qualified by its package path (e.g. "*github.com/me/mypkg.MyStruct"), so types
+// of the same name in different packages do not collide. See RegisterName.
+func (r *TypeRegistry) Register(value interface{}) {
+	rt := reflect.TypeOf(value)
+	if rt == nil {
+		r.RegisterName("", value)
+		return
+	}
+	var prefix string
+	if rt.Kind() == reflect.Ptr {
+		prefix, rt = "*", rt.Elem()
+	}
+	r.RegisterName(prefix + rt.PkgPath() + "." + rt.Name(), value)
+}
+
+// RegisterName records the type of value (a struct, or pointer to a struct) under name, 
+// like encoding/gob.RegisterName. 
+// 
+// When a value of a registered type is encoded as the dynamic value of an interface
+// (e.g. an element of a []interface{}), its map starts with an extra entry:
+// "_type": name. When such a map is decoded into a nil interface, a value of the 
+// registered type is created and decoded into, instead of a map.
+// 
+// It panics if the type is not a struct or pointer to a struct, if the struct is 
+// encoded as an array (the "toarray" option), which has no room for the name, or if 
+// the name or type is already registered to another type or name.
+func (r *TypeRegistry) RegisterName(name string, value interface{}) {
+	rt := reflect.TypeOf(value)
+	if rt == nil || (rt.Kind() != reflect.Struct && 
+		(rt.Kind() != reflect.Ptr || rt.Elem().Kind() != reflect.Struct)) {
+		panic(fmt.Errorf("msgpack: Register: Expecting struct or pointer to struct. Got: %T", value))
+	}
+	st := rt
+	if st.Kind() == reflect.Ptr {
+		st = st.Elem()
+	}
+	if getStructFieldInfos(st).toArray != nil {
+		panic(fmt.Errorf("msgpack: Register: Type %v is encoded as an array (toarray), which cannot hold its name", rt))
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if rt0, ok := r.types[name]; ok && rt0 != rt {
+		panic(fmt.Errorf("msgpack: Register: Name %q already registered for type: %v", name, rt0))
+	}
+	if name0, ok := r.names[rt]; ok && name0 != name {
+		panic(fmt.Errorf("msgpack: Register: Type %v already registered as: %q", rt, name0))
+	}
+	r.names[rt] = name
+	r.types[name] = rt
+}
+
+// Unregister removes the type of value (and its name), if it is registered.
+func (r *TypeRegistry) Unregister(value interface{}) {
+	rt := reflect.TypeOf(value)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if name, ok := r.names[rt]; ok {
+		delete(r.names, rt)
+		delete(r.types, name)
+	}
+}
+
+// returns the registered name of rt, or "" if not registered.
+func (r *TypeRegistry) nameOf(rt reflect.Type) (name string) {
+	r.mu.RLock()
+	name = r.names[rt]
+	r.mu.RUnlock()
+	return
+}
+
+// returns the type registered as name, or nil.
+func (r *TypeRegistry) typeOf(name string) (rt reflect.Type) {
+	r.mu.RLock()
+	rt = r.types[name]
+	r.mu.RUnlock()
+	return
+}
+
+// reports whether any type is registered (r may be nil).
+func (r *TypeRegistry) hasTypes() (b bool) {
+	if r == nil {
+		return false
+	}
+	r.mu.RLock()
+	b = len(r.types) > 0
+	r.mu.RUnlock()
 	return
 }
 
@@ -42,6 +42,11 @@ import (
 	"time"
 	"runtime"
 	"flag"
+	"net"
+	"net/rpc"
+	"sync/atomic"
+	"strconv"
+	"strings"
 )
 
 var (
@@ -218,3 +223,273 @@ func Benchmark__Json_____Decode(b *testing.B) {
 	fnBenchmarkDecode(b, fnJsonEncodeFn, fnJsonDecodeFn)
 }
 
+type benchCountingConn struct {
+	net.Conn
+	reads int64
+}
+
+func (c *benchCountingConn) Read(p []byte) (int, error) {
+	atomic.AddInt64(&c.reads, 1)
+	return c.Conn.Read(p)
+}
+
+// Benchmark__Msgpack__CustomRpc reports the number of reads on the server connection per call.
+func Benchmark__Msgpack__CustomRpc(b *testing.B) {
+	srv := rpc.NewServer()
+	srv.Register(testRpcInt)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		logT(b, "Error listening: %v", err)
+		b.FailNow()
+	}
+	defer ln.Close()
+	sconnChan := make(chan *benchCountingConn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		sconn := &benchCountingConn{Conn: conn}
+		sconnChan <- sconn
+		srv.ServeCodec(NewCustomRPCServerCodec(sconn, nil))
+	}()
+	conn, err := net.Dial(ln.Addr().Network(), ln.Addr().String())
+	if err != nil {
+		logT(b, "Error dialing: %v", err)
+		b.FailNow()
+	}
+	cl := rpc.NewClientWithCodec(NewCustomRPCClientCodec(conn, nil))
+	defer cl.Close()
+	sconn := <-sconnChan
+	var res int
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err = cl.Call("TestRpcInt.Mult", i, &res); err != nil {
+			logT(b, "Error calling rpc: %v", err)
+			b.FailNow()
+		}
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(atomic.LoadInt64(&sconn.reads)) / float64(b.N), "reads/op")
+}
+
+// Benchmark__Msgpack__DecodeReuseBytes decodes raw bytes into a []byte with enough capacity.
+func Benchmark__Msgpack__DecodeReuseBytes(b *testing.B) {
+	bs, err := Marshal(make([]byte, 1024))
+	if err != nil {
+		logT(b, "Error encoding: %v", err)
+		b.FailNow()
+	}
+	r := bytes.NewReader(bs)
+	dec := NewDecoderWithOptions(r, nil, &DecoderOptions{ReuseByteSlices: true})
+	target := make([]byte, 0, 1024)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.Reset(bs)
+		if err = dec.Decode(&target); err != nil {
+			logT(b, "Error decoding: %v", err)
+			b.FailNow()
+		}
+	}
+}
+
+type benchFieldsStruc struct {
+	F3  int64
+	F10 string
+	F20 []int64
+}
+
+// benchDecodeFields decodes a 50-field map into a struct with 3 fields, 
+// either via Decode or (if fields is non-nil) via DecodeFields.
+func benchDecodeFields(b *testing.B, fields []string) {
+	m := make(map[string]interface{}, 50)
+	for j := 0; j < 50; j++ {
+		switch j % 3 {
+		case 0:
+			m["F" + strconv.Itoa(j)] = int64(j * 1000)
+		case 1:
+			m["F" + strconv.Itoa(j)] = strings.Repeat("x", j)
+		case 2:
+			m["F" + strconv.Itoa(j)] = []int64{int64(j), int64(j * 2), int64(j * 3)}
+		}
+	}
+	bs, err := Marshal(m)
+	if err != nil {
+		logT(b, "Error encoding: %v", err)
+		b.FailNow()
+	}
+	r := bytes.NewReader(bs)
+	dec := NewDecoder(r, nil)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var v benchFieldsStruc
+		r.Reset(bs)
+		if fields == nil {
+			err = dec.Decode(&v)
+		} else {
+			err = dec.DecodeFields(&v, fields)
+		}
+		if err != nil {
+			logT(b, "Error decoding: %v", err)
+			b.FailNow()
+		}
+	}
+}
+
+func Benchmark__Msgpack__DecodeAllFields(b *testing.B) {
+	benchDecodeFields(b, nil)
+}
+
+func Benchmark__Msgpack__DecodeFields(b *testing.B) {
+	benchDecodeFields(b, []string{"F3", "F10", "F20"})
+}
+
+// Benchmark__Msgpack__MarshalAppend reuses one buffer across 10k encodes per op.
+func Benchmark__Msgpack__MarshalAppend(b *testing.B) {
+	var buf []byte
+	var err error
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j := 0; j < 10000; j++ {
+			if buf, err = MarshalAppend(buf[:0], &benchTs, nil); err != nil {
+				logT(b, "Error encoding benchTs: %v", err)
+				b.FailNow()
+			}
+		}
+	}
+}
+
+func benchBatchDecode(b *testing.B, batch bool) {
+	v := make([]TestStruc, 1000)
+	for j := range v {
+		v[j] = benchTs
+	}
+	bs, err := Marshal(v)
+	if err != nil {
+		logT(b, "Error encoding: %v", err)
+		b.FailNow()
+	}
+	r := bytes.NewReader(bs)
+	dec := NewDecoder(r, testDecOpts(nil, nil, false, false, false))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var v2 []TestStruc
+		r.Reset(bs)
+		if batch {
+			err = dec.BatchDecode(&v2, 0)
+		} else {
+			err = dec.Decode(&v2)
+		}
+		if err != nil {
+			logT(b, "Error decoding: %v", err)
+			b.FailNow()
+		}
+	}
+}
+
+// Benchmark__Msgpack__BatchDecode decodes an array of 1000 structs in parallel, 
+// for comparison with Benchmark__Msgpack__DecodeArray.
+func Benchmark__Msgpack__BatchDecode(b *testing.B) {
+	benchBatchDecode(b, true)
+}
+
+func Benchmark__Msgpack__DecodeArray(b *testing.B) {
+	benchBatchDecode(b, false)
+}
+
+var benchMixed = []interface{}{
+	1, int64(-1 << 40), "hello", true, 3.25, []byte("bytes"), 
+	map[string]interface{}{"a": 1, "b": "two", "c": false}, 
+	strings.Repeat("x", 100), 42, 2.5,
+}
+
+// benchEncodeMixed encodes a mixed workload of common types, via Encode 
+// (which uses the fast path for them), or via EncodeValue (if reflectOnly).
+func benchEncodeMixed(b *testing.B, reflectOnly bool) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	rvs := make([]reflect.Value, len(benchMixed))
+	for j, v := range benchMixed {
+		rvs[j] = reflect.ValueOf(v)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		for j, v := range benchMixed {
+			var err error
+			if reflectOnly {
+				err = enc.EncodeValue(rvs[j])
+			} else {
+				err = enc.Encode(v)
+			}
+			if err != nil {
+				logT(b, "Error encoding: %v", err)
+				b.FailNow()
+			}
+		}
+	}
+}
+
+func Benchmark__Msgpack__EncodeMixed(b *testing.B) {
+	benchEncodeMixed(b, false)
+}
+
+func Benchmark__Msgpack__EncodeMixedReflect(b *testing.B) {
+	benchEncodeMixed(b, true)
+}
+
+// benchDecodeMixed decodes a stream of mixed scalars into typed pointers, 
+// via Decode (which uses the fast path for them), or via DecodeValue (if reflectOnly).
+func benchDecodeMixed(b *testing.B, reflectOnly bool) {
+	var i int
+	var i64 int64
+	var s string
+	var t bool
+	var f float64
+	var bs []byte
+	targets := []interface{}{&i, &i64, &s, &t, &f, &bs, &i, &s}
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	for _, v := range []interface{}{42, int64(-1 << 40), "hello", true, 3.25, []byte("bytes"), 70000, strings.Repeat("x", 100)} {
+		if err := enc.Encode(v); err != nil {
+			logT(b, "Error encoding: %v", err)
+			b.FailNow()
+		}
+	}
+	data := buf.Bytes()
+	rvs := make([]reflect.Value, len(targets))
+	for j, v := range targets {
+		rvs[j] = reflect.ValueOf(v)
+	}
+	r := bytes.NewReader(data)
+	dec := NewDecoder(r, nil)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		r.Reset(data)
+		for j, v := range targets {
+			var err error
+			if reflectOnly {
+				err = dec.DecodeValue(rvs[j])
+			} else {
+				err = dec.Decode(v)
+			}
+			if err != nil {
+				logT(b, "Error decoding: %v", err)
+				b.FailNow()
+			}
+		}
+	}
+}
+
+func Benchmark__Msgpack__DecodeMixed(b *testing.B) {
+	benchDecodeMixed(b, false)
+}
+
+func Benchmark__Msgpack__DecodeMixedReflect(b *testing.B) {
+	benchDecodeMixed(b, true)
+}
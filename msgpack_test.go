@@ -59,6 +59,15 @@ import (
 	"path/filepath"
 	"strconv"
 	"net"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"math"
+	"sync/atomic"
+	"bufio"
+	"strings"
+	"encoding/json"
 )
 
 var (
@@ -117,6 +126,12 @@ type TestStruc struct {
 	Nteststruc *TestStruc
 }
 
+type testTextKey struct {
+	A, B int
+}
+
+func (k testTextKey) MarshalText() ([]byte, error) { return []byte(fmt.Sprintf("%d-%d", k.A, k.B)), nil }
+
 type TestRpcInt struct {
 	i int
 }
@@ -124,6 +139,14 @@ type TestRpcInt struct {
 func (r *TestRpcInt) Update(n int, res *int) error { r.i = n; *res = r.i; return nil }
 func (r *TestRpcInt) Square(ignore int, res *int) error { *res = r.i * r.i; return nil }
 func (r *TestRpcInt) Mult(n int, res *int) error { *res = r.i * n; return nil }
+func (r *TestRpcInt) Fail(msg string, res *int) error { return errors.New(msg) }
+
+type testRpcError struct {
+	Code int
+	Msg string
+}
+
+func (e *testRpcError) Error() string { return fmt.Sprintf("code %d: %s", e.Code, e.Msg) }
 
 func init() {
 	primitives := []interface{} {
@@ -444,6 +467,37 @@ func TestIntfDecode(t *testing.T) {
 	}
 }
 
+func TestDecodeIntoIntfHoldingValue(t *testing.T) {
+	ts := newTestStruc(0, false)
+	bs, err := Marshal(&ts)
+	checkErrT(t, err)
+	// interface holding a non-nil pointer: decode into the pointed-to value
+	ts2 := new(TestStruc)
+	var v interface{} = ts2
+	checkErrT(t, Unmarshal(bs, &v, nil))
+	if v2, ok := v.(*TestStruc); !ok || v2 != ts2 {
+		logT(t, "Expecting interface to still hold same *TestStruc. Got: %T, %p", v, v)
+		t.FailNow()
+	}
+	checkEqualT(t, ts2.I64, int64(64))
+	checkEqualT(t, ts2.Sslice, ts.Sslice)
+	// interface holding a non-pointer: fall back to decoding as if nil
+	var v3 interface{} = int(5)
+	checkErrT(t, Unmarshal(bs, &v3, testDecOpts(mapStringIntfTyp, nil, true, true, true)))
+	if m, ok := v3.(map[string]interface{}); !ok || m["S"] != "some string" {
+		logT(t, "Expecting generic map decoded into interface. Got: %T, %v", v3, v3)
+		t.FailNow()
+	}
+	// interface values in a map are decoded into (reused) too
+	ts4 := new(TestStruc)
+	m4 := map[string]interface{}{"A": ts4}
+	bs, err = Marshal(map[string]interface{}{"A": &ts})
+	checkErrT(t, err)
+	checkErrT(t, Unmarshal(bs, &m4, nil))
+	checkEqualT(t, m4["A"], interface{}(ts4))
+	checkEqualT(t, ts4.S, "some string")
+}
+
 func TestDecodeStructSubset(t *testing.T) {
 	// test that we can decode a subset of the stream
 	m := map[string]interface{}{"A": 5, "B": 99, "C": 333, }
@@ -469,111 +523,3571 @@ func TestDecodeStructSubset(t *testing.T) {
 	}
 }
 
-// comment out for now
-func TestRpcAll(t *testing.T) {
-	testRpc(t, true, true, true, true)
+func TestStrictNumericConversion(t *testing.T) {
+	strict := &DecoderOptions{StrictNumericConversion: true}
+	bs, err := Marshal(3.5)
+	checkErrT(t, err)
+	var i int
+	// by default (as without DecoderOptions), a float cannot be decoded into an integer
+	for _, dopts := range []*DecoderOptions{nil, strict} {
+		if err = NewDecoderWithOptions(bytes.NewBuffer(bs), nil, dopts).Decode(&i); err == nil {
+			logT(t, "Expecting error decoding 3.5 into int, with options: %v", dopts)
+			t.FailNow()
+		}
+	}
+	checkErrT(t, NewDecoderWithOptions(bytes.NewBuffer(bs), nil, &DecoderOptions{FloatToInt: true}).Decode(&i))
+	checkEqualT(t, i, 3)
+	lossless := &DecoderOptions{FloatToInt: true, StrictNumericConversion: true}
+	if err = NewDecoderWithOptions(bytes.NewBuffer(bs), nil, lossless).Decode(&i); err == nil {
+		logT(t, "Expecting error decoding 3.5 into int in strict mode")
+		t.FailNow()
+	}
+	bs, err = Marshal(float32(-4.0))
+	checkErrT(t, err)
+	if err = NewDecoder(bytes.NewBuffer(bs), nil).Decode(&i); err == nil {
+		logT(t, "Expecting error decoding -4.0 into int by default")
+		t.FailNow()
+	}
+	i = 0
+	checkErrT(t, NewDecoderWithOptions(bytes.NewBuffer(bs), nil, lossless).Decode(&i))
+	checkEqualT(t, i, -4)
+	var ui uint
+	if err = NewDecoderWithOptions(bytes.NewBuffer(bs), nil, lossless).Decode(&ui); err == nil {
+		logT(t, "Expecting error decoding -4.0 into uint")
+		t.FailNow()
+	}
+	bs, err = Marshal(300)
+	checkErrT(t, err)
+	var i8 int8
+	if err = NewDecoderWithOptions(bytes.NewBuffer(bs), nil, strict).Decode(&i8); err == nil {
+		logT(t, "Expecting overflow error decoding 300 into int8 in strict mode")
+		t.FailNow()
+	}
+	// a float64 out of the range of a float32 is an infinity by default
+	bs, err = Marshal(1e300)
+	checkErrT(t, err)
+	var f32 float32
+	checkErrT(t, NewDecoder(bytes.NewBuffer(bs), nil).Decode(&f32))
+	checkEqualT(t, math.IsInf(float64(f32), 1), true)
+	if err = NewDecoderWithOptions(bytes.NewBuffer(bs), nil, strict).Decode(&f32); err == nil {
+		logT(t, "Expecting overflow error decoding 1e300 into float32 in strict mode")
+		t.FailNow()
+	}
 }
 
-func TestRpc(t *testing.T) {
-	testRpc(t, true, true, false, true)
+func TestEncodePtrToPrimitive(t *testing.T) {
+	i, str := 5, "someday"
+	pstr := &str
+	var nilp *int
+	for _, v := range [][2]interface{}{ {&i, i}, {&pstr, str}, {nilp, nil} } {
+		b0, err := Marshal(v[0])
+		checkErrT(t, err)
+		b1, err := Marshal(v[1])
+		checkErrT(t, err)
+		checkEqualT(t, b0, b1)
+	}
+	b, err := Marshal(nilp)
+	checkErrT(t, err)
+	checkEqualT(t, b, []byte{0xc0})
 }
 
-func TestCustomRpc(t *testing.T) {
-	testRpc(t, true, false, true, true)
+func TestSize(t *testing.T) {
+	type tSize struct {
+		A string `msgpack:"aaaaaaaa"`
+		B int    `msgpack:",omitempty"`
+		C []byte `msgpack:"-"`
+	}
+	vs := append([]interface{}{ tSize{"a", 0, []byte("c")}, tSize{"a", 99999, nil} }, table...)
+	for i, v := range vs {
+		b, err := Marshal(v)
+		checkErrT(t, err)
+		n, err := Size(v, nil)
+		checkErrT(t, err)
+		if n != len(b) {
+			logT(t, "Size mismatch for #%d: %T: Size: %d, len(Marshal): %d", i, v, n, len(b))
+			failT(t)
+		}
+	}
 }
 
-func testRpc(t *testing.T, callClose, doBasic, doCustom, doExit bool) {
-	srv := rpc.NewServer()
-	srv.Register(testRpcInt)
-	ln, err := net.Listen("tcp", "127.0.0.1:0")
-	// log("listener: %v", ln.Addr())
+func TestCopyValue(t *testing.T) {
+	v := map[string]interface{}{
+		"list": []interface{}{ int16(1616), "1234567890123456789012345678901234567890", 
+			map[string]interface{}{"TRUE": true, "N": nil}, float64(-3232.0) },
+		"bytes": make([]byte, 300),
+	}
+	b0, err := Marshal(v)
 	checkErrT(t, err)
-	defer ln.Close()
+	b1, err := Marshal(uint16(9999))
+	checkErrT(t, err)
+	dec := NewDecoder(bytes.NewBuffer(append(append([]byte{}, b0...), b1...)), nil)
+	var buf bytes.Buffer
+	checkErrT(t, dec.CopyValue(&buf))
+	checkEqualT(t, buf.Bytes(), b0)
+	// the decoder must be positioned at the next value
+	var u uint16
+	checkErrT(t, dec.Decode(&u))
+	checkEqualT(t, u, uint16(9999))
+}
+
+func TestCaseInsensitiveFieldMatch(t *testing.T) {
+	type tCase struct {
+		Name string `msgpack:"name"`
+		Age int `msgpack:"age"`
+		AGE int `msgpack:"AGE"`
+	}
+	bs, err := Marshal(map[string]interface{}{"Name": "x", "AGE": 5})
+	checkErrT(t, err)
+	var v tCase
+	checkErrT(t, NewDecoderWithOptions(bytes.NewBuffer(bs), nil, nil).Decode(&v))
+	checkEqualT(t, v, tCase{"", 0, 5})
+	v = tCase{}
+	checkErrT(t, NewDecoderWithOptions(bytes.NewBuffer(bs), nil, 
+		&DecoderOptions{CaseInsensitiveFieldMatch: true}).Decode(&v))
+	checkEqualT(t, v, tCase{"x", 0, 5})
+}
+
+func TestMixedKeyMapCanonical(t *testing.T) {
+	m := map[interface{}]interface{}{
+		int8(1): "one", int8(-100): "minus 100", "a": int8(2), true: false, float64(1.5): nil,
+	}
+	eopts := &EncoderOptions{Canonical: true}
+	var b0 []byte
+	for i := 0; i < 8; i++ {
+		buf := new(bytes.Buffer)
+		checkErrT(t, NewEncoderWithOptions(buf, eopts).Encode(m))
+		if i == 0 {
+			b0 = buf.Bytes()
+		} else {
+			checkEqualT(t, buf.Bytes(), b0)
+		}
+	}
+	var m2 map[interface{}]interface{}
+	checkErrT(t, Unmarshal(b0, &m2, nil))
+	checkEqualT(t, m2, m)
+}
+
+func TestStructKeyMapCanonical(t *testing.T) {
+	type tKey struct {
+		Name string
+		N    int
+	}
+	m := map[tKey]string{
+		{"a", 1}: "a1", {"a", 2}: "a2", {"b", 1}: "b1", {"", 0}: "zero",
+	}
+	eopts := &EncoderOptions{Canonical: true}
+	var b0 []byte
+	for i := 0; i < 8; i++ {
+		buf := new(bytes.Buffer)
+		checkErrT(t, NewEncoderWithOptions(buf, eopts).Encode(m))
+		if i == 0 {
+			b0 = buf.Bytes()
+		} else {
+			checkEqualT(t, buf.Bytes(), b0)
+		}
+	}
+	var m2 map[tKey]string
+	checkErrT(t, Unmarshal(b0, &m2, nil))
+	checkEqualT(t, m2, m)
+
+	// a struct key is a map in the stream, which cannot be a key of a map[interface{}]...
+	var v interface{}
+	err := Unmarshal(b0, &v, nil)
+	if err == nil || !strings.Contains(err.Error(), "cannot be a key") {
+		logT(t, "Expecting map key error. Got: %v", err)
+		t.FailNow()
+	}
+}
+
+func TestEncodeMaxDepth(t *testing.T) {
+	type tDepth struct {
+		Next *tDepth
+	}
+	head := new(tDepth)
+	for i, v := 0, head; i < 40; i++ {
+		v.Next = new(tDepth)
+		v = v.Next
+	}
+	// each level is a pointer and a struct
+	_, err := Size(head, &EncoderOptions{MaxDepth: 100})
+	checkErrT(t, err)
+	if _, err = Size(head, &EncoderOptions{MaxDepth: 50}); err == nil {
+		logT(t, "Expecting max depth error")
+		t.FailNow()
+	}
+	// a cyclic structure errors with the default max depth
+	head.Next = head
+	if _, err = Marshal(head); err == nil {
+		logT(t, "Expecting max depth error for cyclic structure")
+		t.FailNow()
+	}
+}
+
+func TestUseNumber(t *testing.T) {
+	f0 := 0.1
+	vs := []interface{}{ uint64(math.MaxUint64), int64(math.MinInt64), f0 + 0.2, float32(0.1), int8(-5) }
+	bs, err := Marshal(vs)
+	checkErrT(t, err)
+	var v interface{}
+	checkErrT(t, NewDecoderWithOptions(bytes.NewBuffer(bs), nil, &DecoderOptions{UseNumber: true}).Decode(&v))
+	ns := v.([]interface{})
+	checkEqualT(t, ns, []interface{}{ Number("18446744073709551615"), Number("-9223372036854775808"), 
+		Number("0.30000000000000004"), Number("0.1"), Number("-5") })
+	ui, err := ns[0].(Number).Uint64()
+	checkErrT(t, err)
+	checkEqualT(t, ui, uint64(math.MaxUint64))
+	f, err := ns[2].(Number).Float64()
+	checkErrT(t, err)
+	checkEqualT(t, f, f0 + 0.2)
+	// a Number encodes as a number
+	bs2, err := Marshal(Number("-9223372036854775808"))
+	checkErrT(t, err)
+	bs3, err := Marshal(int64(math.MinInt64))
+	checkErrT(t, err)
+	checkEqualT(t, bs2, bs3)
+}
+
+func TestSkipSyncTypes(t *testing.T) {
+	type tSync struct {
+		sync.Mutex
+		Once sync.Once
+		RW sync.RWMutex
+		N atomic.Int64
+		A int
+	}
+	v := tSync{A: 5}
+	v.Lock()
+	bs, err := Marshal(&v)
+	v.Unlock()
+	checkErrT(t, err)
+	var m map[string]interface{}
+	checkErrT(t, Unmarshal(bs, &m, nil))
+	checkEqualT(t, m, map[string]interface{}{"A": int8(5)})
+	var v2 tSync
+	checkErrT(t, Unmarshal(bs, &v2, nil))
+	checkEqualT(t, v2.A, 5)
+}
+
+func TestStrictDecode(t *testing.T) {
+	strict := &DecoderOptions{Strict: true}
+	var v interface{}
+	// minimal encodings from our encoder pass in strict mode
+	for _, v0 := range []interface{}{ 5, -5, 200, -200, uint(200), 70000, "abc", table } {
+		bs, err := Marshal(v0)
+		checkErrT(t, err)
+		checkErrT(t, NewDecoderWithOptions(bytes.NewBuffer(bs), nil, strict).Decode(&v))
+	}
+	for _, bs := range [][]byte{
+		{ 0xcf, 0, 0, 0, 0, 0, 0, 0, 5 },  // uint8 value as uint64
+		{ 0xd0, 0x05 },                    // fixnum value as int8
+		{ 0xd1, 0xff, 0xf0 },              // int8 value as int16
+		{ 0xdb, 0, 0, 0, 1, 'a' },         // 1-char string with raw32
+		{ 0xdc, 0, 1, 0x01 },              // 1-element array with array16
+	} {
+		var i int
+		var err error
+		if bs[0] == 0xdb || bs[0] == 0xdc {
+			err = NewDecoderWithOptions(bytes.NewBuffer(bs), nil, nil).Decode(&v)
+		} else {
+			err = NewDecoderWithOptions(bytes.NewBuffer(bs), nil, nil).Decode(&i)
+		}
+		checkErrT(t, err)
+		if err = NewDecoderWithOptions(bytes.NewBuffer(bs), nil, strict).Decode(&v); err == nil {
+			logT(t, "Expecting error decoding non-minimal encoding: %x in strict mode", bs)
+			failT(t)
+		}
+		if err = NewDecoderWithOptions(bytes.NewBuffer(bs), nil, strict).Decode(&i); err == nil {
+			logT(t, "Expecting error decoding non-minimal encoding: %x into int in strict mode", bs)
+			failT(t)
+		}
+	}
+}
+
+func TestInvalidByte(t *testing.T) {
+	var v interface{}
+	var i int
+	var s string
+	for _, bs := range [][]byte{ {0xc1}, {0x92, 0x01, 0xc1}, {0x81, 0xa1, 'a', 0xc1} } {
+		checkEqualT(t, Unmarshal(bs, &v, nil), ErrInvalidByte)
+		checkEqualT(t, NewDecoder(bytes.NewBuffer(bs), nil).CopyValue(ioutil.Discard), ErrInvalidByte)
+	}
+	checkEqualT(t, Unmarshal([]byte{0xc1}, &i, nil), ErrInvalidByte)
+	checkEqualT(t, Unmarshal([]byte{0xc1}, &s, nil), ErrInvalidByte)
+}
+
+func TestDecodeSliceAndMapOfPtrs(t *testing.T) {
+	type tElem struct {
+		A int
+		S string
+	}
+	s0 := []*tElem{ {1, "one"}, nil, {3, "three"}, nil }
+	bs, err := Marshal(s0)
+	checkErrT(t, err)
+	var s1 []*tElem
+	checkErrT(t, Unmarshal(bs, &s1, nil))
+	checkEqualT(t, s1, s0)
+	// elements already present are reused
+	e0 := new(tElem)
+	s2 := []*tElem{ e0 }
+	checkErrT(t, Unmarshal(bs, &s2, nil))
+	checkEqualT(t, s2, s0)
+	checkEqualT(t, s2[0] == e0, true)
 	
-	var opts DecoderContainerResolver
-	serverExitChan := make(chan bool, 1)
-	serverFn := func() {
-		for { 
-			conn1, err1 := ln.Accept()
-			if err1 != nil {
-				continue
-			}
-			bs := make([]byte, 1)
-			n1, err1 := conn1.Read(bs)
-			if n1 != 1 || err1 != nil {
-				conn1.Close()
-				continue
+	m0 := map[string]*tElem{ "a": {1, "one"}, "n": nil }
+	bs, err = Marshal(m0)
+	checkErrT(t, err)
+	var m1 map[string]*tElem
+	checkErrT(t, Unmarshal(bs, &m1, nil))
+	checkEqualT(t, m1, m0)
+}
+
+func TestPeekType(t *testing.T) {
+	vs := []interface{}{ nil, true, int8(-5), uint16(300), 1.5, "str", []interface{}{int8(1)}, 
+		map[string]interface{}{"a": int8(1)} }
+	mts := []MsgpackType{ MsgpackNil, MsgpackBool, MsgpackInt, MsgpackUint, MsgpackFloat, 
+		MsgpackRawBytes, MsgpackArray, MsgpackMap }
+	buf := new(bytes.Buffer)
+	for _, v := range vs {
+		checkErrT(t, NewEncoder(buf).Encode(v))
+	}
+	dec := NewDecoder(buf, testDecOpts(mapStringIntfTyp, nil, true, true, true))
+	for i, v := range vs {
+		for j := 0; j < 2; j++ {
+			mt, err := dec.PeekType()
+			checkErrT(t, err)
+			checkEqualT(t, mt, mts[i])
+		}
+		var v1 interface{}
+		checkErrT(t, dec.Decode(&v1))
+		checkEqualT(t, v1, v)
+	}
+	_, err := dec.PeekType()
+	checkEqualT(t, err, io.EOF)
+}
+
+func TestDecodeNewFunc(t *testing.T) {
+	type tElem struct {
+		A int
+		S string
+	}
+	s0 := make([]*tElem, 1000)
+	for i := range s0 {
+		if i % 10 != 0 {
+			s0[i] = &tElem{i, strconv.Itoa(i)}
+		}
+	}
+	bs, err := Marshal(s0)
+	checkErrT(t, err)
+	pool := make([]tElem, 900)
+	var numNew, numOther int
+	dopts := &DecoderOptions{NewFunc: func(rt reflect.Type) interface{} {
+		if rt != reflect.TypeOf(tElem{}) {
+			numOther++
+			return nil
+		}
+		numNew++
+		return &pool[numNew-1]
+	}}
+	var s1 []*tElem
+	checkErrT(t, NewDecoderWithOptions(bytes.NewBuffer(bs), nil, dopts).Decode(&s1))
+	checkEqualT(t, s1, s0)
+	checkEqualT(t, numNew, 900)
+	checkEqualT(t, numOther, 0)
+	checkEqualT(t, s1[999] == &pool[899], true)
+}
+
+func TestMapKeyAsString(t *testing.T) {
+	m := map[testTextKey]int{ {1, 2}: 3, {4, 5}: 9 }
+	buf := new(bytes.Buffer)
+	checkErrT(t, NewEncoderWithOptions(buf, &EncoderOptions{MapKeyAsString: true}).Encode(m))
+	var m2 map[string]int
+	checkErrT(t, Unmarshal(buf.Bytes(), &m2, nil))
+	checkEqualT(t, m2, map[string]int{"1-2": 3, "4-5": 9})
+	// without the option, keys are encoded as structs
+	bs, err := Marshal(m)
+	checkErrT(t, err)
+	m2 = nil
+	if err = Unmarshal(bs, &m2, nil); err == nil {
+		logT(t, "Expecting error decoding struct keys into string keys")
+		t.FailNow()
+	}
+}
+
+func TestDuplicateKeyPolicy(t *testing.T) {
+	// {"a": 1, "b": 2, "a": 3}
+	bs := []byte{0x83, 0xa1, 'a', 0x01, 0xa1, 'b', 0x02, 0xa1, 'a', 0x03}
+	type tAB struct {
+		A int `msgpack:"a"`
+		B int `msgpack:"b"`
+	}
+	for _, x := range []struct { p DuplicateKeyPolicy; a int }{
+		{DuplicateKeyLastWins, 3}, {DuplicateKeyFirstWins, 1}, {DuplicateKeyError, -1},
+	} {
+		dopts := &DecoderOptions{DuplicateKeyPolicy: x.p}
+		var m map[string]int
+		var v tAB
+		err := NewDecoderWithOptions(bytes.NewBuffer(bs), nil, dopts).Decode(&m)
+		err2 := NewDecoderWithOptions(bytes.NewBuffer(bs), nil, dopts).Decode(&v)
+		if x.a < 0 {
+			if err == nil || err2 == nil {
+				logT(t, "Expecting duplicate key error. Got: %v, %v", err, err2)
+				t.FailNow()
 			}
-			var sc rpc.ServerCodec
-			switch bs[0] {
-			case 'B': 
-				sc = NewRPCServerCodec(conn1, opts)
-			case 'C':
-				sc = NewCustomRPCServerCodec(conn1, opts)
-			case 'X':
-				serverExitChan <- true
-				conn1.Close()
-				return // exit serverFn goroutine
+			continue
+		}
+		checkErrT(t, err)
+		checkErrT(t, err2)
+		checkEqualT(t, m, map[string]int{"a": x.a, "b": 2})
+		checkEqualT(t, v, tAB{x.a, 2})
+	}
+}
+
+func TestEncodeComplex(t *testing.T) {
+	if _, err := Marshal(complex(1, 2)); err == nil {
+		logT(t, "Expecting error encoding complex128 without EncodeComplex")
+		t.FailNow()
+	}
+	eopts := &EncoderOptions{EncodeComplex: true}
+	nan := math.NaN()
+	for _, v := range []interface{}{ complex(1.5, -2), complex64(complex(3, 4.25)), complex(nan, 1), complex64(complex(1, nan)) } {
+		buf := new(bytes.Buffer)
+		checkErrT(t, NewEncoderWithOptions(buf, eopts).Encode(v))
+		checkEqualT(t, buf.Bytes()[0], byte(0x92))
+		rv := reflect.New(reflect.TypeOf(v))
+		checkErrT(t, Unmarshal(buf.Bytes(), rv.Interface(), nil))
+		c0, c1 := reflect.ValueOf(v).Complex(), rv.Elem().Complex()
+		for _, f := range [][2]float64{ {real(c0), real(c1)}, {imag(c0), imag(c1)} } {
+			if f[0] != f[1] && !(math.IsNaN(f[0]) && math.IsNaN(f[1])) {
+				logT(t, "Complex values do not match: %v, %v", c0, c1)
+				failT(t)
 			}
-			if sc == nil {
-				conn1.Close()
-				continue
+		}
+	}
+}
+
+func TestReuseByteSlices(t *testing.T) {
+	bs, err := Marshal([]byte("abcdef"))
+	checkErrT(t, err)
+	reuse := &DecoderOptions{ReuseByteSlices: true}
+	for _, x := range []struct { opts *DecoderOptions; cap int; aliased bool }{
+		{ nil, 10, false }, { reuse, 10, true }, { reuse, 6, true }, { reuse, 3, false }, 
+	} {
+		b0 := make([]byte, 1, x.cap)
+		b1 := b0
+		checkErrT(t, NewDecoderWithOptions(bytes.NewBuffer(bs), nil, x.opts).Decode(&b1))
+		checkEqualT(t, string(b1), "abcdef")
+		checkEqualT(t, &b0[:1][0] == &b1[0], x.aliased)
+	}
+}
+
+func TestDecodeEach(t *testing.T) {
+	vs := []interface{}{ "one", int8(2), []interface{}{"three"} }
+	buf := new(bytes.Buffer)
+	for _, v := range vs {
+		checkErrT(t, NewEncoder(buf).Encode(v))
+	}
+	bs := buf.Bytes()
+	var vs2 []interface{}
+	checkErrT(t, NewDecoder(bytes.NewBuffer(bs), nil).DecodeEach(func(v interface{}) error {
+		vs2 = append(vs2, v)
+		return nil
+	}))
+	checkEqualT(t, vs2, vs)
+	// an error from fn stops the loop
+	errStop := errors.New("stop")
+	n := 0
+	checkEqualT(t, NewDecoder(bytes.NewBuffer(bs), nil).DecodeEach(func(v interface{}) error {
+		n++
+		return errStop
+	}), errStop)
+	checkEqualT(t, n, 1)
+}
+
+func TestLengthOverflow(t *testing.T) {
+	_, ok := uint32ToInt(0xFFFFFFFF, 32)
+	checkEqualT(t, ok, false)
+	_, ok = uint32ToInt(0x80000000, 32)
+	checkEqualT(t, ok, false)
+	i, ok := uint32ToInt(0x7FFFFFFF, 32)
+	checkEqualT(t, ok, true)
+	checkEqualT(t, i, math.MaxInt32)
+	if strconv.IntSize == 64 {
+		i, ok = uint32ToInt(0xFFFFFFFF, 64)
+		checkEqualT(t, ok, true)
+		checkEqualT(t, int64(i), int64(0xFFFFFFFF))
+	} else {
+		var v interface{}
+		if err := Unmarshal([]byte{0xdb, 0xff, 0xff, 0xff, 0xff}, &v, nil); err == nil {
+			logT(t, "Expecting length overflow error")
+			t.FailNow()
+		}
+	}
+}
+
+func TestEncodeSpecVersion(t *testing.T) {
+	type T struct {
+		S  string
+		B  []byte
+		At time.Time
+	}
+	v := T{"hi", []byte{1, 2}, time.Unix(1, 2)}
+	// V2013 (the default): raw bytes for both, and time as a [seconds, nanoseconds] array
+	want := []byte{0x83, 0xa1, 'S', 0xa2, 'h', 'i', 0xa1, 'B', 0xa2, 0x01, 0x02, 
+		0xa2, 'A', 't', 0x92, 0x01, 0x02}
+	for _, eopts := range []*EncoderOptions{nil, {SpecVersion: V2013}} {
+		var buf bytes.Buffer
+		checkErrT(t, NewEncoderWithOptions(&buf, eopts).Encode(v))
+		checkEqualT(t, buf.Bytes(), want)
+	}
+	// other options apply on top of the preset
+	var buf bytes.Buffer
+	checkErrT(t, NewEncoderWithOptions(&buf, &EncoderOptions{SpecVersion: V2013, BoolAsInt: true}).Encode(true))
+	checkEqualT(t, buf.Bytes(), []byte{0x01})
+
+	// Current is not supported yet: nothing is written
+	for _, sv := range []SpecVersion{Current, 9} {
+		buf.Reset()
+		e := NewEncoderWithOptions(&buf, &EncoderOptions{SpecVersion: sv})
+		for _, err := range []error{e.Encode(v), e.EncodeArrayStart(1), e.EncodeFromJSON(strings.NewReader("1"))} {
+			if err == nil || !strings.Contains(err.Error(), "SpecVersion") {
+				logT(t, "Expecting SpecVersion error for: %d. Got: %v", sv, err)
+				t.FailNow()
 			}
-			srv.ServeCodec(sc)
-			// for {
-			// 	if err1 = srv.ServeRequest(sc); err1 != nil {
-			// 		break
-			// 	}
-			// }
-			// if callClose {
-			// 	sc.Close() 
-			// }
 		}
+		checkEqualT(t, buf.Len(), 0)
 	}
-	
-	clientFn := func(cc rpc.ClientCodec) {
-		cl := rpc.NewClientWithCodec(cc)
-		if callClose {
-			defer cl.Close() 
-		} 
-		var up, sq, mult int
-		// log("Calling client")
-		checkErrT(t, cl.Call("TestRpcInt.Update", 5, &up))
-		// log("Called TestRpcInt.Update")
-		checkEqualT(t, testRpcInt.i, 5)
-		checkEqualT(t, up, 5)
-		checkErrT(t, cl.Call("TestRpcInt.Square", 1, &sq))
-		checkEqualT(t, sq, 25)
-		checkErrT(t, cl.Call("TestRpcInt.Mult", 20, &mult))
-		checkEqualT(t, mult, 100)		
+}
+
+func TestEncodeAutoFlush(t *testing.T) {
+	for _, autoFlush := range []bool{false, true} {
+		var buf bytes.Buffer
+		bw := bufio.NewWriter(&buf)
+		enc := NewEncoderWithOptions(bw, &EncoderOptions{AutoFlush: autoFlush})
+		checkErrT(t, enc.Encode("abc"))
+		if autoFlush {
+			checkEqualT(t, buf.Bytes(), []byte{0xa3, 'a', 'b', 'c'})
+		} else {
+			checkEqualT(t, buf.Len(), 0)
+		}
+		// an array of unknown length is written (and flushed) by EncodeEnd
+		buf.Reset()
+		bw.Reset(&buf)
+		checkErrT(t, enc.EncodeArrayStart(-1))
+		checkErrT(t, enc.Encode(1))
+		checkEqualT(t, buf.Len(), 0)
+		checkErrT(t, enc.EncodeEnd())
+		if autoFlush {
+			checkEqualT(t, buf.Bytes(), []byte{0x91, 0x01})
+		} else {
+			checkEqualT(t, buf.Len(), 0)
+		}
 	}
-	
-	connFn := func(req byte) (bs net.Conn) {
-		// log("calling f1")
-		bs, err2 := net.Dial(ln.Addr().Network(), ln.Addr().String())
-		// log("f1. bs: %v, err2: %v", bs, err2)
-		checkErrT(t, err2)
-		n1, err2 := bs.Write([]byte{req})
-		checkErrT(t, err2)
-		checkEqualT(t, n1, 1)
-		return
+}
+
+func TestEncodeErrorAsString(t *testing.T) {
+	type errStruct struct {
+		A   int
+		Err error
 	}
-	
-	go serverFn()
-	if doBasic {
-		bs := connFn('B')
-		cc := NewRPCClientCodec(bs, opts)
-		clientFn(cc)
+	opts := &EncoderOptions{EncodeErrorAsString: true}
+	for _, v := range []errStruct{{1, errors.New("failed")}, {2, nil}} {
+		var buf bytes.Buffer
+		err := NewEncoderWithOptions(&buf, opts).Encode(v)
+		checkErrT(t, err)
+		var m map[string]interface{}
+		err = Unmarshal(buf.Bytes(), &m, testDecOpts(nil, nil, false, false, true))
+		checkErrT(t, err)
+		var v2 errStruct
+		err = Unmarshal(buf.Bytes(), &v2, nil)
+		checkErrT(t, err)
+		checkEqualT(t, v2.A, v.A)
+		if v.Err == nil {
+			checkEqualT(t, m["Err"], nil)
+			checkEqualT(t, v2.Err, nil)
+		} else {
+			checkEqualT(t, m["Err"], "failed")
+			checkEqualT(t, v2.Err.Error(), "failed")
+		}
 	}
-	if doCustom {
-		bs := connFn('C')
-		cc := NewCustomRPCClientCodec(bs, opts)
-		clientFn(cc)
+}
+
+func TestEncodeOmitFunc(t *testing.T) {
+	type omitStruct struct {
+		Short string
+		Long  string
+		Empty string `msgpack:",omitempty"`
+		N     int
 	}
-	if doExit {
-		bs := connFn('X')
-		<- serverExitChan
-		bs.Close()
+	opts := &EncoderOptions{
+		OmitFunc: func(fieldName string, v reflect.Value) bool {
+			return v.Kind() == reflect.String && v.Len() > 8
+		},
+	}
+	var buf bytes.Buffer
+	err := NewEncoderWithOptions(&buf, opts).Encode(omitStruct{"short", "far too long", "", 5})
+	checkErrT(t, err)
+	var m map[string]interface{}
+	err = Unmarshal(buf.Bytes(), &m, testDecOpts(nil, nil, false, false, true))
+	checkErrT(t, err)
+	checkEqualT(t, m, map[string]interface{}{"Short": "short", "N": int8(5)})
+}
+
+func TestDecodeTimeFromString(t *testing.T) {
+	tt := time.Date(2012, 2, 1, 10, 30, 15, 0, time.UTC)
+	for _, layout := range []string{"", time.RFC1123} {
+		opts := &DecoderOptions{TimeLayout: layout}
+		if layout == "" {
+			layout = time.RFC3339
+		}
+		bs, err := Marshal([]interface{}{tt, tt.Format(layout)})
+		checkErrT(t, err)
+		var v []time.Time
+		err = NewDecoderWithOptions(bytes.NewReader(bs), nil, opts).Decode(&v)
+		checkErrT(t, err)
+		checkEqualT(t, len(v), 2)
+		for _, v2 := range v {
+			if !v2.Equal(tt) {
+				logT(t, "Time mismatch: expected: %v, got: %v", tt, v2)
+				t.FailNow()
+			}
+		}
+	}
+	bs, err := Marshal("not a time")
+	checkErrT(t, err)
+	var v time.Time
+	if err = Unmarshal(bs, &v, nil); err == nil {
+		logT(t, "Expected error decoding an invalid time string")
+		t.FailNow()
+	}
+}
+
+func TestDecodeFields(t *testing.T) {
+	type fieldsStruc struct {
+		A int64
+		B string
+		C []int64
+		D map[string]string
+	}
+	v0 := fieldsStruc{1, "b", []int64{3}, map[string]string{"d": "dd"}}
+	bs, err := Marshal(v0)
+	checkErrT(t, err)
+	dec := NewDecoder(bytes.NewReader(append(bs, bs...)), nil)
+	var v fieldsStruc
+	err = dec.DecodeFields(&v, []string{"B", "D"})
+	checkErrT(t, err)
+	checkEqualT(t, v, fieldsStruc{B: "b", D: v0.D})
+	// the allowlist only applies to a single call
+	v = fieldsStruc{}
+	err = dec.Decode(&v)
+	checkErrT(t, err)
+	checkEqualT(t, v, v0)
+	if err = dec.DecodeFields(new(int), []string{"A"}); err == nil {
+		logT(t, "Expected error from DecodeFields into a non-struct")
+		t.FailNow()
+	}
+}
+
+type testRegA struct {
+	Side int64
+}
+
+type testRegB struct {
+	Radius float64
+	Name   string
+}
+
+func TestRegister(t *testing.T) {
+	Register(testRegA{})
+	defer Unregister(testRegA{})
+	Register(&testRegB{})
+	defer Unregister(&testRegB{})
+	// registering again with the same name is a no-op
+	Register(testRegA{})
+	v0 := []interface{}{testRegA{2}, &testRegB{1.5, "b"}, map[string]interface{}{"x": "y"}}
+	bs, err := Marshal(v0)
+	checkErrT(t, err)
+	dam := testDecOpts(mapStringIntfTyp, nil, false, false, true)
+	dopts := &DecoderOptions{Types: DefaultTypeRegistry}
+	// with default options on both sides, the registered types round-trip
+	var v []interface{}
+	checkErrT(t, Unmarshal(bs, &v, dam))
+	checkEqualT(t, v, v0)
+	// names are qualified by the package path
+	var m []map[string]interface{}
+	checkErrT(t, Unmarshal(bs, &m, dam))
+	checkEqualT(t, m[0][registeredTypeKey], reflect.TypeOf(testRegA{}).PkgPath() + ".testRegA")
+	checkEqualT(t, m[1][registeredTypeKey], "*" + reflect.TypeOf(testRegA{}).PkgPath() + ".testRegB")
+	// with an empty registry, the maps are decoded as maps
+	v = nil
+	err = NewDecoderWithOptions(bytes.NewReader(bs), dam, &DecoderOptions{Types: NewTypeRegistry()}).Decode(&v)
+	checkErrT(t, err)
+	checkEqualT(t, v[0], interface{}(m[0]))
+	// the type name is ignored when decoding into a typed value
+	var a testRegA
+	err = NewDecoder(bytes.NewReader(bs[1:]), nil).Decode(&a)
+	checkErrT(t, err)
+	checkEqualT(t, a, testRegA{2})
+	// a separate registry is only used by the options it is set on
+	types := NewTypeRegistry()
+	types.RegisterName("a", testRegA{})
+	var buf bytes.Buffer
+	checkErrT(t, NewEncoderWithOptions(&buf, &EncoderOptions{Types: types}).Encode([]interface{}{testRegA{5}}))
+	v = nil
+	checkErrT(t, NewDecoderWithOptions(bytes.NewReader(buf.Bytes()), nil, &DecoderOptions{Types: types}).Decode(&v))
+	checkEqualT(t, v, []interface{}{testRegA{5}})
+	v = nil
+	checkErrT(t, NewDecoderWithOptions(bytes.NewReader(buf.Bytes()), dam, dopts).Decode(&v))
+	checkEqualT(t, v, []interface{}{map[string]interface{}{registeredTypeKey: "a", "Side": int8(5)}})
+	// registering a type twice with a different name panics
+	func() {
+		defer func() {
+			if recover() == nil {
+				logT(t, "Expected panic registering a type twice")
+				t.FailNow()
+			}
+		}()
+		RegisterName("regA", testRegA{})
+	}()
+}
+
+func TestDecodeArrayToChan(t *testing.T) {
+	bs, err := Marshal([]interface{}{int8(1), "two", []interface{}{int8(3)}})
+	checkErrT(t, err)
+	ch := make(chan interface{}, 3)
+	err = NewDecoder(bytes.NewReader(bs), nil).DecodeArrayToChan(ch)
+	checkErrT(t, err)
+	close(ch)
+	var vs []interface{}
+	for v := range ch {
+		vs = append(vs, v)
+	}
+	checkEqualT(t, vs, []interface{}{int8(1), "two", []interface{}{int8(3)}})
+	// a truncated element is not sent
+	ch = make(chan interface{}, 3)
+	err = NewDecoder(bytes.NewReader(bs[:len(bs)-1]), nil).DecodeArrayToChan(ch)
+	if err == nil {
+		logT(t, "Expected error decoding truncated array")
+		t.FailNow()
+	}
+	checkEqualT(t, len(ch), 2)
+}
+
+func TestEncodedWriterTo(t *testing.T) {
+	v := struct {
+		A int
+		B []interface{}
+	}{1, []interface{}{"x", nil}}
+	bs, err := Marshal(v)
+	checkErrT(t, err)
+
+	var buf bytes.Buffer
+	n, err := io.Copy(&buf, NewEncoded(v, nil))
+	checkErrT(t, err)
+	checkEqualT(t, n, int64(len(bs)))
+	checkEqualT(t, buf.Bytes(), bs)
+
+	buf.Reset()
+	n, err = NewEncoded(v, nil).WriteTo(&buf)
+	checkErrT(t, err)
+	checkEqualT(t, n, int64(len(bs)))
+	checkEqualT(t, buf.Bytes(), bs)
+
+	// reading it (e.g. as a request body) gives the same bytes, and it is read once
+	x := NewEncoded(v, nil)
+	rbs, err := ioutil.ReadAll(x)
+	checkErrT(t, err)
+	checkEqualT(t, rbs, bs)
+	buf.Reset()
+	n, err = x.WriteTo(&buf)
+	checkErrT(t, err)
+	checkEqualT(t, n, int64(0))
+
+	// the encode error is returned
+	_, err = io.Copy(&buf, NewEncoded(make(chan int), nil))
+	if err == nil {
+		logT(t, "Expecting error writing an Encoded chan")
+		t.FailNow()
+	}
+	if _, err = NewEncoded(make(chan int), nil).WriteTo(&buf); err == nil {
+		logT(t, "Expecting error writing an Encoded chan")
+		t.FailNow()
+	}
+}
+
+func TestMarshalAppend(t *testing.T) {
+	dst := make([]byte, 2, 64)
+	dst[0], dst[1] = 0x01, 0x02
+	bs, err := MarshalAppend(dst, "abc", nil)
+	checkErrT(t, err)
+	checkEqualT(t, bs, []byte{0x01, 0x02, 0xa3, 'a', 'b', 'c'})
+	// the existing capacity is reused
+	checkEqualT(t, &bs[0], &dst[0])
+	bs, err = MarshalAppend(bs[:0], int64(1), nil)
+	checkErrT(t, err)
+	checkEqualT(t, bs, []byte{0x01})
+	bs, err = MarshalAppend(dst, make(chan int), nil)
+	if err == nil {
+		logT(t, "Expected error encoding a chan")
+		t.FailNow()
+	}
+	checkEqualT(t, bs, dst)
+}
+
+func TestLenientBool(t *testing.T) {
+	type flagStruc struct {
+		I int
+		U uint8
+		S string
+	}
+	bs, err := Marshal(map[string]bool{"I": true, "U": true, "S": true})
+	checkErrT(t, err)
+	var v flagStruc
+	err = NewDecoderWithOptions(bytes.NewReader(bs), nil, &DecoderOptions{LenientBool: true}).Decode(&v)
+	checkErrT(t, err)
+	checkEqualT(t, v, flagStruc{1, 1, "true"})
+	bs, err = Marshal(false)
+	checkErrT(t, err)
+	err = NewDecoderWithOptions(bytes.NewReader(bs), nil, &DecoderOptions{LenientBool: true}).Decode(&v.S)
+	checkErrT(t, err)
+	checkEqualT(t, v.S, "false")
+	for _, target := range []interface{}{new(int), new(uint), new(string)} {
+		if err = Unmarshal(bs, target, nil); err == nil {
+			logT(t, "Expected error decoding bool into %T without LenientBool", target)
+			t.FailNow()
+		}
+	}
+}
+
+func TestNilInterfaceAsEmpty(t *testing.T) {
+	var nilp *int
+	v := []interface{}{nil, nilp}
+	for _, asEmpty := range []bool{false, true} {
+		var buf bytes.Buffer
+		enc := NewEncoderWithOptions(&buf, &EncoderOptions{NilInterfaceAsEmpty: asEmpty})
+		checkErrT(t, enc.Encode(nil))
+		checkErrT(t, enc.Encode(v))
+		if asEmpty {
+			checkEqualT(t, buf.Bytes(), []byte{0x80, 0x92, 0x80, 0xc0})
+		} else {
+			checkEqualT(t, buf.Bytes(), []byte{0xc0, 0x92, 0xc0, 0xc0})
+		}
+	}
+}
+
+func TestStringTagOption(t *testing.T) {
+	type idStruc struct {
+		ID   int64   `msgpack:"id,string"`
+		U    *uint16 `msgpack:",string"`
+		F    float64 `msgpack:",string"`
+		B    bool    `msgpack:",string"`
+		Name string  `msgpack:",string"`
+	}
+	u := uint16(7)
+	v0 := idStruc{1 << 60, &u, 1.5, true, "n"}
+	bs, err := Marshal(v0)
+	checkErrT(t, err)
+	var m map[string]interface{}
+	err = Unmarshal(bs, &m, testDecOpts(nil, nil, false, false, true))
+	checkErrT(t, err)
+	checkEqualT(t, m, map[string]interface{}{
+		"id": "1152921504606846976", "U": "7", "F": "1.5", "B": "true", "Name": "n"})
+	var v idStruc
+	err = Unmarshal(bs, &v, nil)
+	checkErrT(t, err)
+	checkEqualT(t, v, v0)
+	// a number in the stream is still accepted
+	bs, err = Marshal(map[string]interface{}{"id": 5})
+	checkErrT(t, err)
+	err = Unmarshal(bs, &v, nil)
+	checkErrT(t, err)
+	checkEqualT(t, v.ID, int64(5))
+	bs, err = Marshal(map[string]interface{}{"id": "x"})
+	checkErrT(t, err)
+	if err = Unmarshal(bs, &v, nil); err == nil {
+		logT(t, "Expected error decoding an invalid number string")
+		t.FailNow()
+	}
+}
+
+func TestBatchDecode(t *testing.T) {
+	v0 := make([]TestStruc, 50)
+	for j := range v0 {
+		v0[j] = newTestStruc(0, false)
+		v0[j].I64 = int64(j)
+	}
+	bs, err := Marshal(v0)
+	checkErrT(t, err)
+	var v1, v2 []TestStruc
+	err = Unmarshal(bs, &v1, nil)
+	checkErrT(t, err)
+	for _, concurrency := range []int{0, 1, 4} {
+		v2 = nil
+		err = NewDecoder(bytes.NewReader(bs), nil).BatchDecode(&v2, concurrency)
+		checkErrT(t, err)
+		checkEqualT(t, v2, v1)
+	}
+	// an error decoding any element is returned
+	bs, err = Marshal([]interface{}{int8(1), "x", int8(3)})
+	checkErrT(t, err)
+	var is []int
+	if err = NewDecoder(bytes.NewReader(bs), nil).BatchDecode(&is, 2); err == nil {
+		logT(t, "Expected error decoding a string into an int")
+		t.FailNow()
+	}
+
+	// MaxTotalAlloc applies to the whole batch: many small elements add up
+	elems := make([][]byte, 200)
+	for j := range elems {
+		elems[j] = bytes.Repeat([]byte{byte(j)}, 100)
+	}
+	bs, err = Marshal(elems)
+	checkErrT(t, err)
+	for _, concurrency := range []int{1, 4} {
+		var bss [][]byte
+		d := NewDecoderWithOptions(bytes.NewReader(bs), nil, &DecoderOptions{MaxTotalAlloc: 10000})
+		if err = d.BatchDecode(&bss, concurrency); err == nil || !strings.Contains(err.Error(), "MaxTotalAlloc") {
+			logT(t, "Expecting MaxTotalAlloc error for the batch. Got: %v", err)
+			t.FailNow()
+		}
+		d = NewDecoderWithOptions(bytes.NewReader(bs), nil, &DecoderOptions{MaxTotalAlloc: 40000, CollectStats: true})
+		checkErrT(t, d.BatchDecode(&bss, concurrency))
+		checkEqualT(t, bss, elems)
+		checkEqualT(t, d.Stats().Allocs, 202)
+	}
+	// the offsets and the slice are counted before they are allocated
+	var bss [][]byte
+	d := NewDecoderWithOptions(bytes.NewReader([]byte{0xdd, 0x7f, 0xff, 0xff, 0xff}), nil, 
+		&DecoderOptions{MaxTotalAlloc: 1 << 20})
+	if err = d.BatchDecode(&bss, 2); err == nil || !strings.Contains(err.Error(), "MaxTotalAlloc") {
+		logT(t, "Expecting MaxTotalAlloc error for a huge array header. Got: %v", err)
+		t.FailNow()
+	}
+}
+
+func TestEncodeUintptr(t *testing.T) {
+	v := []interface{}{uintptr(5)}
+	_, err := Marshal(v)
+	if terr, ok := err.(*UnsupportedTypeError); !ok || terr.Type != reflect.TypeOf(uintptr(0)) {
+		logT(t, "Expected UnsupportedTypeError for uintptr. Got: %v", err)
+		t.FailNow()
+	}
+	_, err = Marshal(make(chan int))
+	if _, ok := err.(*UnsupportedTypeError); !ok {
+		logT(t, "Expected UnsupportedTypeError for chan. Got: %v", err)
+		t.FailNow()
+	}
+	var buf bytes.Buffer
+	err = NewEncoderWithOptions(&buf, &EncoderOptions{AllowUintptr: true}).Encode(v)
+	checkErrT(t, err)
+	checkEqualT(t, buf.Bytes(), []byte{0x91, 0x05})
+}
+
+type TestShape interface {
+	Area() float64
+}
+
+type testCircle struct {
+	R float64
+}
+
+func (c testCircle) Area() float64 { return 3 * c.R * c.R }
+
+type testSquare struct {
+	Side float64
+}
+
+func (s *testSquare) Area() float64 { return s.Side * s.Side }
+
+type testShapeHolder struct {
+	TestShape
+	Name string
+}
+
+func TestDecodeEmbeddedInterface(t *testing.T) {
+	Register(testCircle{})
+	defer Unregister(testCircle{})
+	v0 := testShapeHolder{testCircle{2}, "c"}
+	bs, err := Marshal(v0)
+	checkErrT(t, err)
+	// nil: the registered type is used
+	var v testShapeHolder
+	err = NewDecoderWithOptions(bytes.NewReader(bs), nil, &DecoderOptions{Types: DefaultTypeRegistry}).Decode(&v)
+	checkErrT(t, err)
+	checkEqualT(t, v, v0)
+	checkEqualT(t, v.Area(), float64(12))
+	// pre-set: the concrete value (pointer or not) is decoded into
+	bs, err = Marshal(map[string]interface{}{"TestShape": map[string]interface{}{"Side": 3.0}})
+	checkErrT(t, err)
+	sq := &testSquare{}
+	v = testShapeHolder{TestShape: sq}
+	err = Unmarshal(bs, &v, nil)
+	checkErrT(t, err)
+	checkEqualT(t, v.TestShape == TestShape(sq), true)
+	checkEqualT(t, sq.Side, 3.0)
+	bs, err = Marshal(map[string]interface{}{"TestShape": map[string]interface{}{"R": 1.0}})
+	checkErrT(t, err)
+	v = testShapeHolder{TestShape: testCircle{5}}
+	err = Unmarshal(bs, &v, nil)
+	checkErrT(t, err)
+	checkEqualT(t, v.TestShape, TestShape(testCircle{1}))
+}
+
+func TestErrorOnTrailingBytes(t *testing.T) {
+	bs, err := Marshal("abc")
+	checkErrT(t, err)
+	bs = append(bs, 0x01, 0x02)
+	var v string
+	err = Unmarshal(bs, &v, nil)
+	if terr, ok := err.(*TrailingBytesError); !ok || terr.N != 2 {
+		logT(t, "Expected TrailingBytesError with 2 bytes. Got: %v", err)
+		t.FailNow()
+	}
+	checkEqualT(t, v, "abc")
+	// a streaming Decode only checks if asked to (here with a reader without Len())
+	checkErrT(t, NewDecoder(bufio.NewReader(bytes.NewReader(bs)), nil).Decode(&v))
+	opts := &DecoderOptions{ErrorOnTrailingBytes: true}
+	err = NewDecoderWithOptions(bufio.NewReader(bytes.NewReader(bs)), nil, opts).Decode(&v)
+	if terr, ok := err.(*TrailingBytesError); !ok || terr.N != 2 {
+		logT(t, "Expected TrailingBytesError with 2 bytes. Got: %v", err)
+		t.FailNow()
+	}
+	err = Unmarshal(bs[:4], &v, nil)
+	checkErrT(t, err)
+}
+
+type testMoney float64
+
+type testInvoice struct {
+	Total testMoney
+	Items []*testMoney
+}
+
+func TestRegisterEncoderDecoder(t *testing.T) {
+	moneyTyp := reflect.TypeOf(testMoney(0))
+	eopts := &EncoderOptions{}
+	eopts.RegisterEncoder(moneyTyp, func(e *Encoder, rv reflect.Value) error {
+		return e.Encode(int64(math.Floor(rv.Float() * 100 + 0.5)))
+	})
+	dopts := &DecoderOptions{}
+	dopts.RegisterDecoder(moneyTyp, func(d *Decoder, rv reflect.Value) error {
+		var cents int64
+		if err := d.Decode(&cents); err != nil {
+			return err
+		}
+		rv.SetFloat(float64(cents) / 100)
+		return nil
+	})
+	m1 := testMoney(2.5)
+	v0 := testInvoice{12.34, []*testMoney{&m1}}
+	var buf bytes.Buffer
+	checkErrT(t, NewEncoderWithOptions(&buf, eopts).Encode(v0))
+	// the wire form is plain integers
+	var m map[string]interface{}
+	checkErrT(t, Unmarshal(buf.Bytes(), &m, testDecOpts(nil, nil, false, false, true)))
+	checkEqualT(t, m, map[string]interface{}{"Total": int16(1234), "Items": []interface{}{int16(250)}})
+	opts := *dopts
+	opts.ErrorOnTrailingBytes = true
+	var v testInvoice
+	checkErrT(t, NewDecoderWithOptions(bytes.NewReader(buf.Bytes()), nil, &opts).Decode(&v))
+	checkEqualT(t, v, v0)
+	// errors from the registered functions are returned
+	eopts.RegisterEncoder(moneyTyp, func(e *Encoder, rv reflect.Value) error {
+		return errors.New("no money")
+	})
+	checkEqualT(t, NewEncoderWithOptions(&buf, eopts).Encode(v0), errors.New("no money"))
+}
+
+func TestMapKeySort(t *testing.T) {
+	m := map[string]int{"a": 1, "c": 3, "b": 2, "d": 4}
+	opts := &EncoderOptions{
+		Canonical: true,
+		MapKeySort: func(a, b reflect.Value) bool { return a.String() > b.String() },
+	}
+	var buf bytes.Buffer
+	checkErrT(t, NewEncoderWithOptions(&buf, opts).Encode(m))
+	checkEqualT(t, buf.Bytes(), []byte{0x84, 0xa1, 'd', 4, 0xa1, 'c', 3, 0xa1, 'b', 2, 0xa1, 'a', 1})
+}
+
+func TestDecodePtrFieldsLazily(t *testing.T) {
+	type inner struct {
+		N int
+	}
+	type outer struct {
+		A *inner
+		B *inner
+		C *inner
+	}
+	bs, err := Marshal(map[string]interface{}{"A": map[string]int{"N": 1}, "C": nil})
+	checkErrT(t, err)
+	var v outer
+	checkErrT(t, Unmarshal(bs, &v, nil))
+	checkEqualT(t, v, outer{A: &inner{1}})
+	// a nil in the stream sets an allocated pointer back to nil
+	v = outer{C: &inner{3}}
+	checkErrT(t, Unmarshal(bs, &v, nil))
+	checkEqualT(t, v.C == nil, true)
+}
+
+func TestDecodeStats(t *testing.T) {
+	type statsStruc struct {
+		S string
+		P *int64
+		L []int64
+		M map[string]int32
+	}
+	i := int64(5)
+	bs, err := Marshal(statsStruc{"abc", &i, []int64{1, 2}, map[string]int32{"k": 1}})
+	checkErrT(t, err)
+	dec := NewDecoderWithOptions(bytes.NewReader(append(bs, bs...)), nil, &DecoderOptions{CollectStats: true})
+	var v statsStruc
+	checkErrT(t, dec.Decode(&v))
+	// 4 field names (1 byte each), S (3 bytes), P (8), L (2*8), M (1 entry) and its key (1)
+	mentry := int(reflect.TypeOf("").Size()) + 4
+	checkEqualT(t, dec.Stats(), DecodeStats{Allocs: 9, Bytes: 4 + 3 + 8 + 16 + mentry + 1})
+	// stats are reset by each Decode, and existing values are reused 
+	checkErrT(t, dec.Decode(&v))
+	checkEqualT(t, dec.Stats(), DecodeStats{Allocs: 6, Bytes: 4 + 3 + 1})
+}
+
+func TestEncodeIntfSliceDispatch(t *testing.T) {
+	Register(testRegA{})
+	type plain struct {
+		X int8
+	}
+	v0 := []interface{}{
+		int8(1), "s", plain{2}, testRegA{3}, 
+		[]interface{}{"nested", testRegA{4}}, 
+		map[string]interface{}{"k": testRegA{5}},
+	}
+	defer Unregister(testRegA{})
+	bs, err := Marshal(v0)
+	checkErrT(t, err)
+	var v []interface{}
+	checkErrT(t, NewDecoderWithOptions(bytes.NewReader(bs), testDecOpts(mapStringIntfTyp, nil, true, true, true), 
+		&DecoderOptions{Types: DefaultTypeRegistry}).Decode(&v))
+	// an unregistered struct decodes as a map; registered ones as their type
+	checkEqualT(t, v, []interface{}{
+		int8(1), "s", map[string]interface{}{"X": int8(2)}, testRegA{3},
+		[]interface{}{"nested", testRegA{4}},
+		map[string]interface{}{"k": testRegA{5}},
+	})
+}
+
+func TestBoolAsInt(t *testing.T) {
+	var buf bytes.Buffer
+	checkErrT(t, NewEncoderWithOptions(&buf, &EncoderOptions{BoolAsInt: true}).Encode([]bool{true, false}))
+	checkEqualT(t, buf.Bytes(), []byte{0x92, 0x01, 0x00})
+	var v []bool
+	dec := NewDecoderWithOptions(bytes.NewReader(buf.Bytes()), nil, &DecoderOptions{LenientBool: true})
+	checkErrT(t, dec.Decode(&v))
+	checkEqualT(t, v, []bool{true, false})
+	if err := Unmarshal(buf.Bytes(), &v, nil); err == nil {
+		logT(t, "Expected error decoding an int into a bool without LenientBool")
+		t.FailNow()
+	}
+}
+
+func TestMaxContainerLen(t *testing.T) {
+	opts := &DecoderOptions{MaxMapLen: 100, MaxArrayLen: 10}
+	// a map16 header declaring 1000 entries (and no entries following)
+	var m map[string]int
+	err := NewDecoderWithOptions(bytes.NewReader([]byte{0xde, 0x03, 0xe8}), nil, opts).Decode(&m)
+	if err == nil || !strings.Contains(err.Error(), "MaxMapLen") {
+		logT(t, "Expected MaxMapLen error. Got: %v", err)
+		t.FailNow()
+	}
+	var v interface{}
+	err = NewDecoderWithOptions(bytes.NewReader([]byte{0xdc, 0x00, 0x0b}), nil, opts).Decode(&v)
+	if err == nil || !strings.Contains(err.Error(), "MaxArrayLen") {
+		logT(t, "Expected MaxArrayLen error. Got: %v", err)
+		t.FailNow()
+	}
+	bs, err := Marshal(make([]int, 10))
+	checkErrT(t, err)
+	checkErrT(t, NewDecoderWithOptions(bytes.NewReader(bs), nil, opts).Decode(&v))
+}
+
+func TestEncodeReflectValue(t *testing.T) {
+	type rvStruc struct {
+		A int8
+		B string
+	}
+	v := rvStruc{1, "b"}
+	bs0, err := Marshal(v)
+	checkErrT(t, err)
+	bs, err := Marshal(reflect.ValueOf(v))
+	checkErrT(t, err)
+	checkEqualT(t, bs, bs0)
+	// also within an interface{}
+	bs0, err = Marshal([]interface{}{v})
+	checkErrT(t, err)
+	bs, err = Marshal([]interface{}{reflect.ValueOf(v)})
+	checkErrT(t, err)
+	checkEqualT(t, bs, bs0)
+}
+
+func TestIntAsFloat(t *testing.T) {
+	bs, err := Marshal([]interface{}{uint64(math.MaxUint32 + 1), int8(-5), int64(math.MinInt32 - 1), 7, 1.5})
+	checkErrT(t, err)
+	var v interface{}
+	dec := NewDecoderWithOptions(bytes.NewReader(bs), nil, &DecoderOptions{IntAsFloat: true})
+	checkErrT(t, dec.Decode(&v))
+	checkEqualT(t, v, []interface{}{float64(math.MaxUint32 + 1), float64(-5), float64(math.MinInt32 - 1), float64(7), 1.5})
+}
+
+func TestLowerCaseFieldNames(t *testing.T) {
+	type lcStruc struct {
+		UserID  int8
+		Name    string
+		Tagged  string `msgpack:"TaggedName"`
+		Options bool   `msgpack:",omitempty"`
+	}
+	v0 := lcStruc{1, "n", "t", true}
+	var buf bytes.Buffer
+	checkErrT(t, NewEncoderWithOptions(&buf, &EncoderOptions{LowerCaseFieldNames: true}).Encode(v0))
+	var m map[string]interface{}
+	checkErrT(t, Unmarshal(buf.Bytes(), &m, testDecOpts(nil, nil, false, false, true)))
+	checkEqualT(t, m, map[string]interface{}{"userid": int8(1), "name": "n", "TaggedName": "t", "options": true})
+	var v lcStruc
+	dec := NewDecoderWithOptions(bytes.NewReader(buf.Bytes()), nil, &DecoderOptions{CaseInsensitiveFieldMatch: true})
+	checkErrT(t, dec.Decode(&v))
+	checkEqualT(t, v, v0)
+}
+
+// testCamelToSnake converts e.g. "UserID" to "user_id".
+func testCamelToSnake(s string) string {
+	var buf bytes.Buffer
+	for i, r := range s {
+		if r >= 'A' && r <= 'Z' {
+			if i > 0 && (s[i-1] < 'A' || s[i-1] > 'Z' || (i+1 < len(s) && s[i+1] >= 'a' && s[i+1] <= 'z')) {
+				buf.WriteByte('_')
+			}
+			r += 'a' - 'A'
+		}
+		buf.WriteRune(r)
+	}
+	return buf.String()
+}
+
+func TestFieldNameTransform(t *testing.T) {
+	type snakeStruc struct {
+		UserID    int8
+		FirstName string
+		Tagged    string `msgpack:"TaggedName"`
+	}
+	v0 := snakeStruc{1, "f", "t"}
+	var buf bytes.Buffer
+	err := NewEncoderWithOptions(&buf, &EncoderOptions{FieldNameTransform: testCamelToSnake}).Encode(v0)
+	checkErrT(t, err)
+	var m map[string]interface{}
+	checkErrT(t, Unmarshal(buf.Bytes(), &m, testDecOpts(nil, nil, false, false, true)))
+	checkEqualT(t, m, map[string]interface{}{"user_id": int8(1), "first_name": "f", "TaggedName": "t"})
+	var v snakeStruc
+	dec := NewDecoderWithOptions(bytes.NewReader(buf.Bytes()), nil, &DecoderOptions{FieldNameTransform: testCamelToSnake})
+	checkErrT(t, dec.Decode(&v))
+	checkEqualT(t, v, v0)
+}
+
+func TestRegisterDecoderNested(t *testing.T) {
+	dopts := &DecoderOptions{}
+	dopts.RegisterDecoder(reflect.TypeOf(testMoney(0)), func(d *Decoder, rv reflect.Value) error {
+		var cents int64
+		if err := d.Decode(&cents); err != nil {
+			return err
+		}
+		rv.SetFloat(float64(cents) / 100)
+		return nil
+	})
+	type nested struct {
+		A testMoney
+		B []testMoney
+		C map[string]testMoney
+	}
+	bs, err := Marshal(map[string]interface{}{
+		"A": 150, 
+		"B": []int{1, 2},
+		"C": map[string]int{"x": 250},
+	})
+	checkErrT(t, err)
+	var v1 nested
+	checkErrT(t, NewDecoderWithOptions(bytes.NewReader(bs), nil, dopts).Decode(&v1))
+	checkEqualT(t, v1, nested{1.5, []testMoney{0.01, 0.02}, map[string]testMoney{"x": 2.5}})
+
+	// registered types nested as map values decode through the generic (interface) path
+	Register(testRegA{})
+	defer Unregister(testRegA{})
+	bs, err = Marshal(map[string]interface{}{"s": []interface{}{testRegA{2}}, "a": testRegA{3}})
+	checkErrT(t, err)
+	var v2 map[string]interface{}
+	dam := &testParentResolver{SimpleDecoderContainerResolver: SimpleDecoderContainerResolver{BytesStringMapValue: true}}
+	checkErrT(t, NewDecoderWithOptions(bytes.NewReader(bs), dam, 
+		&DecoderOptions{Types: DefaultTypeRegistry}).Decode(&v2))
+	checkEqualT(t, v2["s"], []interface{}{testRegA{2}})
+	checkEqualT(t, v2["a"], testRegA{3})
+	// the resolver is passed the parent container of the maps of the registered values
+	// (in the order of the map entries, which is random)
+	if len(dam.mapParents) == 2 && dam.mapParents[0] == reflect.Slice {
+		dam.mapParents[0], dam.mapParents[1] = dam.mapParents[1], dam.mapParents[0]
+	}
+	checkEqualT(t, dam.mapParents, []reflect.Kind{reflect.Map, reflect.Slice})
+}
+
+// testParentResolver records the kinds of the parent containers of the maps it makes.
+type testParentResolver struct {
+	SimpleDecoderContainerResolver
+	mapParents []reflect.Kind
+}
+
+func (r *testParentResolver) DecoderContainer(parentcontainer reflect.Value, parentkey interface{}, 
+	length int, ct ContainerType) reflect.Value {
+	if ct == ContainerMap {
+		r.mapParents = append(r.mapParents, parentcontainer.Kind())
+	}
+	return r.SimpleDecoderContainerResolver.DecoderContainer(parentcontainer, parentkey, length, ct)
+}
+
+func TestDecodeMapField(t *testing.T) {
+	m := make(map[interface{}]interface{}, 102)
+	for i := 0; i < 100; i++ {
+		m[fmt.Sprintf("F%d", i)] = []interface{}{i, "s", map[string]int{"x": i}}
+	}
+	m["Target"] = map[string]interface{}{"A": 1.5, "B": "b"}
+	m[int64(7)] = "int key"
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	checkErrT(t, enc.Encode(m))
+	checkErrT(t, enc.Encode("next"))
+	dec := NewDecoder(bytes.NewReader(buf.Bytes()), nil)
+	var v struct {
+		A float64
+		B string
+	}
+	checkErrT(t, dec.DecodeMapField("Target", &v))
+	checkEqualT(t, v.A, 1.5)
+	checkEqualT(t, v.B, "b")
+	// the whole map was consumed
+	var s string
+	checkErrT(t, dec.Decode(&s))
+	checkEqualT(t, s, "next")
+
+	err := NewDecoder(bytes.NewReader(buf.Bytes()), nil).DecodeMapField("Missing", &v)
+	if _, ok := err.(*MapFieldNotFoundError); !ok {
+		logT(t, "Expecting *MapFieldNotFoundError. Got: %v", err)
+		t.FailNow()
+	}
+	err = NewDecoder(bytes.NewReader([]byte{0x91, 0x01}), nil).DecodeMapField("A", &v)
+	if err == nil {
+		logT(t, "Expecting error decoding map field from array")
+		t.FailNow()
+	}
+}
+
+func TestEncodeTimeAsString(t *testing.T) {
+	tm := time.Date(2012, 5, 6, 7, 8, 9, 0, time.FixedZone("", 3600))
+	var buf bytes.Buffer
+	err := NewEncoderWithOptions(&buf, &EncoderOptions{TimeAsString: true}).Encode(tm)
+	checkErrT(t, err)
+	var s string
+	checkErrT(t, Unmarshal(buf.Bytes(), &s, nil))
+	checkEqualT(t, s, "2012-05-06T07:08:09+01:00")
+	var tm2 time.Time
+	checkErrT(t, Unmarshal(buf.Bytes(), &tm2, nil))
+	checkEqualT(t, tm2.Equal(tm), true)
+
+	// custom layout, paired with DecoderOptions.TimeLayout
+	buf.Reset()
+	eopts := &EncoderOptions{TimeAsString: true, TimeLayout: "2006-01-02 15:04"}
+	err = NewEncoderWithOptions(&buf, eopts).Encode(struct{ T time.Time }{tm})
+	checkErrT(t, err)
+	var v struct{ T time.Time }
+	dopts := &DecoderOptions{TimeLayout: "2006-01-02 15:04"}
+	checkErrT(t, NewDecoderWithOptions(&buf, nil, dopts).Decode(&v))
+	checkEqualT(t, v.T.Format("2006-01-02 15:04"), "2012-05-06 07:08")
+}
+
+func TestDump(t *testing.T) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	checkErrT(t, enc.Encode(map[string]interface{}{
+		"list": []interface{}{int8(-3), uint64(200), 1.5, float32(2.5), true, nil, []byte{0xc1, 0xff}},
+		"sub": map[string]interface{}{"name": "x y"},
+	}))
+	checkErrT(t, enc.Encode(7))
+	var out bytes.Buffer
+	checkErrT(t, Dump(buf.Bytes(), &out))
+	s := out.String()
+	for _, sub := range []string{
+		"map(2) {\n",
+		"\n  raw(4) \"list\": array(7) [\n",
+		"\n    int64 -3\n",
+		"\n    uint64 200\n",
+		"\n    float64 1.5\n",
+		"\n    float32 2.5\n",
+		"\n    bool true\n",
+		"\n    nil\n",
+		"\n    raw(2) 0xc1ff\n",
+		"\n  ]\n",
+		"\n  raw(3) \"sub\": map(1) {\n",
+		"\n    raw(4) \"name\": raw(3) \"x y\"\n",
+		"\n}\nint64 7\n",
+	} {
+		if !strings.Contains(s, sub) {
+			logT(t, "Dump output: expecting %q in:\n%s", sub, s)
+			t.FailNow()
+		}
+	}
+	if err := Dump([]byte{0x92, 0x01}, &out); err == nil {
+		logT(t, "Expecting error dumping truncated data")
+		t.FailNow()
+	}
+}
+
+func TestDecodeScalarIntoNilPtr(t *testing.T) {
+	vals := []interface{}{
+		true, "abc", []byte("xyz"), 1.5, float32(2.5), 
+		int(-100), int8(-8), int16(300), int32(-70000), int64(1 << 40),
+		uint(100), uint8(200), uint16(60000), uint32(1 << 20), uint64(1 << 40),
+	}
+	for _, v0 := range vals {
+		bs, err := Marshal(v0)
+		checkErrT(t, err)
+		// a nil *T is allocated
+		rp := reflect.New(reflect.PtrTo(reflect.TypeOf(v0)))
+		checkErrT(t, Unmarshal(bs, rp.Interface(), nil))
+		if rp.Elem().IsNil() {
+			logT(t, "%T: Expecting pointer to be allocated", v0)
+			t.FailNow()
+		}
+		checkEqualT(t, rp.Elem().Elem().Interface(), v0)
+		// nil sets the *T back to nil
+		checkErrT(t, Unmarshal([]byte{0xc0}, rp.Interface(), nil))
+		if !rp.Elem().IsNil() {
+			logT(t, "%T: Expecting nil pointer after decoding nil", v0)
+			t.FailNow()
+		}
+	}
+}
+
+func TestWrappedEncoderDecoder(t *testing.T) {
+	magic := []byte("MPK")
+	var buf bytes.Buffer
+	enc := NewWrappedEncoder(&buf, magic, 2, nil)
+	type T struct {
+		A string
+		B []int64
+	}
+	v0 := T{"a", []int64{1, 2}}
+	checkErrT(t, enc.Encode(v0))
+	checkErrT(t, enc.Encode("second"))
+	checkEqualT(t, buf.Bytes()[:4], []byte("MPK\x02"))
+
+	dec := NewWrappedDecoder(bytes.NewReader(buf.Bytes()), magic, 2, nil, nil)
+	var v1 T
+	checkErrT(t, dec.Decode(&v1))
+	checkEqualT(t, v1, v0)
+	var s string
+	checkErrT(t, dec.Decode(&s))
+	checkEqualT(t, s, "second")
+	checkEqualT(t, dec.Decode(&s), io.EOF)
+	// DecodeValue and EncodeValue read and write the header too
+	buf.Reset()
+	checkErrT(t, enc.EncodeValue(reflect.ValueOf(v0)))
+	checkErrT(t, enc.Encode("third"))
+	dec = NewWrappedDecoder(bytes.NewReader(buf.Bytes()), magic, 2, nil, nil)
+	v1 = T{}
+	checkErrT(t, dec.DecodeValue(reflect.ValueOf(&v1)))
+	checkEqualT(t, v1, v0)
+	checkErrT(t, dec.Decode(&s))
+	checkEqualT(t, s, "third")
+
+	err := NewWrappedDecoder(bytes.NewReader(buf.Bytes()), []byte("XYZ"), 2, nil, nil).Decode(&v1)
+	checkEqualT(t, err, ErrBadMagic)
+	// plain msgpack (without the header) is also bad magic
+	bs, err := Marshal("plain")
+	checkErrT(t, err)
+	err = NewWrappedDecoder(bytes.NewReader(bs), magic, 2, nil, nil).Decode(&s)
+	checkEqualT(t, err, ErrBadMagic)
+
+	err = NewWrappedDecoder(bytes.NewReader(buf.Bytes()), magic, 3, nil, nil).Decode(&v1)
+	verr, ok := err.(*VersionMismatchError)
+	if !ok {
+		logT(t, "Expecting *VersionMismatchError. Got: %v", err)
+		t.FailNow()
+	}
+	checkEqualT(t, *verr, VersionMismatchError{3, 2})
+}
+
+func TestDecodeToJSON(t *testing.T) {
+	bs, err := Marshal([]interface{}{
+		map[string]interface{}{"a": []interface{}{int8(-3), uint64(200), 1.5, float32(0.25), true, nil}},
+		map[int64]string{1: "one"},
+		"x\"y",
+		[]byte{0xc1, 0xff},
+	})
+	checkErrT(t, err)
+	var buf bytes.Buffer
+	checkErrT(t, NewDecoder(bytes.NewReader(bs), nil).DecodeToJSON(&buf))
+	checkEqualT(t, buf.String(), `[{"a":[-3,200,1.5,0.25,true,null]},{"1":"one"},"x\"y","wf8="]`)
+	if !json.Valid(buf.Bytes()) {
+		logT(t, "Invalid JSON: %s", buf.Bytes())
+		t.FailNow()
+	}
+
+	// a container key cannot be converted
+	bs, err = Marshal(map[interface{}]int{[2]int{1, 2}: 1})
+	checkErrT(t, err)
+	if err = NewDecoder(bytes.NewReader(bs), nil).DecodeToJSON(&buf); err == nil {
+		logT(t, "Expecting error converting map with array key")
+		t.FailNow()
+	}
+	bs, err = Marshal(math.NaN())
+	checkErrT(t, err)
+	if err = NewDecoder(bytes.NewReader(bs), nil).DecodeToJSON(&buf); err == nil {
+		logT(t, "Expecting error converting NaN")
+		t.FailNow()
+	}
+}
+
+func TestEncodeFromJSON(t *testing.T) {
+	type doc struct {
+		json string
+		v interface{}
+	}
+	docs := []doc{
+		{`null`, nil},
+		{`[1, -2, 300, 1.5, 1e3, "s", true, false, null, []]`, 
+			[]interface{}{int8(1), int8(-2), int16(300), 1.5, float64(1000), "s", true, false, nil, []interface{}{}}},
+		{`{"a": {"b": [{"c": "d"}]}, "e": {}}`, 
+			map[string]interface{}{
+				"a": map[string]interface{}{"b": []interface{}{map[string]interface{}{"c": "d"}}}, 
+				"e": map[string]interface{}{},
+			}},
+		{`18446744073709551615`, uint64(math.MaxUint64)},
+	}
+	dopts := testDecOpts(mapStringIntfTyp, nil, true, true, true)
+	for _, d := range docs {
+		var buf bytes.Buffer
+		checkErrT(t, NewEncoder(&buf).EncodeFromJSON(strings.NewReader(d.json)))
+		var v interface{}
+		checkErrT(t, Unmarshal(buf.Bytes(), &v, dopts))
+		checkEqualT(t, v, d.v)
+	}
+
+	// nested containers (with headers of each size) are written as by Encode
+	var big, deep []interface{}
+	for i := 0; i < 70000; i++ {
+		big = append(big, i%100)
+	}
+	deep = []interface{}{[]interface{}{big, []interface{}{}}, map[string]interface{}{"k": []interface{}{1}}}
+	js, err := json.Marshal(deep)
+	checkErrT(t, err)
+	var buf, buf2 bytes.Buffer
+	checkErrT(t, NewEncoder(&buf).EncodeFromJSON(bytes.NewReader(js)))
+	checkErrT(t, NewEncoder(&buf2).Encode(deep))
+	checkEqualT(t, buf.Bytes(), buf2.Bytes())
+
+	// base64 strings decoded for some keys
+	buf.Reset()
+	eopts := &EncoderOptions{JSONBase64Field: func(key string) bool { return key == "data" }}
+	err = NewEncoderWithOptions(&buf, eopts).EncodeFromJSON(strings.NewReader(
+		`{"data": ["AQI=", "/w=="], "name": "AQI="}`))
+	checkErrT(t, err)
+	var v struct {
+		Data [][]byte `msgpack:"data"`
+		Name string   `msgpack:"name"`
+	}
+	checkErrT(t, Unmarshal(buf.Bytes(), &v, nil))
+	checkEqualT(t, v.Data, [][]byte{{1, 2}, {0xff}})
+	checkEqualT(t, v.Name, "AQI=")
+
+	for _, s := range []string{`{"data": "!!"}`, `[1, 2`, `{"a" 1}`} {
+		if err = NewEncoderWithOptions(&buf, eopts).EncodeFromJSON(strings.NewReader(s)); err == nil {
+			logT(t, "Expecting error encoding from JSON: %s", s)
+			t.FailNow()
+		}
+	}
+
+	// the limits of the options apply
+	eopts = &EncoderOptions{MaxStringLen: 2, MaxBinLen: 1, MaxDepth: 4,
+		JSONBase64Field: func(key string) bool { return key == "b" }}
+	for _, x := range []struct {
+		json string
+		err string
+	}{
+		{`{"a": ["xy", {"b": "AQ=="}]}`, ""},
+		{`{"a": ["xyz"]}`, "MaxStringLen"},
+		{`{"abc": 1}`, "MaxStringLen"},
+		{`{"b": "AQI="}`, "MaxBinLen"},
+		{`[[[[1]]]]`, "Max depth"},
+		{`[[[[]]]]`, ""},
+	} {
+		err = NewEncoderWithOptions(ioutil.Discard, eopts).EncodeFromJSON(strings.NewReader(x.json))
+		if x.err == "" {
+			checkErrT(t, err)
+		} else if err == nil || !strings.Contains(err.Error(), x.err) {
+			logT(t, "Expecting %s error encoding from JSON: %s. Got: %v", x.err, x.json, err)
+			t.FailNow()
+		}
+	}
+}
+
+func TestEncodeMaxStringBinLen(t *testing.T) {
+	type inner struct {
+		Blob []byte
+	}
+	type T struct {
+		LongFieldNameHere string
+		Tags []string
+		In inner
+	}
+	eopts := &EncoderOptions{MaxStringLen: 4, MaxBinLen: 2}
+	v := T{"abcd", []string{"x", "y"}, inner{[]byte{1, 2}}}
+	var buf bytes.Buffer
+	// at the limits (field names are not limited)
+	checkErrT(t, NewEncoderWithOptions(&buf, eopts).Encode(v))
+
+	for _, x := range []struct {
+		v interface{}
+		errSub string
+	}{
+		{T{LongFieldNameHere: "abcde"}, "String length: 5 exceeds MaxStringLen: 4 (field: LongFieldNameHere)"},
+		{T{Tags: []string{"x", "hello"}}, "(field: Tags)"},
+		{T{In: inner{[]byte{1, 2, 3}}}, "Bytes length: 3 exceeds MaxBinLen: 2 (field: Blob)"},
+		{[3]byte{1, 2, 3}, "Bytes length: 3 exceeds MaxBinLen: 2"},
+		{"hello", "String length: 5 exceeds MaxStringLen: 4"},
+	} {
+		err := NewEncoderWithOptions(&buf, eopts).Encode(x.v)
+		if err == nil || !strings.Contains(err.Error(), x.errSub) {
+			logT(t, "Expecting error containing: %q. Got: %v", x.errSub, err)
+			t.FailNow()
+		}
+	}
+}
+
+func TestDecodeRequiredFields(t *testing.T) {
+	type T struct {
+		ID   int64  `msgpack:"id,required"`
+		Name string `msgpack:",required"`
+		Note string
+		Sub  *T     `msgpack:"sub"`
+	}
+	bs, err := Marshal(map[string]interface{}{"id": 1, "Name": "a", "sub": map[string]interface{}{"Note": "n"}})
+	checkErrT(t, err)
+	var v T
+	err = Unmarshal(bs, &v, nil)
+	merr, ok := err.(*MissingFieldsError)
+	if !ok {
+		logT(t, "Expecting *MissingFieldsError. Got: %v", err)
+		t.FailNow()
+	}
+	checkEqualT(t, merr.Fields, []string{"id", "Name"})
+	checkEqualT(t, merr.Type, reflect.TypeOf(v))
+
+	// an empty map reports all the required fields
+	err = Unmarshal([]byte{0x80}, &v, nil)
+	if merr, ok = err.(*MissingFieldsError); !ok || len(merr.Fields) != 2 {
+		logT(t, "Expecting *MissingFieldsError for 2 fields. Got: %v", err)
+		t.FailNow()
+	}
+
+	bs, err = Marshal(map[string]interface{}{"id": 1, "Name": "a"})
+	checkErrT(t, err)
+	v = T{}
+	checkErrT(t, Unmarshal(bs, &v, nil))
+	checkEqualT(t, v, T{ID: 1, Name: "a"})
+}
+
+func TestEncodeLazyValue(t *testing.T) {
+	type T struct {
+		A     int
+		Stats LazyValue `msgpack:",omitempty"`
+	}
+	calls := 0
+	lazy := LazyValue(func() (interface{}, error) {
+		calls++
+		return map[string]int{"n": 3}, nil
+	})
+	bs, err := Marshal(T{1, lazy})
+	checkErrT(t, err)
+	checkEqualT(t, calls, 1)
+	var v struct {
+		A     int
+		Stats map[string]int
+	}
+	checkErrT(t, Unmarshal(bs, &v, nil))
+	checkEqualT(t, v.Stats, map[string]int{"n": 3})
+
+	// not called if the field is omitted
+	var buf bytes.Buffer
+	eopts := &EncoderOptions{OmitFunc: func(name string, _ reflect.Value) bool { return name == "Stats" }}
+	checkErrT(t, NewEncoderWithOptions(&buf, eopts).Encode(T{1, lazy}))
+	checkEqualT(t, calls, 1)
+	// nil is omitted by omitempty
+	bs, err = Marshal(T{A: 1})
+	checkErrT(t, err)
+	checkEqualT(t, bs, []byte{0x81, 0xa1, 'A', 0x01})
+
+	errLazy := errors.New("lazy failed")
+	_, err = Marshal([]interface{}{LazyValue(func() (interface{}, error) { return nil, errLazy })})
+	checkEqualT(t, err, errLazy)
+	// other funcs are still unsupported
+	_, err = Marshal(func() {})
+	if _, ok := err.(*UnsupportedTypeError); !ok {
+		logT(t, "Expecting *UnsupportedTypeError. Got: %v", err)
+		t.FailNow()
+	}
+}
+
+func TestDecoderSkipValue(t *testing.T) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	// well-framed values which are not ints (one holding the invalid byte 0xc1 as raw bytes)
+	for _, v := range []interface{}{1, map[string]interface{}{"a": []int{1, 2}}, 2, []byte{0xc1, 0xc1}, "x", 3} {
+		checkErrT(t, enc.Encode(v))
+	}
+	dec := NewDecoder(&buf, nil)
+	var ints []int
+	for {
+		mt, err := dec.PeekType()
+		if err == io.EOF {
+			break
+		}
+		checkErrT(t, err)
+		if mt != MsgpackInt {
+			checkErrT(t, dec.SkipValue())
+			continue
+		}
+		var i int
+		checkErrT(t, dec.Decode(&i))
+		ints = append(ints, i)
+	}
+	checkEqualT(t, ints, []int{1, 2, 3})
+	checkEqualT(t, NewDecoder(bytes.NewReader([]byte{0x92, 0x01}), nil).SkipValue(), io.EOF)
+}
+
+func TestEncodeNilVsEmptyCollection(t *testing.T) {
+	for _, x := range []struct {
+		v interface{}
+		bs, bsEmpty []byte
+	}{
+		{[]interface{}(nil), []byte{0xc0}, []byte{0x90}},
+		{[]interface{}{}, []byte{0x90}, []byte{0x90}},
+		{[]interface{}{1, "a"}, []byte{0x92, 0x01, 0xa1, 'a'}, []byte{0x92, 0x01, 0xa1, 'a'}},
+		{map[string]int(nil), []byte{0xc0}, []byte{0x80}},
+		{[]byte(nil), []byte{0xc0}, []byte{0xa0}},
+	} {
+		bs, err := Marshal(x.v)
+		checkErrT(t, err)
+		checkEqualT(t, bs, x.bs)
+		var buf bytes.Buffer
+		err = NewEncoderWithOptions(&buf, &EncoderOptions{NilCollectionAsEmpty: true}).Encode(x.v)
+		checkErrT(t, err)
+		checkEqualT(t, buf.Bytes(), x.bsEmpty)
+	}
+	// and they decode back as nil, empty and populated slices
+	var v0, v1 []interface{}
+	checkErrT(t, Unmarshal([]byte{0xc0}, &v0, nil))
+	checkErrT(t, Unmarshal([]byte{0x90}, &v1, nil))
+	checkEqualT(t, v0 == nil, true)
+	checkEqualT(t, v1 != nil && len(v1) == 0, true)
+	var m0, m1 map[string]int
+	checkErrT(t, Unmarshal([]byte{0xc0}, &m0, nil))
+	checkErrT(t, Unmarshal([]byte{0x80}, &m1, nil))
+	checkEqualT(t, m0 == nil, true)
+	checkEqualT(t, m1 != nil && len(m1) == 0, true)
+	// raw bytes too, on the fast path, in a struct field and in an interface{}
+	var b0, b1 []byte
+	checkErrT(t, Unmarshal([]byte{0xc0}, &b0, nil))
+	checkErrT(t, Unmarshal([]byte{0xa0}, &b1, nil))
+	checkEqualT(t, b0 == nil, true)
+	checkEqualT(t, b1 != nil && len(b1) == 0, true)
+	var sb struct{ B []byte }
+	checkErrT(t, Unmarshal([]byte{0x81, 0xa1, 'B', 0xa0}, &sb, nil))
+	checkEqualT(t, sb.B != nil && len(sb.B) == 0, true)
+	var vi interface{}
+	checkErrT(t, Unmarshal([]byte{0xa0}, &vi, testDecOpts(nil, nil, false, false, false)))
+	bi, ok := vi.([]byte)
+	checkEqualT(t, ok && bi != nil && len(bi) == 0, true)
+}
+
+func TestMapAsPairArray(t *testing.T) {
+	eopts := &EncoderOptions{MapAsPairArray: true, Canonical: true}
+	var buf bytes.Buffer
+	v0 := map[int64]string{1: "a", -2: "b", 300: "c"}
+	checkErrT(t, NewEncoderWithOptions(&buf, eopts).Encode(v0))
+	// canonical order: by the encoded bytes of the keys
+	checkEqualT(t, buf.Bytes(), []byte{0x93, 
+		0x92, 0x01, 0xa1, 'a', 
+		0x92, 0xd1, 0x01, 0x2c, 0xa1, 'c', 
+		0x92, 0xfe, 0xa1, 'b'})
+	var v1 map[int64]string
+	checkErrT(t, Unmarshal(buf.Bytes(), &v1, nil))
+	checkEqualT(t, v1, v0)
+
+	// nested, with MapKeySort
+	type T struct {
+		M map[string][]int
+	}
+	eopts = &EncoderOptions{MapAsPairArray: true, 
+		MapKeySort: func(a, b reflect.Value) bool { return a.String() > b.String() }}
+	buf.Reset()
+	t0 := T{map[string][]int{"x": {1}, "y": {2, 3}}}
+	checkErrT(t, NewEncoderWithOptions(&buf, eopts).Encode(t0))
+	var iv interface{}
+	checkErrT(t, Unmarshal(buf.Bytes(), &iv, testDecOpts(nil, nil, true, true, true)))
+	checkEqualT(t, iv.(map[interface{}]interface{})["M"], []interface{}{
+		[]interface{}{"y", []interface{}{int8(2), int8(3)}}, 
+		[]interface{}{"x", []interface{}{int8(1)}},
+	})
+	var t1 T
+	checkErrT(t, Unmarshal(buf.Bytes(), &t1, nil))
+	checkEqualT(t, t1, t0)
+
+	// entries must be pairs
+	err := Unmarshal([]byte{0x91, 0x93, 0x01, 0x02, 0x03}, &v1, nil)
+	if err == nil {
+		logT(t, "Expecting error decoding map entry which is not a pair")
+		t.FailNow()
+	}
+}
+
+type testOneofSquare struct {
+	Side int
+}
+
+type testOneofText struct {
+	Body string
+	Lang string
+}
+
+func TestDecodeDiscriminatorMap(t *testing.T) {
+	types := NewTypeRegistry()
+	types.RegisterName("square", testOneofSquare{})
+	types.RegisterName("text", &testOneofText{})
+	type msg struct {
+		ID int
+		Payload interface{}
+	}
+	dopts := &DecoderOptions{DiscriminatorMap: true, Types: types}
+	for _, x := range []struct {
+		payload interface{}
+		v interface{}
+	}{
+		{map[string]interface{}{"square": map[string]interface{}{"Side": 3}}, testOneofSquare{3}},
+		{map[string]interface{}{"text": map[string]interface{}{"Body": "hi", "Lang": "en"}}, &testOneofText{"hi", "en"}},
+		// not a registered name: a map, as without the option
+		{map[string]interface{}{"other": 1}, map[interface{}]interface{}{"other": int8(1)}},
+		{map[int]interface{}{1: 1}, map[interface{}]interface{}{int8(1): int8(1)}},
+	} {
+		bs, err := Marshal(map[string]interface{}{"ID": 1, "Payload": x.payload})
+		checkErrT(t, err)
+		var v msg
+		checkErrT(t, NewDecoderWithOptions(bytes.NewReader(bs), nil, dopts).Decode(&v))
+		checkEqualT(t, v, msg{1, x.v})
+	}
+	// without the option, it is a map
+	bs, err := Marshal(map[string]interface{}{"square": map[string]interface{}{"Side": 3}})
+	checkErrT(t, err)
+	var v interface{}
+	checkErrT(t, Unmarshal(bs, &v, nil))
+	if _, ok := v.(map[interface{}]interface{}); !ok {
+		logT(t, "Expecting a map without DiscriminatorMap. Got: %T", v)
+		t.FailNow()
+	}
+}
+
+func TestEncodeFastPathMatchesReflect(t *testing.T) {
+	vals := []interface{}{
+		nil, true, false, 0, -1, int64(1 << 40), int64(-200), 0.5, "", "abc", []byte(nil), []byte{}, []byte{1, 2},
+		map[string]interface{}(nil), map[string]interface{}{}, 
+		map[string]interface{}{"a": 1, "b": []interface{}{"x", 2.5}, "c": map[string]interface{}{"d": nil}},
+	}
+	for _, eopts := range []*EncoderOptions{
+		{}, 
+		{BoolAsInt: true, NilInterfaceAsEmpty: true, NilCollectionAsEmpty: true},
+	} {
+		for _, v := range vals {
+			var buf1, buf2 bytes.Buffer
+			checkErrT(t, NewEncoderWithOptions(&buf1, eopts).Encode(v))
+			checkErrT(t, NewEncoderWithOptions(&buf2, eopts).EncodeValue(reflect.ValueOf(v)))
+			// map iteration order is random, so compare maps with more than one entry decoded
+			if m, ok := v.(map[string]interface{}); ok && len(m) > 1 {
+				var v1, v2 interface{}
+				checkErrT(t, Unmarshal(buf1.Bytes(), &v1, nil))
+				checkErrT(t, Unmarshal(buf2.Bytes(), &v2, nil))
+				checkEqualT(t, v1, v2)
+				continue
+			}
+			checkEqualT(t, buf1.Bytes(), buf2.Bytes())
+		}
+	}
+	// limits apply on the fast path too
+	eopts := &EncoderOptions{MaxStringLen: 2, MaxBinLen: 2, MaxDepth: 2}
+	for _, v := range []interface{}{
+		"abc", []byte{1, 2, 3}, map[string]interface{}{"abc": 1}, 
+		map[string]interface{}{"a": map[string]interface{}{"b": map[string]interface{}{}}},
+	} {
+		if err := NewEncoderWithOptions(ioutil.Discard, eopts).Encode(v); err == nil {
+			logT(t, "Expecting error encoding: %v", v)
+			t.FailNow()
+		}
+	}
+	// MaxDepth counts the same levels (including interface values) on both paths
+	var nested interface{} = map[string]interface{}{"a": 1, "b": nil, "c": "x"}
+	for i := 0; i < 3; i++ {
+		nested = map[string]interface{}{"a": nested}
+	}
+	for maxDepth := 1; maxDepth < 12; maxDepth++ {
+		for _, v := range []interface{}{nested, "abc", nil, map[string]interface{}{"a": nil}} {
+			eopts := &EncoderOptions{MaxDepth: maxDepth}
+			err1 := NewEncoderWithOptions(ioutil.Discard, eopts).Encode(v)
+			err2 := NewEncoderWithOptions(ioutil.Discard, eopts).EncodeValue(reflect.ValueOf(v))
+			if (err1 == nil) != (err2 == nil) {
+				logT(t, "MaxDepth: %d: fast path error: %v, reflect path error: %v", maxDepth, err1, err2)
+				t.FailNow()
+			}
+		}
+	}
+}
+
+func TestDecodeFastPathMatchesReflect(t *testing.T) {
+	var inputs [][]byte
+	for _, v := range []interface{}{
+		nil, true, false, 0, -1, 127, -32, 200, -200, 70000, int64(1 << 40), uint64(math.MaxUint64), 
+		float32(2.5), 3.75, "", "abc", []byte{1, 2, 3}, []int{1}, map[string]int{"a": 1},
+	} {
+		bs, err := Marshal(v)
+		checkErrT(t, err)
+		inputs = append(inputs, bs)
+	}
+	// integers not in the smallest format (for Strict), and a truncated value
+	inputs = append(inputs, []byte{0xd3, 0, 0, 0, 0, 0, 0, 0, 1}, []byte{0xa3, 'a'})
+	// pointers to the initial values to decode into
+	newTargets := func() []interface{} {
+		i, i64, s, b, f, bs := 9, int64(9), "init", true, 9.5, []byte("init")
+		return []interface{}{&i, &i64, &s, &b, &f, &bs}
+	}
+	for _, dopts := range []*DecoderOptions{
+		{}, {LenientBool: true}, {Strict: true}, {ReuseByteSlices: true}, {StrictNumericConversion: true},
+		{FloatToInt: true},
+	} {
+		for _, bs := range inputs {
+			targets1, targets2 := newTargets(), newTargets()
+			for j := range targets1 {
+				err1 := NewDecoderWithOptions(bytes.NewReader(bs), nil, dopts).Decode(targets1[j])
+				err2 := NewDecoderWithOptions(bytes.NewReader(bs), nil, dopts).DecodeValue(reflect.ValueOf(targets2[j]))
+				checkEqualT(t, fmt.Sprint(err1), fmt.Sprint(err2))
+				checkEqualT(t, targets1[j], targets2[j])
+			}
+		}
+	}
+	// a value after a PeekType, and decoding continues after a fallback
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	for _, v := range []interface{}{1, 2.5, "s"} {
+		checkErrT(t, enc.Encode(v))
+	}
+	dec := NewDecoderWithOptions(&buf, nil, &DecoderOptions{FloatToInt: true})
+	var i int
+	var s string
+	_, err := dec.PeekType()
+	checkErrT(t, err)
+	checkErrT(t, dec.Decode(&i))
+	checkErrT(t, dec.Decode(&i))
+	checkErrT(t, dec.Decode(&s))
+	checkEqualT(t, i, 2)
+	checkEqualT(t, s, "s")
+}
+
+type testArrayV1 struct {
+	_struct bool  `msgpack:",toarray=ID,Name,Tags"`
+	Name  string
+	ID    int64   `msgpack:"id,string"`
+	Tags  []string
+	Extra int
+}
+
+// the same layout, with the fields declared in another order
+type testArrayV2 struct {
+	_struct bool  `msgpack:",toarray=ID,Name,Tags"`
+	Tags  []string
+	Extra int
+	ID    int64   `msgpack:"id,string"`
+	Name  string
+}
+
+type testArrayPlain struct {
+	_struct bool `msgpack:",toarray"`
+	B int
+	A string
+}
+
+func TestEncodeStructToArray(t *testing.T) {
+	bs, err := Marshal(testArrayV1{Name: "n", ID: 7, Tags: []string{"t"}, Extra: 9})
+	checkErrT(t, err)
+	// positions follow the listed order. Extra is not listed, so it is not encoded.
+	checkEqualT(t, bs, []byte{0x93, 0xa1, '7', 0xa1, 'n', 0x91, 0xa1, 't'})
+	bs2, err := Marshal(testArrayV2{Name: "n", ID: 7, Tags: []string{"t"}, Extra: 9})
+	checkErrT(t, err)
+	checkEqualT(t, bs2, bs)
+	var v2 testArrayV2
+	checkErrT(t, Unmarshal(bs, &v2, nil))
+	checkEqualT(t, v2, testArrayV2{Name: "n", ID: 7, Tags: []string{"t"}})
+
+	// plain toarray uses the declaration order
+	bs, err = Marshal(testArrayPlain{B: 1, A: "a"})
+	checkErrT(t, err)
+	checkEqualT(t, bs, []byte{0x92, 0x01, 0xa1, 'a'})
+	// a shorter array leaves the other fields, and extra elements are skipped
+	vp := testArrayPlain{B: 5, A: "x"}
+	checkErrT(t, Unmarshal([]byte{0x91, 0x02}, &vp, nil))
+	checkEqualT(t, vp, testArrayPlain{B: 2, A: "x"})
+	checkErrT(t, Unmarshal([]byte{0x93, 0x03, 0xa1, 'b', 0xc3}, &vp, nil))
+	checkEqualT(t, vp, testArrayPlain{B: 3, A: "b"})
+	// a map still decodes by name
+	bs, err = Marshal(map[string]interface{}{"A": "m", "B": 4})
+	checkErrT(t, err)
+	checkErrT(t, Unmarshal(bs, &vp, nil))
+	checkEqualT(t, vp, testArrayPlain{B: 4, A: "m"})
+
+	type bad struct {
+		_struct bool `msgpack:",toarray=A,Nope"`
+		A int
+	}
+	if _, err = Marshal(bad{}); err == nil || !strings.HasPrefix(err.Error(), msgTagEnc) {
+		logT(t, "Expecting error for unknown field in toarray. Got: %v", err)
+		t.FailNow()
+	}
+
+	// a required field past the end of a shorter array is missing
+	type req struct {
+		_struct bool `msgpack:",toarray"`
+		A int
+		B int `msgpack:",required"`
+	}
+	var vr req
+	checkErrT(t, Unmarshal([]byte{0x92, 0x01, 0x02}, &vr, nil))
+	checkEqualT(t, vr, req{A: 1, B: 2})
+	err = Unmarshal([]byte{0x91, 0x01}, &vr, nil)
+	if merr, ok := err.(*MissingFieldsError); !ok || !reflect.DeepEqual(merr.Fields, []string{"B"}) {
+		logT(t, "Expecting MissingFieldsError for B. Got: %v", err)
+		t.FailNow()
+	}
+
+	// a toarray struct cannot be registered, as the array has no room for its name
+	for _, v := range []interface{}{testArrayPlain{}, &testArrayPlain{}} {
+		func() {
+			defer func() {
+				if x := recover(); x == nil {
+					logT(t, "Expecting panic registering toarray type: %T", v)
+					t.FailNow()
+				}
+			}()
+			NewTypeRegistry().Register(v)
+		}()
+	}
+}
+
+func TestDecodeByteArrayLen(t *testing.T) {
+	var hash [32]byte
+	for j := range hash {
+		hash[j] = byte(j)
+	}
+	bs, err := Marshal(hash)
+	checkErrT(t, err)
+	var h [32]byte
+	checkErrT(t, Unmarshal(bs, &h, nil))
+	checkEqualT(t, h, hash)
+
+	for _, n := range []int{0, 31, 33} {
+		bs, err = Marshal(make([]byte, n))
+		checkErrT(t, err)
+		if err = Unmarshal(bs, &h, nil); err == nil {
+			logT(t, "Expecting error decoding %d bytes into [32]byte", n)
+			t.FailNow()
+		}
+	}
+	// lenient: shorter is accepted (and the rest is zeroed), longer is not
+	dopts := &DecoderOptions{LenientByteArrayLen: true}
+	bs, err = Marshal([]byte{9, 9})
+	checkErrT(t, err)
+	h = hash
+	checkErrT(t, NewDecoderWithOptions(bytes.NewReader(bs), nil, dopts).Decode(&h))
+	checkEqualT(t, h, [32]byte{9, 9})
+	bs, err = Marshal(make([]byte, 33))
+	checkErrT(t, err)
+	if err = NewDecoderWithOptions(bytes.NewReader(bs), nil, dopts).Decode(&h); err == nil {
+		logT(t, "Expecting error decoding 33 bytes into [32]byte")
+		t.FailNow()
+	}
+}
+
+func TestEncodeDroppedFieldsCallback(t *testing.T) {
+	type inner struct {
+		X int `msgpack:",omitempty"`
+	}
+	type T struct {
+		A  string `msgpack:"a,omitempty"`
+		B  int    `msgpack:",omitempty"`
+		C  []int  `msgpack:",omitempty"`
+		D  int
+		In inner
+	}
+	var dropped []string
+	eopts := &EncoderOptions{DroppedFieldsCallback: func(rt reflect.Type, name string) {
+		dropped = append(dropped, rt.Name()+"."+name)
+	}}
+	var buf bytes.Buffer
+	checkErrT(t, NewEncoderWithOptions(&buf, eopts).Encode(T{B: 1}))
+	// D is empty, but not omitempty, so it is not dropped
+	checkEqualT(t, dropped, []string{"T.A", "T.C", "inner.X"})
+	var v map[string]interface{}
+	checkErrT(t, Unmarshal(buf.Bytes(), &v, testDecOpts(mapStringIntfTyp, nil, false, false, true)))
+	checkEqualT(t, len(v), 3)
+}
+
+func TestDecodeIntAsUnixTime(t *testing.T) {
+	type T struct {
+		At time.Time
+	}
+	secs := int64(1700000000)
+	bs, err := Marshal(map[string]interface{}{"At": secs})
+	checkErrT(t, err)
+	var v T
+	if err = Unmarshal(bs, &v, nil); err == nil {
+		logT(t, "Expecting error decoding an int into a time.Time without IntAsUnixTime")
+		t.FailNow()
+	}
+	dopts := &DecoderOptions{IntAsUnixTime: true}
+	checkErrT(t, NewDecoderWithOptions(bytes.NewReader(bs), nil, dopts).Decode(&v))
+	checkEqualT(t, v.At, time.Unix(secs, 0).UTC())
+
+	// other units, and before the epoch
+	dopts.UnixTimeUnit = time.Millisecond
+	for _, ms := range []int64{secs*1000 + 123, -1500, 0} {
+		bs, err = Marshal(ms)
+		checkErrT(t, err)
+		var tm time.Time
+		checkErrT(t, NewDecoderWithOptions(bytes.NewReader(bs), nil, dopts).Decode(&tm))
+		checkEqualT(t, tm, time.Unix(0, ms*int64(time.Millisecond)).UTC())
+	}
+	dopts.UnixTimeUnit = time.Minute
+	bs, err = Marshal(int64(3))
+	checkErrT(t, err)
+	var tm time.Time
+	checkErrT(t, NewDecoderWithOptions(bytes.NewReader(bs), nil, dopts).Decode(&tm))
+	checkEqualT(t, tm, time.Unix(180, 0).UTC())
+
+	// units which neither divide a second nor are a multiple of one are not truncated
+	for _, x := range []struct {
+		unit time.Duration
+		n    int64
+		want time.Time
+	}{
+		{300 * time.Millisecond, 5, time.Unix(1, 5e8)},
+		{1500 * time.Millisecond, -3, time.Unix(-5, 5e8)},
+		{7 * time.Millisecond, 1e12, time.Unix(7e9, 0)},
+		{time.Second + 1, 3e9, time.Unix(3e9+3, 0)},
+	} {
+		dopts.UnixTimeUnit = x.unit
+		bs, err = Marshal(x.n)
+		checkErrT(t, err)
+		checkErrT(t, NewDecoderWithOptions(bytes.NewReader(bs), nil, dopts).Decode(&tm))
+		checkEqualT(t, tm, x.want.UTC())
+	}
+}
+
+func TestDecodeExtDescriptorFailsFast(t *testing.T) {
+	// 0xc7 (ext8) and 0xd4 (fixext1) are from the newer spec: they are unrecognized here, 
+	// and decoding stops at the first one, without reading the rest of the array.
+	for _, ext := range [][]byte{{0xd4, 1, 0xff}, {0xc7, 1, 1, 0xff}} {
+		bs := []byte{0x9a, 1, 2}
+		bs = append(bs, ext...)
+		for j := 0; j < 7; j++ {
+			bs = append(bs, ext...)
+		}
+		for _, v := range []interface{}{new(interface{}), new([]int)} {
+			r := bytes.NewReader(bs)
+			err := NewDecoder(r, nil).Decode(v)
+			if err == nil || !strings.Contains(err.Error(), msgBadDesc) {
+				logT(t, "Expecting unrecognized descriptor error. Got: %v", err)
+				t.FailNow()
+			}
+			checkEqualT(t, r.Len(), len(bs)-4)
+		}
+	}
+}
+
+func TestDecodeFixintRange(t *testing.T) {
+	// positive fixint: 0x00-0x7f is 0..127, negative fixint: 0xe0-0xff is -32..-1
+	for j := 0; j < 256; j++ {
+		if j >= 0x80 && j < 0xe0 {
+			continue
+		}
+		bs := []byte{byte(j)}
+		var i8 int8
+		var u8 uint8
+		checkErrT(t, Unmarshal(bs, &i8, nil))
+		err := Unmarshal(bs, &u8, nil)
+		if j <= 0x7f {
+			checkEqualT(t, i8, int8(j))
+			checkErrT(t, err)
+			checkEqualT(t, u8, uint8(j))
+			continue
+		}
+		checkEqualT(t, i8, int8(j-256))
+		if err == nil {
+			logT(t, "Expecting error decoding %d into uint8", i8)
+			t.FailNow()
+		}
+		u8 = 0
+		checkErrT(t, NewDecoderWithOptions(bytes.NewReader(bs), nil, 
+			&DecoderOptions{LenientUnsigned: true}).Decode(&u8))
+		checkEqualT(t, u8, uint8(j))
+	}
+	// lenient: a negative value must fit the signed type of the target's size
+	dopts := &DecoderOptions{LenientUnsigned: true}
+	for _, v := range []interface{}{int64(-128), int64(-129), int64(-1), int64(-1 << 40)} {
+		bs, err := Marshal(v)
+		checkErrT(t, err)
+		var u8 uint8
+		err = NewDecoderWithOptions(bytes.NewReader(bs), nil, dopts).Decode(&u8)
+		if n := v.(int64); n >= -128 {
+			checkErrT(t, err)
+			checkEqualT(t, u8, uint8(n))
+		} else if err == nil {
+			logT(t, "Expecting overflow error decoding %d into uint8", n)
+			t.FailNow()
+		}
+		var u64 uint64
+		checkErrT(t, NewDecoderWithOptions(bytes.NewReader(bs), nil, dopts).Decode(&u64))
+		checkEqualT(t, u64, uint64(v.(int64)))
+	}
+}
+
+type testFlags uint8
+
+type testLevel int16
+
+func TestNamedIntEnum(t *testing.T) {
+	// named integer types encode like their underlying kind, in the smallest format for the value
+	for _, x := range []struct {
+		v  interface{}
+		bs []byte
+	}{
+		{testFlags(5), []byte{0x05}},
+		{testFlags(200), []byte{0xcc, 0xc8}},
+		{testLevel(-3), []byte{0xfd}},
+		{testLevel(-200), []byte{0xd1, 0xff, 0x38}},
+		{[]testFlags{1, 255}, []byte{0x92, 0x01, 0xcc, 0xff}},
+	} {
+		bs, err := Marshal(x.v)
+		checkErrT(t, err)
+		checkEqualT(t, bs, x.bs)
+	}
+	var f testFlags
+	checkErrT(t, Unmarshal([]byte{0xcc, 0xc8}, &f, nil))
+	checkEqualT(t, f, testFlags(200))
+
+	// decoding a value which overflows the underlying kind errors, with or without StrictNumericConversion
+	bs, err := Marshal(300)
+	checkErrT(t, err)
+	for _, dopts := range []*DecoderOptions{nil, {StrictNumericConversion: true}} {
+		f = 7
+		err = NewDecoderWithOptions(bytes.NewReader(bs), nil, dopts).Decode(&f)
+		if err == nil || !strings.Contains(err.Error(), "Overflow") {
+			logT(t, "Expecting overflow error decoding 300 into testFlags. Got: %v", err)
+			t.FailNow()
+		}
+		var lv testLevel
+		bs2, err := Marshal(int64(1 << 20))
+		checkErrT(t, err)
+		if err = NewDecoderWithOptions(bytes.NewReader(bs2), nil, dopts).Decode(&lv); err == nil {
+			logT(t, "Expecting overflow error decoding %d into testLevel", 1 << 20)
+			t.FailNow()
+		}
+	}
+}
+
+func TestDecodeIntArrayAsBytes(t *testing.T) {
+	type T struct {
+		Data []byte
+	}
+	bs, err := Marshal(map[string]interface{}{"Data": []int{0, 1, 127, 128, 255}})
+	checkErrT(t, err)
+	var v T
+	if err = Unmarshal(bs, &v, nil); err == nil {
+		logT(t, "Expecting error decoding an array into a []byte without IntArrayAsBytes")
+		t.FailNow()
+	}
+	dopts := &DecoderOptions{IntArrayAsBytes: true}
+	checkErrT(t, NewDecoderWithOptions(bytes.NewReader(bs), nil, dopts).Decode(&v))
+	checkEqualT(t, v.Data, []byte{0, 1, 127, 128, 255})
+
+	// raw bytes are still accepted
+	bs, err = Marshal(T{[]byte("abc")})
+	checkErrT(t, err)
+	checkErrT(t, NewDecoderWithOptions(bytes.NewReader(bs), nil, dopts).Decode(&v))
+	checkEqualT(t, v.Data, []byte("abc"))
+
+	for _, elems := range [][]int{{1, 256}, {-1}} {
+		bs, err = Marshal(map[string]interface{}{"Data": elems})
+		checkErrT(t, err)
+		if err = NewDecoderWithOptions(bytes.NewReader(bs), nil, dopts).Decode(&v); err == nil {
+			logT(t, "Expecting error decoding %v into a []byte", elems)
+			t.FailNow()
+		}
+	}
+}
+
+func TestEncodeMapStream(t *testing.T) {
+	for _, eopts := range []*EncoderOptions{nil, {MapAsPairArray: true}} {
+		var buf bytes.Buffer
+		e := NewEncoderWithOptions(&buf, eopts)
+		checkErrT(t, e.EncodeMapStart(1000))
+		m := make(map[string]int, 1000)
+		for j := 0; j < 1000; j++ {
+			k := strconv.Itoa(j)
+			m[k] = j
+			if j%2 == 0 {
+				checkErrT(t, e.EncodeMapKeyValue(k, j))
+			} else {
+				checkErrT(t, e.Encode(k))
+				checkErrT(t, e.Encode(j))
+			}
+		}
+		checkErrT(t, e.EncodeEnd())
+		// a value after the map
+		checkErrT(t, e.Encode("after"))
+		d := NewDecoder(&buf, nil)
+		var m2 map[string]int
+		checkErrT(t, d.Decode(&m2))
+		checkEqualT(t, m2, m)
+		var s string
+		checkErrT(t, d.Decode(&s))
+		checkEqualT(t, s, "after")
+	}
+
+	// more or fewer entries than declared
+	e := NewEncoder(ioutil.Discard)
+	checkErrT(t, e.EncodeMapStart(1))
+	if err := e.EncodeEnd(); err == nil {
+		logT(t, "Expecting error ending a map with a missing entry")
+		t.FailNow()
+	}
+	checkErrT(t, e.Encode("a"))
+	if err := e.EncodeMapKeyValue("b", 2); err == nil {
+		logT(t, "Expecting error writing an entry after a key")
+		t.FailNow()
+	}
+	checkErrT(t, e.Encode(1))
+	if err := e.Encode("b"); err == nil {
+		logT(t, "Expecting error encoding into a full map")
+		t.FailNow()
+	}
+	checkErrT(t, e.EncodeEnd())
+	if err := e.EncodeEnd(); err == nil {
+		logT(t, "Expecting error ending a map which was not started")
+		t.FailNow()
+	}
+}
+
+func TestEncodeArrayStream(t *testing.T) {
+	var buf bytes.Buffer
+	e := NewEncoder(&buf)
+	checkErrT(t, e.EncodeArrayStart(100000))
+	for j := 0; j < 100000; j++ {
+		checkErrT(t, e.Encode(j))
+	}
+	checkErrT(t, e.EncodeEnd())
+	ch := make(chan interface{}, 16)
+	var err error
+	go func() {
+		err = NewDecoder(&buf, nil).DecodeArrayToChan(ch)
+		close(ch)
+	}()
+	n := 0
+	for v := range ch {
+		if reflect.ValueOf(v).Int() != int64(n) {
+			logT(t, "Expecting element %d. Got: %v", n, v)
+			t.FailNow()
+		}
+		n++
+	}
+	checkErrT(t, err)
+	checkEqualT(t, n, 100000)
+
+	// nested: an array of maps and arrays
+	buf.Reset()
+	e = NewEncoder(&buf)
+	checkErrT(t, e.EncodeArrayStart(3))
+	checkErrT(t, e.EncodeMapStart(1))
+	checkErrT(t, e.EncodeMapKeyValue("a", 1))
+	checkErrT(t, e.EncodeEnd())
+	checkErrT(t, e.EncodeArrayStart(0))
+	checkErrT(t, e.EncodeEnd())
+	checkErrT(t, e.Encode("x"))
+	checkErrT(t, e.EncodeEnd())
+	var v []interface{}
+	checkErrT(t, Unmarshal(buf.Bytes(), &v, testDecOpts(mapStringIntfTyp, nil, false, true, true)))
+	checkEqualT(t, v, []interface{}{map[string]interface{}{"a": int8(1)}, []interface{}{}, "x"})
+
+	// more or fewer elements than declared
+	e = NewEncoder(ioutil.Discard)
+	checkErrT(t, e.EncodeArrayStart(2))
+	checkErrT(t, e.Encode(1))
+	if err = e.EncodeEnd(); err == nil {
+		logT(t, "Expecting error ending an array with a missing element")
+		t.FailNow()
+	}
+	checkErrT(t, e.Encode(2))
+	if err = e.Encode(3); err == nil {
+		logT(t, "Expecting error encoding into a full array")
+		t.FailNow()
+	}
+	if err = e.EncodeMapKeyValue("a", 1); err == nil {
+		logT(t, "Expecting error writing a map entry into an array")
+		t.FailNow()
+	}
+	checkErrT(t, e.EncodeEnd())
+}
+
+func TestEncodeArrayStreamUnknownLen(t *testing.T) {
+	// the header size depends on the count: fixarray, array 16 and array 32
+	for _, n := range []int{0, 3, 15, 16, 1000, 70000} {
+		var buf bytes.Buffer
+		e := NewEncoder(&buf)
+		checkErrT(t, e.EncodeArrayStart(-1))
+		for j := 0; j < n; j++ {
+			checkErrT(t, e.Encode(j%100))
+		}
+		checkErrT(t, e.EncodeEnd())
+		checkErrT(t, e.Encode("after"))
+		s := make([]int, n)
+		for j := range s {
+			s[j] = j % 100
+		}
+		bs, err := Marshal(s)
+		checkErrT(t, err)
+		checkEqualT(t, buf.Bytes()[:len(bs)], bs)
+		d := NewDecoder(&buf, nil)
+		var s2 []int
+		checkErrT(t, d.Decode(&s2))
+		checkEqualT(t, s2, s)
+		var after string
+		checkErrT(t, d.Decode(&after))
+		checkEqualT(t, after, "after")
+	}
+
+	// nested in a map, and holding an array of unknown length
+	var buf bytes.Buffer
+	e := NewEncoder(&buf)
+	checkErrT(t, e.EncodeMapStart(1))
+	checkErrT(t, e.Encode("a"))
+	checkErrT(t, e.EncodeArrayStart(-1))
+	checkErrT(t, e.Encode(1))
+	checkErrT(t, e.EncodeArrayStart(-1))
+	checkErrT(t, e.Encode(2))
+	checkErrT(t, e.EncodeEnd())
+	checkErrT(t, e.EncodeEnd())
+	checkErrT(t, e.EncodeEnd())
+	var v map[string]interface{}
+	checkErrT(t, Unmarshal(buf.Bytes(), &v, testDecOpts(mapStringIntfTyp, nil, false, true, true)))
+	checkEqualT(t, v, map[string]interface{}{"a": []interface{}{int8(1), []interface{}{int8(2)}}})
+}
+
+func TestEncodeStreamRegisteredEncoder(t *testing.T) {
+	// a registered encoder calls Encode: only the outermost call counts against the stream
+	eopts := &EncoderOptions{}
+	eopts.RegisterEncoder(reflect.TypeOf(testMoney(0)), func(e *Encoder, rv reflect.Value) error {
+		return e.Encode(int64(math.Floor(rv.Float() * 100 + 0.5)))
+	})
+	var buf bytes.Buffer
+	e := NewEncoderWithOptions(&buf, eopts)
+	checkErrT(t, e.EncodeMapStart(2))
+	checkErrT(t, e.Encode("k"))
+	checkErrT(t, e.Encode(testMoney(1.5)))
+	checkErrT(t, e.EncodeMapKeyValue("l", []testMoney{2, 3}))
+	checkErrT(t, e.EncodeEnd())
+	checkErrT(t, e.EncodeArrayStart(-1))
+	checkErrT(t, e.Encode(testMoney(0.25)))
+	checkErrT(t, e.EncodeEnd())
+	d := NewDecoder(&buf, nil)
+	var m map[string]interface{}
+	checkErrT(t, d.Decode(&m))
+	checkEqualT(t, m, map[string]interface{}{"k": int16(150), "l": []interface{}{int16(200), int16(300)}})
+	var a []int
+	checkErrT(t, d.Decode(&a))
+	checkEqualT(t, a, []int{25})
+}
+
+type testPercent struct {
+	Name string
+	Pct  int
+}
+
+func (p *testPercent) Validate() error {
+	if p.Pct < 0 || p.Pct > 100 {
+		return fmt.Errorf("Pct out of range: %d", p.Pct)
+	}
+	return nil
+}
+
+func TestDecodeValidator(t *testing.T) {
+	bs, err := Marshal(testPercent{"a", 50})
+	checkErrT(t, err)
+	var v testPercent
+	checkErrT(t, Unmarshal(bs, &v, nil))
+	checkEqualT(t, v, testPercent{"a", 50})
+
+	bs, err = Marshal([]testPercent{{"a", 50}, {"b", 101}})
+	checkErrT(t, err)
+	var vs []testPercent
+	err = Unmarshal(bs, &vs, nil)
+	verr, ok := err.(*ValidationError)
+	if !ok {
+		logT(t, "Expecting *ValidationError. Got: %v", err)
+		t.FailNow()
+	}
+	checkEqualT(t, verr.Type, reflect.TypeOf(v))
+	checkEqualT(t, verr.Err.Error(), "Pct out of range: 101")
+
+	// also when decoding into a struct field, or through a pointer
+	type T struct {
+		P *testPercent
+	}
+	bs, err = Marshal(map[string]interface{}{"P": map[string]interface{}{"Pct": -1}})
+	checkErrT(t, err)
+	var tv T
+	if _, ok = Unmarshal(bs, &tv, nil).(*ValidationError); !ok {
+		logT(t, "Expecting *ValidationError decoding into a struct field")
+		t.FailNow()
+	}
+}
+
+func TestStructFieldDefault(t *testing.T) {
+	type tConfig struct {
+		Name    string  `msgpack:"name,default=anon"`
+		Port    uint16  `msgpack:"port,default=8080"`
+		Retries int     `msgpack:",omitempty,default=3"`
+		Ratio   float64 `msgpack:",default=0.5"`
+		Verbose bool    `msgpack:",default=true"`
+		Other   int
+	}
+	// empty fields encode as they are (unless omitted), and decode back as they are
+	bs, err := Marshal(tConfig{Port: 9000})
+	checkErrT(t, err)
+	var m map[string]interface{}
+	checkErrT(t, Unmarshal(bs, &m, testDecOpts(mapStringIntfTyp, nil, false, false, true)))
+	checkEqualT(t, m, map[string]interface{}{
+		"name": "", "port": uint16(9000), "Ratio": 0.0, "Verbose": false, "Other": int8(0)})
+	var v tConfig
+	checkErrT(t, Unmarshal(bs, &v, nil))
+	checkEqualT(t, v, tConfig{"", 9000, 3, 0, false, 0})
+
+	// absent keys decode into the default
+	bs, err = Marshal(map[string]interface{}{"name": "x", "Other": 1})
+	checkErrT(t, err)
+	v = tConfig{}
+	checkErrT(t, Unmarshal(bs, &v, nil))
+	checkEqualT(t, v, tConfig{"x", 8080, 3, 0.5, true, 1})
+	v = tConfig{}
+	checkErrT(t, Unmarshal([]byte{0x80}, &v, nil))
+	checkEqualT(t, v, tConfig{"anon", 8080, 3, 0.5, true, 0})
+
+	// with EncodeDefaults, a zero-valued field encodes as its declared default
+	eopts := &EncoderOptions{EncodeDefaults: true}
+	var buf bytes.Buffer
+	checkErrT(t, NewEncoderWithOptions(&buf, eopts).Encode(tConfig{Port: 9000}))
+	m = nil
+	checkErrT(t, Unmarshal(buf.Bytes(), &m, testDecOpts(mapStringIntfTyp, nil, false, false, true)))
+	checkEqualT(t, m, map[string]interface{}{
+		"name": "anon", "port": uint16(9000), "Retries": int8(3), "Ratio": 0.5, "Verbose": true, "Other": int8(0)})
+
+	// with toarray, the fields past the end of a shorter array are absent
+	type tArr struct {
+		_struct bool   `msgpack:",toarray"`
+		Name    string `msgpack:",default=anon"`
+		Port    int    `msgpack:",default=8080"`
+		Verbose bool   `msgpack:",default=true"`
+	}
+	bs, err = Marshal([]interface{}{"x"})
+	checkErrT(t, err)
+	var va tArr
+	checkErrT(t, Unmarshal(bs, &va, nil))
+	checkEqualT(t, va, tArr{Name: "x", Port: 8080, Verbose: true})
+	bs, err = Marshal(tArr{Name: "y"})
+	checkErrT(t, err)
+	va = tArr{}
+	checkErrT(t, Unmarshal(bs, &va, nil))
+	checkEqualT(t, va, tArr{Name: "y"})
+	buf.Reset()
+	checkErrT(t, NewEncoderWithOptions(&buf, eopts).Encode(tArr{Name: "y"}))
+	checkEqualT(t, buf.Bytes(), []byte{0x93, 0xa1, 'y', 0xd1, 0x1f, 0x90, 0xc3})
+
+	// a default which does not parse as the type of the field
+	type tBad struct {
+		N int8 `msgpack:",default=200"`
+	}
+	if _, err = Marshal(tBad{}); err == nil {
+		logT(t, "Expecting error for an invalid default")
+		t.FailNow()
+	}
+}
+
+func TestDecodeAndCapture(t *testing.T) {
+	type T struct {
+		A string
+		B []int
+		C map[string]float64
+	}
+	v0 := T{"a", []int{1, 2, 300}, map[string]float64{"x": 1.5}}
+	var buf bytes.Buffer
+	e := NewEncoder(&buf)
+	checkErrT(t, e.Encode(v0))
+	checkErrT(t, e.Encode("next"))
+	d := NewDecoder(&buf, nil)
+	// after a PeekType, the peeked byte is captured too
+	_, err := d.PeekType()
+	checkErrT(t, err)
+	var v T
+	bs, err := d.DecodeAndCapture(&v)
+	checkErrT(t, err)
+	checkEqualT(t, v, v0)
+	var v2 T
+	checkErrT(t, Unmarshal(bs, &v2, nil))
+	checkEqualT(t, v2, v0)
+	// the next value is not captured, and can be decoded as usual
+	var s string
+	bs, err = d.DecodeAndCapture(&s)
+	checkErrT(t, err)
+	checkEqualT(t, s, "next")
+	checkEqualT(t, bs, []byte("\xa4next"))
+}
+
+func TestRawMessage(t *testing.T) {
+	type T struct {
+		A   int
+		Raw RawMessage
+	}
+	inner := []interface{}{"x", map[string]interface{}{"y": 1.5}}
+	innerBs, err := Marshal(inner)
+	checkErrT(t, err)
+	bs, err := Marshal(map[string]interface{}{"A": 1, "Raw": inner})
+	checkErrT(t, err)
+	var v T
+	checkErrT(t, Unmarshal(bs, &v, nil))
+	checkEqualT(t, v, T{1, RawMessage(innerBs)})
+	// encoded as is, and nil if empty
+	bs2, err := Marshal(v)
+	checkErrT(t, err)
+	var v2 T
+	checkErrT(t, Unmarshal(bs2, &v2, nil))
+	checkEqualT(t, v2, v)
+	bs, err = Marshal(RawMessage(nil))
+	checkErrT(t, err)
+	checkEqualT(t, bs, []byte{0xc0})
+}
+
+func TestStructExtras(t *testing.T) {
+	type T struct {
+		Name   string
+		Extras []RawField `msgpack:",extras"`
+		N      int
+	}
+	// the keys in the stream, in order: known keys first, so re-encoding gives the same bytes
+	var buf bytes.Buffer
+	e := NewEncoder(&buf)
+	checkErrT(t, e.EncodeMapStart(5))
+	checkErrT(t, e.EncodeMapKeyValue("Name", "a"))
+	checkErrT(t, e.EncodeMapKeyValue("N", 2))
+	checkErrT(t, e.EncodeMapKeyValue("zeta", []int{1, 2}))
+	checkErrT(t, e.EncodeMapKeyValue("alpha", "b"))
+	checkErrT(t, e.EncodeMapKeyValue("mid", nil))
+	checkErrT(t, e.EncodeEnd())
+	var v T
+	checkErrT(t, Unmarshal(buf.Bytes(), &v, nil))
+	checkEqualT(t, v.Name, "a")
+	checkEqualT(t, v.N, 2)
+	var keys []string
+	for _, x := range v.Extras {
+		keys = append(keys, x.Key)
+	}
+	checkEqualT(t, keys, []string{"zeta", "alpha", "mid"})
+	var zeta []int
+	checkErrT(t, Unmarshal(v.Extras[0].Raw, &zeta, nil))
+	checkEqualT(t, zeta, []int{1, 2})
+	checkEqualT(t, []byte(v.Extras[2].Raw), []byte{0xc0})
+
+	bs, err := Marshal(v)
+	checkErrT(t, err)
+	checkEqualT(t, bs, buf.Bytes())
+	// decoding again replaces the extras
+	checkErrT(t, Unmarshal(bs, &v, nil))
+	checkEqualT(t, len(v.Extras), 3)
+
+	// the extras field must be a []RawField
+	type tBad struct {
+		Extras map[string]interface{} `msgpack:",extras"`
+	}
+	if _, err = Marshal(tBad{}); err == nil {
+		logT(t, "Expecting error for an extras field which is not a []RawField")
+		t.FailNow()
+	}
+}
+
+func TestStructSelf(t *testing.T) {
+	type TInner struct {
+		N   int
+		Raw RawMessage `msgpack:",self"`
+	}
+	type T struct {
+		Kind  string
+		Inner TInner
+		Raw   RawMessage `msgpack:",self"`
+	}
+	type tIn struct {
+		Kind  string
+		Inner map[string]interface{}
+		Extra []interface{}
+	}
+	in := tIn{"x", map[string]interface{}{"N": 3, "More": "y"}, []interface{}{1, "z", nil}}
+	bs, err := Marshal(in)
+	checkErrT(t, err)
+	var v T
+	checkErrT(t, Unmarshal(bs, &v, nil))
+	checkEqualT(t, v.Kind, "x")
+	checkEqualT(t, v.Inner.N, 3)
+	checkEqualT(t, []byte(v.Raw), bs)
+	innerBs, err := Marshal(in.Inner)
+	checkErrT(t, err)
+	var inner map[string]interface{}
+	checkErrT(t, Unmarshal(v.Inner.Raw, &inner, nil))
+	checkEqualT(t, len(v.Inner.Raw), len(innerBs))
+	checkEqualT(t, inner["More"], "y")
+
+	// the self field is not encoded
+	bs2, err := Marshal(TInner{N: 3, Raw: RawMessage{0xc0}})
+	checkErrT(t, err)
+	var m map[string]interface{}
+	checkErrT(t, Unmarshal(bs2, &m, nil))
+	checkEqualT(t, len(m), 1)
+
+	// a peeked descriptor byte is captured too, as is a struct decoded from a stream
+	var buf bytes.Buffer
+	buf.Write(bs)
+	buf.Write(bs2)
+	dec := NewDecoder(&buf, nil)
+	if _, err = dec.PeekType(); err != nil {
+		logT(t, "Error peeking: %v", err)
+		t.FailNow()
+	}
+	var v2 T
+	var i2 TInner
+	checkErrT(t, dec.Decode(&v2))
+	checkErrT(t, dec.Decode(&i2))
+	checkEqualT(t, []byte(v2.Raw), bs)
+	checkEqualT(t, []byte(i2.Raw), bs2)
+
+	// the self field must be a RawMessage
+	type tBad struct {
+		Raw []byte `msgpack:",self"`
+	}
+	if _, err = Marshal(tBad{}); err == nil {
+		logT(t, "Expecting error for a self field which is not a RawMessage")
+		t.FailNow()
+	}
+}
+
+func TestEncodeMapEntryFilter(t *testing.T) {
+	m := map[string]interface{}{"a": 1, "b": nil, "c": "x", "d": nil, "_internal": 2}
+	keep := func(k, v reflect.Value) bool {
+		return !v.IsNil() && !strings.HasPrefix(k.String(), "_")
+	}
+	want := map[string]interface{}{"a": int8(1), "c": "x"}
+	for _, eopts := range []*EncoderOptions{
+		{MapEntryFilter: keep}, 
+		{MapEntryFilter: keep, Canonical: true}, 
+		{MapEntryFilter: keep, MapAsPairArray: true},
+	} {
+		type T struct {
+			M      map[string]interface{}
+			Nested map[string]map[string]interface{}
+		}
+		var buf bytes.Buffer
+		// nested maps are filtered too
+		checkErrT(t, NewEncoderWithOptions(&buf, eopts).Encode(T{m, map[string]map[string]interface{}{"m": m}}))
+		var v T
+		checkErrT(t, Unmarshal(buf.Bytes(), &v, testDecOpts(mapStringIntfTyp, nil, false, false, true)))
+		checkEqualT(t, v, T{want, map[string]map[string]interface{}{"m": want}})
+	}
+	// the header length matches the entries written
+	bs, err := Size(map[int]int{1: 1, 2: 2, 3: 3}, &EncoderOptions{MapEntryFilter: func(k, v reflect.Value) bool {
+		return k.Int() == 2
+	}})
+	checkErrT(t, err)
+	checkEqualT(t, bs, 3)
+}
+
+func TestDecodeDuplicateFieldNames(t *testing.T) {
+	type TEmbed struct {
+		Y int `msgpack:"y"`
+	}
+	type T struct {
+		A int `msgpack:"x"`
+		B int `msgpack:"x"`
+		TEmbed
+		C int `msgpack:"y"`
+	}
+	checkEqualT(t, getStructFieldInfos(reflect.TypeOf(T{})).dupNames, []string{"x", "y"})
+	bs, err := Marshal(map[string]int{"x": 1, "y": 2})
+	checkErrT(t, err)
+	// the first field of a name is decoded into
+	var v T
+	checkErrT(t, Unmarshal(bs, &v, nil))
+	checkEqualT(t, v, T{A: 1, TEmbed: TEmbed{2}})
+	// only the first field of a name is encoded, unless StrictTags makes it an error
+	bs2, err := Marshal(T{A: 1, B: 3, TEmbed: TEmbed{2}, C: 4})
+	checkErrT(t, err)
+	var m map[string]int
+	checkErrT(t, Unmarshal(bs2, &m, nil))
+	checkEqualT(t, m, map[string]int{"x": 1, "y": 2})
+	checkEqualT(t, bs2[0], byte(0x82))
+	err = NewEncoderWithOptions(new(bytes.Buffer), &EncoderOptions{StrictTags: true}).Encode(v)
+	if err == nil || !strings.Contains(err.Error(), "several fields named: x, y") {
+		logT(t, "Expecting duplicate field names error on encode. Got: %v", err)
+		t.FailNow()
+	}
+
+	err = NewDecoderWithOptions(bytes.NewReader(bs), nil, &DecoderOptions{StrictTags: true}).Decode(&v)
+	if err == nil || !strings.Contains(err.Error(), "several fields named: x, y") {
+		logT(t, "Expecting duplicate field names error. Got: %v", err)
+		t.FailNow()
+	}
+	// structs without duplicates are not affected
+	var v2 testPercent
+	bs, err = Marshal(testPercent{"a", 1})
+	checkErrT(t, err)
+	checkErrT(t, NewDecoderWithOptions(bytes.NewReader(bs), nil, &DecoderOptions{StrictTags: true}).Decode(&v2))
+}
+
+type testEntry struct {
+	K string
+	V int
+}
+
+func (x testEntry) Key() interface{}   { return x.K }
+func (x testEntry) Value() interface{} { return x.V }
+
+func TestEncodeMapEntrySlice(t *testing.T) {
+	entries := []testEntry{{"b", 2}, {"a", 1}, {"c", 3}}
+	eopts := &EncoderOptions{MapEntrySliceAsMap: true}
+	var buf bytes.Buffer
+	checkErrT(t, NewEncoderWithOptions(&buf, eopts).Encode(entries))
+	var m map[string]int
+	checkErrT(t, Unmarshal(buf.Bytes(), &m, nil))
+	checkEqualT(t, m, map[string]int{"a": 1, "b": 2, "c": 3})
+	// in the order of the slice
+	checkEqualT(t, buf.Bytes()[:5], []byte{0x83, 0xa1, 'b', 0x02, 0xa1})
+	checkEqualT(t, buf.Bytes()[5], byte('a'))
+
+	// pointers, and a nil element
+	buf.Reset()
+	checkErrT(t, NewEncoderWithOptions(&buf, eopts).Encode([]*testEntry{{"x", 1}}))
+	m = nil
+	checkErrT(t, Unmarshal(buf.Bytes(), &m, nil))
+	checkEqualT(t, m, map[string]int{"x": 1})
+	if err := NewEncoderWithOptions(&buf, eopts).Encode([]*testEntry{nil}); err == nil {
+		logT(t, "Expecting error encoding a nil MapEntry")
+		t.FailNow()
+	}
+	// Canonical sorts the entries by encoded key; MapEntryFilter drops entries
+	buf.Reset()
+	copts := &EncoderOptions{MapEntrySliceAsMap: true, Canonical: true}
+	checkErrT(t, NewEncoderWithOptions(&buf, copts).Encode(entries))
+	checkEqualT(t, buf.Bytes(), []byte{0x83, 0xa1, 'a', 0x01, 0xa1, 'b', 0x02, 0xa1, 'c', 0x03})
+	buf.Reset()
+	copts.MapEntryFilter = func(k, v reflect.Value) bool { return k.Elem().String() != "b" }
+	checkErrT(t, NewEncoderWithOptions(&buf, copts).Encode(entries))
+	checkEqualT(t, buf.Bytes(), []byte{0x82, 0xa1, 'a', 0x01, 0xa1, 'c', 0x03})
+	// duplicate keys are written as they are
+	buf.Reset()
+	checkErrT(t, NewEncoderWithOptions(&buf, eopts).Encode([]testEntry{{"a", 1}, {"a", 2}}))
+	checkEqualT(t, buf.Bytes(), []byte{0x82, 0xa1, 'a', 0x01, 0xa1, 'a', 0x02})
+	m = nil
+	checkErrT(t, Unmarshal(buf.Bytes(), &m, nil))
+	checkEqualT(t, m, map[string]int{"a": 2})
+
+	// without the option, the slice is an array
+	bs, err := Marshal(entries)
+	checkErrT(t, err)
+	checkEqualT(t, bs[0], byte(0x93))
+}
+
+func TestEncodeOmitNil(t *testing.T) {
+	type T struct {
+		P    *int        `msgpack:",omitnil"`
+		I    interface{} `msgpack:",omitnil"`
+		N    int         `msgpack:",omitnil"`
+		S    []int       `msgpack:",omitnil"`
+		E    *int        `msgpack:",omitempty"`
+		Zero *int        `msgpack:",omitnil"`
+	}
+	zero := 0
+	var dropped []string
+	eopts := &EncoderOptions{DroppedFieldsCallback: func(rt reflect.Type, name string) {
+		dropped = append(dropped, name)
+	}}
+	// omitnil only omits nil pointers and interfaces: not zero values, nor a pointer to zero
+	var buf bytes.Buffer
+	checkErrT(t, NewEncoderWithOptions(&buf, eopts).Encode(T{Zero: &zero}))
+	checkEqualT(t, dropped, []string{"P", "I", "E"})
+	var m map[string]interface{}
+	checkErrT(t, Unmarshal(buf.Bytes(), &m, testDecOpts(mapStringIntfTyp, nil, false, false, true)))
+	checkEqualT(t, m, map[string]interface{}{"N": int8(0), "S": nil, "Zero": int8(0)})
+
+	// zero (but not nil) values are omitted by omitempty, not by omitnil
+	type T2 struct {
+		A int   `msgpack:",omitempty"`
+		B int   `msgpack:",omitnil"`
+		C []int `msgpack:",omitempty"`
+		D []int `msgpack:",omitnil"`
+	}
+	bs, err := Marshal(T2{C: []int{}, D: []int{}})
+	checkErrT(t, err)
+	m = nil
+	checkErrT(t, Unmarshal(bs, &m, testDecOpts(mapStringIntfTyp, nil, false, false, true)))
+	checkEqualT(t, m, map[string]interface{}{"B": int8(0), "D": []interface{}{}})
+}
+
+func TestDecodeMaxTotalAlloc(t *testing.T) {
+	// many small maps, each within the per-container limits
+	v0 := make([]map[string]string, 1000)
+	for j := range v0 {
+		v0[j] = map[string]string{"k": "v"}
+	}
+	bs, err := Marshal(v0)
+	checkErrT(t, err)
+	dopts := &DecoderOptions{MaxMapLen: 10, MaxArrayLen: 1000, CollectStats: true}
+	d := NewDecoderWithOptions(bytes.NewReader(bs), nil, dopts)
+	var v []map[string]string
+	checkErrT(t, d.Decode(&v))
+	checkEqualT(t, v, v0)
+	total := d.Stats().Bytes
+
+	dopts = &DecoderOptions{MaxMapLen: 10, MaxArrayLen: 1000, MaxTotalAlloc: total}
+	v = nil
+	checkErrT(t, NewDecoderWithOptions(bytes.NewReader(bs), nil, dopts).Decode(&v))
+	dopts.MaxTotalAlloc = total / 2
+	v = nil
+	err = NewDecoderWithOptions(bytes.NewReader(bs), nil, dopts).Decode(&v)
+	if err == nil || !strings.Contains(err.Error(), "exceeds MaxTotalAlloc") {
+		logT(t, "Expecting MaxTotalAlloc error. Got: %v", err)
+		t.FailNow()
+	}
+	// the stream is not decoded to the end
+	checkEqualT(t, v[len(v)-1] == nil, true)
+
+	// the limit is per Decode
+	var buf bytes.Buffer
+	e := NewEncoder(&buf)
+	for j := 0; j < 3; j++ {
+		checkErrT(t, e.Encode(strings.Repeat("x", 100)))
+	}
+	d = NewDecoderWithOptions(&buf, nil, &DecoderOptions{MaxTotalAlloc: 150})
+	for j := 0; j < 3; j++ {
+		var s string
+		checkErrT(t, d.Decode(&s))
+	}
+	bs, err = Marshal([]string{strings.Repeat("x", 100), strings.Repeat("y", 100)})
+	checkErrT(t, err)
+	var ss []string
+	checkErrT(t, Unmarshal(bs, &ss, nil))
+	if err = NewDecoderWithOptions(bytes.NewReader(bs), nil, &DecoderOptions{MaxTotalAlloc: 150}).Decode(&ss); err == nil {
+		logT(t, "Expecting MaxTotalAlloc error decoding 200 bytes of strings")
+		t.FailNow()
+	}
+
+	// a huge length in the header of a container decoded into a nil interface{} 
+	// fails before the container is allocated
+	for _, bs := range [][]byte{
+		{0xdd, 0x7f, 0xff, 0xff, 0xff},
+		{0xdf, 0x7f, 0xff, 0xff, 0xff},
+		{0xdb, 0x7f, 0xff, 0xff, 0xff},
+	} {
+		var v interface{}
+		err = NewDecoderWithOptions(bytes.NewReader(bs), nil, &DecoderOptions{MaxTotalAlloc: 1 << 20}).Decode(&v)
+		if err == nil || !strings.Contains(err.Error(), "exceeds MaxTotalAlloc") {
+			logT(t, "Expecting MaxTotalAlloc error for header: % x. Got: %v", bs, err)
+			t.FailNow()
+		}
+	}
+}
+
+// comment out for now
+func TestRpcAll(t *testing.T) {
+	testRpc(t, true, true, true, true)
+}
+
+func TestRpc(t *testing.T) {
+	testRpc(t, true, true, false, true)
+}
+
+func TestCustomRpc(t *testing.T) {
+	testRpc(t, true, false, true, true)
+}
+
+func testRpc(t *testing.T, callClose, doBasic, doCustom, doExit bool) {
+	srv := rpc.NewServer()
+	srv.Register(testRpcInt)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	// log("listener: %v", ln.Addr())
+	checkErrT(t, err)
+	defer ln.Close()
+	
+	var opts DecoderContainerResolver
+	serverExitChan := make(chan bool, 1)
+	serverFn := func() {
+		for { 
+			conn1, err1 := ln.Accept()
+			if err1 != nil {
+				continue
+			}
+			bs := make([]byte, 1)
+			n1, err1 := conn1.Read(bs)
+			if n1 != 1 || err1 != nil {
+				conn1.Close()
+				continue
+			}
+			var sc rpc.ServerCodec
+			switch bs[0] {
+			case 'B': 
+				sc = NewRPCServerCodec(conn1, opts)
+			case 'C':
+				sc = NewCustomRPCServerCodec(conn1, opts)
+			case 'X':
+				serverExitChan <- true
+				conn1.Close()
+				return // exit serverFn goroutine
+			}
+			if sc == nil {
+				conn1.Close()
+				continue
+			}
+			srv.ServeCodec(sc)
+			// for {
+			// 	if err1 = srv.ServeRequest(sc); err1 != nil {
+			// 		break
+			// 	}
+			// }
+			// if callClose {
+			// 	sc.Close() 
+			// }
+		}
+	}
+	
+	clientFn := func(cc rpc.ClientCodec) {
+		cl := rpc.NewClientWithCodec(cc)
+		if callClose {
+			defer cl.Close() 
+		} 
+		var up, sq, mult int
+		// log("Calling client")
+		checkErrT(t, cl.Call("TestRpcInt.Update", 5, &up))
+		// log("Called TestRpcInt.Update")
+		checkEqualT(t, testRpcInt.i, 5)
+		checkEqualT(t, up, 5)
+		checkErrT(t, cl.Call("TestRpcInt.Square", 1, &sq))
+		checkEqualT(t, sq, 25)
+		checkErrT(t, cl.Call("TestRpcInt.Mult", 20, &mult))
+		checkEqualT(t, mult, 100)		
+	}
+	
+	connFn := func(req byte) (bs net.Conn) {
+		// log("calling f1")
+		bs, err2 := net.Dial(ln.Addr().Network(), ln.Addr().String())
+		// log("f1. bs: %v, err2: %v", bs, err2)
+		checkErrT(t, err2)
+		n1, err2 := bs.Write([]byte{req})
+		checkErrT(t, err2)
+		checkEqualT(t, n1, 1)
+		return
+	}
+	
+	go serverFn()
+	if doBasic {
+		bs := connFn('B')
+		cc := NewRPCClientCodec(bs, opts)
+		clientFn(cc)
+	}
+	if doCustom {
+		bs := connFn('C')
+		cc := NewCustomRPCClientCodec(bs, opts)
+		clientFn(cc)
+	}
+	if doExit {
+		bs := connFn('X')
+		<- serverExitChan
+		bs.Close()
+	}
+}
+
+func TestCustomRpcStructuredError(t *testing.T) {
+	srv := rpc.NewServer()
+	srv.Register(testRpcInt)
+	var decoded []interface{}
+	ropts := &RPCOptions{
+		ErrorIsStructured: true,
+		EncodeError: func(errstr string) interface{} {
+			return map[string]interface{}{"code": 7, "msg": errstr}
+		},
+		DecodeError: func(v interface{}) error {
+			decoded = append(decoded, v)
+			m := v.(map[interface{}]interface{})
+			return &testRpcError{int(m["code"].(int8)), m["msg"].(string)}
+		},
+	}
+	c1, c2 := net.Pipe()
+	go srv.ServeCodec(NewCustomRPCServerCodecWithOptions(c1, nil, ropts))
+	cl := rpc.NewClientWithCodec(NewCustomRPCClientCodecWithOptions(c2, nil, ropts))
+	defer cl.Close()
+	var res int
+	err := cl.Call("TestRpcInt.Fail", "bad thing", &res)
+	checkEqualT(t, err, error(rpc.ServerError("code 7: bad thing")))
+	checkEqualT(t, len(decoded), 1)
+	// successful calls have a nil error, which the hook is not called for
+	checkErrT(t, cl.Call("TestRpcInt.Mult", 2, &res))
+	checkEqualT(t, len(decoded), 1)
+
+	// a SpecRpcConn returns the error DecodeError returned
+	c1, c2 = net.Pipe()
+	p1, p2 := NewSpecRpcConn(c1, nil, ropts), NewSpecRpcConn(c2, nil, ropts)
+	p1.Handle("fail", func(args []byte) (interface{}, error) {
+		return nil, errors.New("bad thing")
+	})
+	go p1.Serve()
+	go p2.Serve()
+	defer p1.Close()
+	checkEqualT(t, p2.Call("fail", nil, &res), error(&testRpcError{7, "bad thing"}))
+
+	// if DecodeError returns nil, the call still fails, with the value as the error string
+	testRpcStructuredErrorNotDecoded(t, true)
+}
+
+// testRpcStructuredErrorNotDecoded checks a call fails if DecodeError returns nil for an error.
+func testRpcStructuredErrorNotDecoded(t *testing.T, custom bool) {
+	srv := rpc.NewServer()
+	srv.Register(testRpcInt)
+	ropts := &RPCOptions{
+		ErrorIsStructured: true,
+		EncodeError: func(errstr string) interface{} { return []interface{}{7, errstr} },
+		DecodeError: func(v interface{}) error { return nil },
+	}
+	c1, c2 := net.Pipe()
+	var cl *rpc.Client
+	if custom {
+		go srv.ServeCodec(NewCustomRPCServerCodecWithOptions(c1, nil, ropts))
+		cl = rpc.NewClientWithCodec(NewCustomRPCClientCodecWithOptions(c2, nil, ropts))
+	} else {
+		go srv.ServeCodec(NewRPCServerCodecWithOptions(c1, nil, ropts))
+		cl = rpc.NewClientWithCodec(NewRPCClientCodecWithOptions(c2, nil, ropts))
+	}
+	defer cl.Close()
+	var res int
+	checkEqualT(t, cl.Call("TestRpcInt.Fail", "bad thing", &res), error(rpc.ServerError("[7 bad thing]")))
+	checkErrT(t, cl.Call("TestRpcInt.Mult", 2, &res))
+}
+
+func TestBasicRpcStructuredError(t *testing.T) {
+	srv := rpc.NewServer()
+	srv.Register(testRpcInt)
+	var decoded []interface{}
+	ropts := &RPCOptions{
+		ErrorIsStructured: true,
+		EncodeError: func(errstr string) interface{} {
+			return map[string]interface{}{"code": 7, "msg": errstr}
+		},
+		DecodeError: func(v interface{}) error {
+			decoded = append(decoded, v)
+			m := v.(map[interface{}]interface{})
+			return &testRpcError{int(m["code"].(int8)), m["msg"].(string)}
+		},
+	}
+	c1, c2 := net.Pipe()
+	go srv.ServeCodec(NewRPCServerCodecWithOptions(c1, nil, ropts))
+	cl := rpc.NewClientWithCodec(NewRPCClientCodecWithOptions(c2, nil, ropts))
+	defer cl.Close()
+	var res int
+	err := cl.Call("TestRpcInt.Fail", "bad thing", &res)
+	checkEqualT(t, err, error(rpc.ServerError("code 7: bad thing")))
+	checkEqualT(t, decoded, []interface{}{map[interface{}]interface{}{"code": int8(7), "msg": "bad thing"}})
+	// successful calls have a nil error, which the hook is not called for
+	checkErrT(t, cl.Call("TestRpcInt.Mult", 2, &res))
+	checkEqualT(t, len(decoded), 1)
+	// without hooks, the error string is sent as is
+	c1, c2 = net.Pipe()
+	ropts = &RPCOptions{ErrorIsStructured: true}
+	go srv.ServeCodec(NewRPCServerCodecWithOptions(c1, nil, ropts))
+	cl2 := rpc.NewClientWithCodec(NewRPCClientCodecWithOptions(c2, nil, ropts))
+	defer cl2.Close()
+	err = cl2.Call("TestRpcInt.Fail", "bad thing", &res)
+	checkEqualT(t, err, error(rpc.ServerError("bad thing")))
+	checkErrT(t, cl2.Call("TestRpcInt.Mult", 3, &res))
+
+	testRpcStructuredErrorNotDecoded(t, false)
+}
+
+type testMessageConn struct {
+	in <-chan []byte
+	out chan<- []byte
+	closeOnce sync.Once
+	msgs [][]byte // messages written
+	msgType int   // type of the messages read (binary if 0)
+}
+
+func (c *testMessageConn) ReadMessage() (messageType int, p []byte, err error) {
+	p, ok := <-c.in
+	if !ok {
+		err = io.EOF
+	}
+	if messageType = c.msgType; messageType == 0 {
+		messageType = binaryMessage
+	}
+	return messageType, p, err
+}
+
+func (c *testMessageConn) WriteMessage(messageType int, data []byte) error {
+	data = append([]byte{}, data...)
+	c.msgs = append(c.msgs, data)
+	c.out <- data
+	return nil
+}
+
+func (c *testMessageConn) Close() error {
+	c.closeOnce.Do(func() { close(c.out) })
+	return nil
+}
+
+func TestMessageConnRpc(t *testing.T) {
+	srv := rpc.NewServer()
+	srv.Register(testRpcInt)
+	ch1, ch2 := make(chan []byte, 16), make(chan []byte, 16)
+	sconn := &testMessageConn{in: ch1, out: ch2}
+	cconn := &testMessageConn{in: ch2, out: ch1}
+	done := make(chan bool)
+	go func() {
+		srv.ServeCodec(NewCustomRPCServerCodec(NewMessageConnReadWriteCloser(sconn), nil))
+		done <- true
+	}()
+	cl := rpc.NewClientWithCodec(NewCustomRPCClientCodec(NewMessageConnReadWriteCloser(cconn), nil))
+	var up, mult int
+	checkErrT(t, cl.Call("TestRpcInt.Update", 3, &up))
+	checkEqualT(t, up, 3)
+	checkErrT(t, cl.Call("TestRpcInt.Mult", 20, &mult))
+	checkEqualT(t, mult, 60)
+	cl.Close()
+	<-done
+	sconn.Close()
+	// each message must hold exactly one complete msgpack value (the request or response)
+	for _, msgs := range [][][]byte{ cconn.msgs, sconn.msgs } {
+		checkEqualT(t, len(msgs), 2)
+		for _, msg := range msgs {
+			buf := bytes.NewBuffer(msg)
+			checkErrT(t, NewDecoder(buf, nil).CopyValue(ioutil.Discard))
+			checkEqualT(t, buf.Len(), 0)
+		}
+	}
+	// text messages are rejected
+	ch := make(chan []byte, 1)
+	ch <- []byte{0x01}
+	var i int
+	err := NewDecoder(NewMessageConnReadWriteCloser(&testMessageConn{in: ch, msgType: 1}), nil).Decode(&i)
+	if err == nil || !strings.Contains(err.Error(), "message type: 1") {
+		logT(t, "Expecting error reading a text message. Got: %v", err)
+		t.FailNow()
+	}
+}
+
+func TestSpecRpcConn(t *testing.T) {
+	c1, c2 := net.Pipe()
+	p1, p2 := NewSpecRpcConn(c1, nil, nil), NewSpecRpcConn(c2, nil, nil)
+	add := func(args []byte) (interface{}, error) {
+		var xs []int
+		if err := Unmarshal(args, &xs, nil); err != nil {
+			return nil, err
+		}
+		if len(xs) != 2 {
+			return nil, errors.New("add: expecting 2 args")
+		}
+		return xs[0] + xs[1], nil
+	}
+	p1.Handle("add", add)
+	// p2 handles "double" by calling back p1's "add"
+	p2.Handle("double", func(args []byte) (interface{}, error) {
+		var xs []int
+		if err := Unmarshal(args, &xs, nil); err != nil {
+			return nil, err
+		}
+		var sum int
+		err := p2.Call("add", []int{xs[0], xs[0]}, &sum)
+		return sum, err
+	})
+	notes := make(chan string, 2)
+	for _, p := range []*SpecRpcConn{p1, p2} {
+		p.Handle("note", func(args []byte) (interface{}, error) {
+			var xs []string
+			err := Unmarshal(args, &xs, nil)
+			notes <- xs[0]
+			return nil, err
+		})
+	}
+	done := make(chan error, 2)
+	go func() { done <- p1.Serve() }()
+	go func() { done <- p2.Serve() }()
+
+	var res int
+	checkErrT(t, p2.Call("add", []int{2, 3}, &res))
+	checkEqualT(t, res, 5)
+	checkErrT(t, p1.Call("double", []int{21}, &res))
+	checkEqualT(t, res, 42)
+	checkEqualT(t, p2.Call("add", []int{1}, &res), error(rpc.ServerError("add: expecting 2 args")))
+	checkEqualT(t, p2.Call("nosuch", nil, nil), error(rpc.ServerError("rpc: can't find method nosuch")))
+	// a reply which does not decode into the reply value only fails its call
+	p1.Handle("name", func(args []byte) (interface{}, error) { return "p1", nil })
+	var bad struct{ A int }
+	if err := p2.Call("name", nil, &bad); err == nil || err == rpc.ErrShutdown {
+		logT(t, "Expecting decode error for a mismatched reply. Got: %v", err)
+		t.FailNow()
+	}
+	checkErrT(t, p2.Call("add", []int{4, 5}, &res))
+	checkEqualT(t, res, 9)
+	checkErrT(t, p1.Notify("note", []string{"from p1"}))
+	checkEqualT(t, <-notes, "from p1")
+	checkErrT(t, p2.Notify("note", []string{"from p2"}))
+	checkEqualT(t, <-notes, "from p2")
+
+	p1.Close()
+	checkErrT(t, <-done)
+	checkErrT(t, <-done)
+	checkEqualT(t, p2.Call("add", []int{1, 2}, &res), rpc.ErrShutdown)
+}
+
+func TestPacketConnNotify(t *testing.T) {
+	spc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	checkErrT(t, err)
+	cpc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	checkErrT(t, err)
+	server := NewSpecRpcConn(NewPacketConnReadWriteCloser(spc, nil, 1024), nil, nil)
+	got := make(chan string, 10)
+	server.Handle("Log", func(args []byte) (interface{}, error) {
+		var params []string
+		if err := Unmarshal(args, &params, nil); err != nil {
+			return nil, err
+		}
+		got <- params[0]
+		return nil, nil
+	})
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- server.Serve() }()
+
+	client := NewSpecRpcConn(NewPacketConnReadWriteCloser(cpc, spc.LocalAddr(), 1024), nil, nil)
+	defer client.Close()
+	for _, s := range []string{"a", "b", "c"} {
+		checkErrT(t, client.Notify("Log", []string{s}))
+	}
+	// a message larger than a datagram is not sent (nor split)
+	if err = client.Notify("Log", []string{strings.Repeat("x", 2000)}); err == nil {
+		logT(t, "Expecting error sending a message larger than the max datagram size")
+		t.FailNow()
+	}
+	checkErrT(t, client.Notify("Log", []string{"d"}))
+	// junk and truncated datagrams (from any sender) are skipped, and do not affect the next ones
+	note, err := Marshal([]interface{}{2, "Log", []string{"e"}})
+	checkErrT(t, err)
+	for _, bs := range [][]byte{{0xc1, 0x02, 0x03}, note[:len(note)-2], {0x93, 0x02}} {
+		_, err = cpc.WriteTo(bs, spc.LocalAddr())
+		checkErrT(t, err)
+	}
+	checkErrT(t, client.Notify("Log", []string{"f"}))
+	var msgs []string
+	for len(msgs) < 5 {
+		select {
+		case s := <-got:
+			msgs = append(msgs, s)
+		case <-time.After(5 * time.Second):
+			logT(t, "Timed out waiting for notifications. Got: %v", msgs)
+			t.FailNow()
+		}
+	}
+	checkEqualT(t, msgs, []string{"a", "b", "c", "d", "f"})
+	checkErrT(t, server.Close())
+	checkErrT(t, <-serveErr)
+}
+
+func TestPacketConnRead(t *testing.T) {
+	spc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	checkErrT(t, err)
+	cpc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	checkErrT(t, err)
+	defer cpc.Close()
+	rwc := NewPacketConnReadWriteCloser(spc, nil, 1024)
+	defer rwc.Close()
+	// read directly, the adapter reads each datagram as it is needed 
+	// (including an empty one, and a value split across datagrams)
+	for _, bs := range [][]byte{{0xa1, 'a'}, {}, {0x92, 0x01}, {0x02}} {
+		_, err = cpc.WriteTo(bs, spc.LocalAddr())
+		checkErrT(t, err)
+	}
+	spc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	d := NewDecoder(rwc, nil)
+	var s string
+	checkErrT(t, d.Decode(&s))
+	checkEqualT(t, s, "a")
+	var xs []int
+	checkErrT(t, d.Decode(&xs))
+	checkEqualT(t, xs, []int{1, 2})
+}
+
+type testBufferRWC struct {
+	bytes.Buffer
+}
+
+func (b *testBufferRWC) Close() error { return nil }
+
+func TestFramedRpcRecovery(t *testing.T) {
+	ropts := &RPCOptions{Framed: true}
+	for _, custom := range []bool{false, true} {
+		var buf testBufferRWC
+		var sc rpc.ServerCodec
+		var cc rpc.ClientCodec
+		if custom {
+			sc, cc = NewCustomRPCServerCodecWithOptions(&buf, nil, ropts), NewCustomRPCClientCodecWithOptions(&buf, nil, ropts)
+		} else {
+			sc, cc = NewRPCServerCodecWithOptions(&buf, nil, ropts), NewRPCClientCodecWithOptions(&buf, nil, ropts)
+		}
+		checkErrT(t, sc.WriteResponse(&rpc.Response{ServiceMethod: "TestRpcInt.Mult", Seq: 1}, 5))
+		// corrupt a byte in the payload of the first frame
+		buf.Bytes()[frameHeaderLen + 2] ^= 0xff
+		// junk between frames is skipped too
+		buf.Write([]byte{0x01, 0x02, 0x03})
+		checkErrT(t, sc.WriteResponse(&rpc.Response{ServiceMethod: "TestRpcInt.Mult", Seq: 2}, 6))
+		checkErrT(t, sc.WriteResponse(&rpc.Response{ServiceMethod: "TestRpcInt.Mult", Seq: 3}, 7))
+		// a corrupt length in a header is caught by the header checksum, 
+		// instead of consuming the length it claims
+		off := buf.Len()
+		checkErrT(t, sc.WriteResponse(&rpc.Response{ServiceMethod: "TestRpcInt.Mult", Seq: 9}, 13))
+		buf.Bytes()[off + 2] ^= 0x7f
+		checkErrT(t, sc.WriteResponse(&rpc.Response{ServiceMethod: "TestRpcInt.Mult", Seq: 4}, 8))
+		for _, seq := range []uint64{2, 3, 4} {
+			var r rpc.Response
+			var i int
+			checkErrT(t, cc.ReadResponseHeader(&r))
+			checkEqualT(t, r.Seq, seq)
+			checkErrT(t, cc.ReadResponseBody(&i))
+			checkEqualT(t, i, int(seq) + 4)
+		}
+		var r rpc.Response
+		checkEqualT(t, cc.ReadResponseHeader(&r), io.EOF)
+	}
+
+	// frames longer than MaxFrameLen are not written, and skipped when read
+	var buf testBufferRWC
+	big := make([]byte, 100)
+	sc := NewRPCServerCodecWithOptions(&buf, nil, &RPCOptions{Framed: true})
+	checkErrT(t, sc.WriteResponse(&rpc.Response{ServiceMethod: "TestRpcInt.Mult", Seq: 1}, big))
+	checkErrT(t, sc.WriteResponse(&rpc.Response{ServiceMethod: "TestRpcInt.Mult", Seq: 2}, 6))
+	lopts := &RPCOptions{Framed: true, MaxFrameLen: 50}
+	if err := NewRPCServerCodecWithOptions(&buf, nil, lopts).WriteResponse(
+		&rpc.Response{ServiceMethod: "TestRpcInt.Mult", Seq: 3}, big); err == nil {
+		logT(t, "Expecting error writing a frame longer than MaxFrameLen")
+		t.FailNow()
+	}
+	cc := NewRPCClientCodecWithOptions(&buf, nil, lopts)
+	var r rpc.Response
+	var i int
+	checkErrT(t, cc.ReadResponseHeader(&r))
+	checkEqualT(t, r.Seq, uint64(2))
+	checkErrT(t, cc.ReadResponseBody(&i))
+	checkEqualT(t, i, 6)
+	checkEqualT(t, cc.ReadResponseHeader(&r), io.EOF)
+}
+
+func TestRpcNilResponseBody(t *testing.T) {
+	var buf testBufferRWC
+	sc, cc := NewRPCServerCodec(&buf, nil), NewRPCClientCodec(&buf, nil)
+	var nilp *int
+	checkErrT(t, sc.WriteResponse(&rpc.Response{ServiceMethod: "TestRpcInt.Mult", Seq: 1}, nil))
+	checkErrT(t, sc.WriteResponse(&rpc.Response{ServiceMethod: "TestRpcInt.Mult", Seq: 2}, nilp))
+	checkErrT(t, sc.WriteResponse(&rpc.Response{ServiceMethod: "TestRpcInt.Mult", Seq: 3}, nilp))
+	for _, seq := range []uint64{1, 2} {
+		var r rpc.Response
+		i := 5
+		checkErrT(t, cc.ReadResponseHeader(&r))
+		checkEqualT(t, r.Seq, seq)
+		checkErrT(t, cc.ReadResponseBody(&i))
+		checkEqualT(t, i, 0)
+	}
+	// net/rpc passes a nil body to discard it
+	var r rpc.Response
+	checkErrT(t, cc.ReadResponseHeader(&r))
+	checkErrT(t, cc.ReadResponseBody(nil))
+	checkEqualT(t, buf.Len(), 0)
+}
+
+type testRpcEvent struct {
+	method string
+	seq    uint64
+	n      int
+}
+
+func TestRpcObserver(t *testing.T) {
+	srv := rpc.NewServer()
+	srv.Register(testRpcInt)
+	type observable interface {
+		SetObserver(RPCObserver)
+	}
+	observe := func(codec interface{}) <-chan testRpcEvent {
+		ch := make(chan testRpcEvent, 2)
+		codec.(observable).SetObserver(func(method string, seq uint64, n int) {
+			ch <- testRpcEvent{method, seq, n}
+		})
+		return ch
+	}
+	for _, custom := range []bool{false, true} {
+		var sc rpc.ServerCodec
+		var cc rpc.ClientCodec
+		c1, c2 := net.Pipe()
+		if custom {
+			sc, cc = NewCustomRPCServerCodec(c1, nil), NewCustomRPCClientCodec(c2, nil)
+		} else {
+			sc, cc = NewRPCServerCodec(c1, nil), NewRPCClientCodec(c2, nil)
+		}
+		sch, cch := observe(sc), observe(cc)
+		go srv.ServeCodec(sc)
+		cl := rpc.NewClientWithCodec(cc)
+		var res int
+		checkErrT(t, cl.Call("TestRpcInt.Mult", 2, &res))
+		cl.Close()
+		// each side sees the request, then the response
+		creq, cres, sreq, sres := <-cch, <-cch, <-sch, <-sch
+		for _, ev := range []testRpcEvent{creq, cres, sreq, sres} {
+			checkEqualT(t, ev.method, "TestRpcInt.Mult")
+			checkEqualT(t, ev.seq, creq.seq)
+		}
+		checkEqualT(t, sreq.n, creq.n)
+		checkEqualT(t, cres.n, sres.n)
+		var reqbs []byte
+		var err error
+		if custom {
+			reqbs, err = Marshal([]interface{}{byte(0), uint32(creq.seq), "TestRpcInt.Mult", 2})
+		} else {
+			reqbs, err = Marshal(rpc.Request{ServiceMethod: "TestRpcInt.Mult", Seq: creq.seq})
+			if err == nil {
+				reqbs = append(reqbs, 0x02)
+			}
+		}
+		checkErrT(t, err)
+		checkEqualT(t, creq.n, len(reqbs))
 	}
 }
 
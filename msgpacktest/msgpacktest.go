@@ -0,0 +1,83 @@
+
+/*
+go-msgpack - Msgpack library for Go. Provides pack/unpack and net/rpc support.
+https://github.com/ugorji/go-msgpack
+
+Copyright (c) 2012, Ugorji Nwoke.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice,
+  this list of conditions and the following disclaimer.
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+* Neither the name of the author nor the names of its contributors may be used
+  to endorse or promote products derived from this software
+  without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+// Package msgpacktest provides helpers for testing values encoded with go-msgpack 
+// (e.g. types with a custom encoder or decoder registered).
+package msgpacktest
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/ugorji/go-msgpack"
+)
+
+// Options holds the options used to encode and decode a value. 
+// A nil Options (or field) uses the defaults.
+type Options struct {
+	Encoder *msgpack.EncoderOptions
+	Decoder *msgpack.DecoderOptions
+	Resolver msgpack.DecoderContainerResolver
+}
+
+// AssertRoundTrip encodes v, decodes it into a new value of the same type, and reports 
+// an error on t (with the encoded bytes in hex) if it fails, or if the decoded value 
+// is not deeply equal to v. It returns whether the round trip succeeded.
+// 
+// v must not be nil. A nil interface{} within v (e.g. in a map[string]interface{}) 
+// is decoded as the decoder sees fit (e.g. an int8 for a small integer), 
+// so such values are best checked with concrete types.
+func AssertRoundTrip(t testing.TB, v interface{}, opts *Options) bool {
+	t.Helper()
+	if opts == nil {
+		opts = &Options{}
+	}
+	var buf bytes.Buffer
+	if err := msgpack.NewEncoderWithOptions(&buf, opts.Encoder).Encode(v); err != nil {
+		t.Errorf("msgpacktest: encoding %T: %v", v, err)
+		return false
+	}
+	rv := reflect.New(reflect.TypeOf(v))
+	d := msgpack.NewDecoderWithOptions(bytes.NewReader(buf.Bytes()), opts.Resolver, opts.Decoder)
+	if err := d.Decode(rv.Interface()); err != nil {
+		t.Errorf("msgpacktest: decoding %T: %v\nencoded: %x", v, err, buf.Bytes())
+		return false
+	}
+	if v2 := rv.Elem().Interface(); !reflect.DeepEqual(v, v2) {
+		t.Errorf("msgpacktest: round trip of %T does not match:\n  value:   %s\n  decoded: %s\nencoded: %x",
+			v, fmt.Sprintf("%#v", v), fmt.Sprintf("%#v", v2), buf.Bytes())
+		return false
+	}
+	return true
+}
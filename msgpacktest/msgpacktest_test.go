@@ -0,0 +1,95 @@
+
+/*
+go-msgpack - Msgpack library for Go. Provides pack/unpack and net/rpc support.
+https://github.com/ugorji/go-msgpack
+
+Copyright (c) 2012, Ugorji Nwoke.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice,
+  this list of conditions and the following disclaimer.
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+* Neither the name of the author nor the names of its contributors may be used
+  to endorse or promote products derived from this software
+  without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package msgpacktest
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ugorji/go-msgpack"
+)
+
+type testStruc struct {
+	A string
+	B int64 `msgpack:"b,omitempty"`
+	C []float64
+	D map[string]int
+	E *testStruc
+	T time.Time
+}
+
+func TestAssertRoundTrip(t *testing.T) {
+	vs := []interface{}{
+		int8(-5), uint16(300), int64(1 << 40), 1.5, float32(2.25), true, "abc", 
+		[]byte{1, 2, 3}, []string{"a", "b"}, [2]int{1, 2}, map[string]bool{"x": true},
+		testStruc{A: "a", B: 2, C: []float64{0.5}, D: map[string]int{"k": 3}, 
+			E: &testStruc{A: "inner"}, T: time.Unix(1700000000, 5).UTC()},
+	}
+	for _, v := range vs {
+		AssertRoundTrip(t, v, nil)
+	}
+	AssertRoundTrip(t, testStruc{A: "x"}, &Options{
+		Encoder: &msgpack.EncoderOptions{Canonical: true},
+		Decoder: &msgpack.DecoderOptions{ErrorOnTrailingBytes: true},
+	})
+}
+
+// recordingTB records the errors reported to it.
+type recordingTB struct {
+	testing.TB
+	errs []string
+}
+
+func (r *recordingTB) Helper() {}
+
+func (r *recordingTB) Errorf(format string, args ...interface{}) {
+	r.errs = append(r.errs, fmt.Sprintf(format, args...))
+}
+
+func TestAssertRoundTripMismatch(t *testing.T) {
+	// a small integer in an interface{} decodes as an int8, not an int
+	r := &recordingTB{TB: t}
+	if AssertRoundTrip(r, map[string]interface{}{"a": 1}, nil) {
+		t.Fatalf("Expecting round trip to fail")
+	}
+	if len(r.errs) != 1 || !strings.Contains(r.errs[0], "does not match") || !strings.Contains(r.errs[0], "81a161") {
+		t.Fatalf("Expecting a mismatch error with the encoded bytes. Got: %q", r.errs)
+	}
+	// a value which cannot be encoded
+	r.errs = nil
+	if AssertRoundTrip(r, make(chan int), nil) || len(r.errs) != 1 {
+		t.Fatalf("Expecting an encoding error. Got: %q", r.errs)
+	}
+}
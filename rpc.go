@@ -40,16 +40,110 @@ and the custom format defined at http://wiki.msgpack.org/display/MSGPACK/RPC+spe
 package msgpack
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
 	"strings"
+	"net"
 	"net/rpc"
 	"io"
+	"io/ioutil"
+	"encoding/binary"
+	"hash/crc32"
+	"sync"
 )
 
+// Default RPCOptions used when a nil parameter is passed to the XXXWithOptions codec functions.
+var DefaultRPCOptions = RPCOptions{}
+
+// RPCOptions holds options which control how the rpc codecs read and write messages.
+type RPCOptions struct {
+	// If set, the error in a response of the custom (msgpack-rpc) codec is not 
+	// restricted to a string, as msgpack-rpc allows any object.
+	// On the server, EncodeError (if set) is called with the rpc.Response.Error string,
+	// and the value it returns is written as the error.
+	// On the client, the error is decoded into an interface{}, and DecodeError (if set) 
+	// is called with it to reconstruct the error. If DecodeError returns nil (or is not set),
+	// the error is the value formatted with fmt.Sprint, so the call still fails.
+	// 
+	// How the error reaches the caller: net/rpc's Client only keeps an error string,
+	// so Call returns an rpc.ServerError of the Error() string of the reconstructed error. 
+	// SpecRpcConn.Call returns the error DecodeError returned itself (e.g. to check its 
+	// type or fields). 
+	// 
+	// With the basic (net/rpc) codec, whose response header holds the error as a string, 
+	// the structured error is written after the header (nil if there is no error), 
+	// and read the same way. Both ends of a connection must use the same setting.
+	ErrorIsStructured bool
+	EncodeError func(errstr string) interface{}
+	DecodeError func(v interface{}) error
+	// If set, each request or response is written in a frame, with a small header
+	// (marker byte, flags, length and checksum of the payload, and a checksum of the header). 
+	// A frame which is corrupt (bad header or checksum) is skipped when reading, and 
+	// reading continues from the next frame, so a dropped or partial message 
+	// does not leave the stream permanently out of sync. A bad header is not trusted
+	// for the payload length: the next frame is looked for from the byte after its marker.
+	// Both ends of a connection must use the same setting.
+	Framed bool
+	// If > 0 (and Framed is set), a frame whose header claims a longer payload is skipped 
+	// as corrupt when reading, and writing a longer message is an error.
+	MaxFrameLen int
+}
+
+// frameMarker starts each frame header. 0xc1 is never used in msgpack, 
+// so it stands out when scanning for the next frame.
+const frameMarker byte = 0xc1
+
+// frame header: marker (1), flags (1), payload length (4), payload crc32 checksum (4),
+// crc32 checksum of the preceding header bytes (4)
+const frameHeaderLen = 14
+
+// RPCObserver is called by an rpc codec for each request or response it writes or reads,
+// with the method name, sequence number, and size in bytes of the message 
+// (excluding any frame header). See SetObserver.
+type RPCObserver func(method string, seq uint64, bytes int)
+
 type rpcCodec struct {
 	rwc       io.ReadWriteCloser
+	br        *bufio.Reader // buffered reader over rwc, so small reads don't each hit the conn
+	r         io.Reader     // reader for the msgpack stream (br, or the current frame)
 	dec       *Decoder
 	enc       *Encoder
+	ropts     *RPCOptions
+	dgram     datagramReader // rwc, if each message is read from a datagram of its own
+	rframe    *bytes.Buffer // payload of frame being read (if Framed)
+	wframe    *bytes.Buffer // payload of frame being written (if Framed)
+	cr        *countingReader
+	cw        *countingWriter
+	obs       RPCObserver
+	rmethod   string // method of message being read (between header and body)
+	rseq      uint64
+	pendingMu sync.Mutex
+	pending   map[uint64]string // methods of requests awaiting a response (if observed)
+}
+
+// countingReader and countingWriter count the bytes of each message, for the RPCObserver.
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (n int, err error) {
+	n, err = c.r.Read(p)
+	c.n += n
+	return
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int
+}
+
+func (c *countingWriter) Write(p []byte) (n int, err error) {
+	n, err = c.w.Write(p)
+	c.n += n
+	return
 }
 
 type basicRpcCodec struct {
@@ -60,11 +154,40 @@ type customRpcCodec struct {
 	rpcCodec
 }
 
-func newRPCCodec(conn io.ReadWriteCloser, opts DecoderContainerResolver) (rpcCodec) {
+func newRPCCodec(conn io.ReadWriteCloser, opts DecoderContainerResolver, ropts *RPCOptions) (rpcCodec) {
+	if ropts == nil {
+		ropts = &DefaultRPCOptions
+	}
+	br := bufio.NewReader(conn)
+	dgram, _ := conn.(datagramReader)
+	if ropts.Framed {
+		rframe, wframe := new(bytes.Buffer), new(bytes.Buffer)
+		cr, cw := &countingReader{r: rframe}, &countingWriter{w: wframe}
+		return rpcCodec{
+			rwc: conn,
+			br: br,
+			dgram: dgram,
+			r: cr,
+			dec: NewDecoder(cr, opts),
+			enc: NewEncoder(cw),
+			ropts: ropts,
+			rframe: rframe,
+			wframe: wframe,
+			cr: cr,
+			cw: cw,
+		}
+	}
+	cr, cw := &countingReader{r: br}, &countingWriter{w: conn}
 	return rpcCodec{
 		rwc: conn,
-		dec: NewDecoder(conn, opts),
-		enc: NewEncoder(conn),
+		br: br,
+		dgram: dgram,
+		r: cr,
+		dec: NewDecoder(cr, opts),
+		enc: NewEncoder(cw),
+		ropts: ropts,
+		cr: cr,
+		cw: cw,
 	}
 }
 
@@ -76,36 +199,187 @@ func newRPCCodec(conn io.ReadWriteCloser, opts DecoderContainerResolver) (rpcCod
 //   client := rpc.NewClientWithCodec(codec)
 //   ... (see rpc package for how to use an rpc client)
 func NewRPCClientCodec(conn io.ReadWriteCloser, opts DecoderContainerResolver) (rpc.ClientCodec) {
-	return &basicRpcCodec{ newRPCCodec(conn, opts) }
+	return &basicRpcCodec{ newRPCCodec(conn, opts, nil) }
 }
 
 // NewRPCServerCodec uses basic msgpack serialization for rpc communication from the server side.
 func NewRPCServerCodec(conn io.ReadWriteCloser, opts DecoderContainerResolver) (rpc.ServerCodec) {
-	return &basicRpcCodec{ newRPCCodec(conn, opts) }
+	return &basicRpcCodec{ newRPCCodec(conn, opts, nil) }
 }
 
 // NewCustomRPCClientCodec uses msgpack serialization for rpc communication from client side, 
 // but uses a custom protocol defined at http://wiki.msgpack.org/display/MSGPACK/RPC+specification
 func NewCustomRPCClientCodec(conn io.ReadWriteCloser, opts DecoderContainerResolver) (rpc.ClientCodec) {
-	return &customRpcCodec{ newRPCCodec(conn, opts) }
+	return &customRpcCodec{ newRPCCodec(conn, opts, nil) }
 }
 	
 // NewCustomRPCServerCodec uses msgpack serialization for rpc communication from server side, 
 // but uses a custom protocol defined at http://wiki.msgpack.org/display/MSGPACK/RPC+specification
 func NewCustomRPCServerCodec(conn io.ReadWriteCloser, opts DecoderContainerResolver) (rpc.ServerCodec) {
-	return &customRpcCodec{ newRPCCodec(conn, opts) }
+	return &customRpcCodec{ newRPCCodec(conn, opts, nil) }
+}
+	
+// NewRPCClientCodecWithOptions is like NewRPCClientCodec, but also takes RPCOptions.
+func NewRPCClientCodecWithOptions(conn io.ReadWriteCloser, opts DecoderContainerResolver, 
+	ropts *RPCOptions) (rpc.ClientCodec) {
+	return &basicRpcCodec{ newRPCCodec(conn, opts, ropts) }
+}
+
+// NewRPCServerCodecWithOptions is like NewRPCServerCodec, but also takes RPCOptions.
+func NewRPCServerCodecWithOptions(conn io.ReadWriteCloser, opts DecoderContainerResolver, 
+	ropts *RPCOptions) (rpc.ServerCodec) {
+	return &basicRpcCodec{ newRPCCodec(conn, opts, ropts) }
+}
+
+// NewCustomRPCClientCodecWithOptions is like NewCustomRPCClientCodec, but also takes RPCOptions.
+func NewCustomRPCClientCodecWithOptions(conn io.ReadWriteCloser, opts DecoderContainerResolver, 
+	ropts *RPCOptions) (rpc.ClientCodec) {
+	return &customRpcCodec{ newRPCCodec(conn, opts, ropts) }
+}
+	
+// NewCustomRPCServerCodecWithOptions is like NewCustomRPCServerCodec, but also takes RPCOptions.
+func NewCustomRPCServerCodecWithOptions(conn io.ReadWriteCloser, opts DecoderContainerResolver, 
+	ropts *RPCOptions) (rpc.ServerCodec) {
+	return &customRpcCodec{ newRPCCodec(conn, opts, ropts) }
 }
 	
 // /////////////// RPC Codec Shared Methods ///////////////////
+
+// SetObserver sets a function called for each request or response written or read
+// by the codec (e.g. to record metrics or tracing spans). It must be called before 
+// the codec is used. The codecs are returned as rpc.ClientCodec or rpc.ServerCodec, 
+// so a type assertion is needed to call it:
+//   codec := msgpack.NewRPCServerCodec(conn, nil)
+//   codec.(interface{ SetObserver(msgpack.RPCObserver) }).SetObserver(fn)
+func (c *rpcCodec) SetObserver(obs RPCObserver) {
+	c.obs = obs
+}
+
 func (c *rpcCodec) write(objs ...interface{}) (err error) {
+	c.cw.n = 0
 	for _, obj := range objs {
 		if err = c.enc.Encode(obj); err != nil {
+			if c.ropts.Framed {
+				c.wframe.Reset()
+			}
+			return
+		}
+	}
+	if c.ropts.Framed {
+		if err = c.writeFrame(); err != nil {
+			return
+		}
+	}
+	return c.flush()
+}
+
+// flush the connection if it buffers writes (e.g. bufio.Writer or a message conn adapter),
+// so a message is sent once it is completely written.
+func (c *rpcCodec) flush() (err error) {
+	if f, ok := c.rwc.(interface { Flush() error }); ok {
+		err = f.Flush()
+	}
+	return
+}
+
+// writeFrame writes the frame header and the payload written so far.
+func (c *rpcCodec) writeFrame() (err error) {
+	payload := c.wframe.Bytes()
+	defer c.wframe.Reset()
+	if c.ropts.MaxFrameLen > 0 && len(payload) > c.ropts.MaxFrameLen {
+		return fmt.Errorf("%s: Frame length: %d exceeds MaxFrameLen: %d", 
+			msgTagEnc, len(payload), c.ropts.MaxFrameLen)
+	}
+	bs := make([]byte, frameHeaderLen, frameHeaderLen + len(payload))
+	bs[0] = frameMarker
+	binary.BigEndian.PutUint32(bs[2:6], uint32(len(payload)))
+	binary.BigEndian.PutUint32(bs[6:10], crc32.ChecksumIEEE(payload))
+	binary.BigEndian.PutUint32(bs[10:14], crc32.ChecksumIEEE(bs[:10]))
+	_, err = c.rwc.Write(append(bs, payload...))
+	return
+}
+
+// observeWrite is called after a request or response is written.
+func (c *rpcCodec) observeWrite(method string, seq uint64) {
+	if c.obs != nil {
+		c.obs(method, seq, c.cw.n)
+	}
+}
+
+// readHeaderStart is called before reading a request or response header.
+// Over datagrams, it moves to the next datagram (dropping what is left of the last one).
+// If framed, it reads the next frame, so the header and body are read from it.
+func (c *rpcCodec) readHeaderStart() (err error) {
+	c.cr.n = 0
+	if c.dgram != nil {
+		c.br.Reset(c.rwc)
+		c.dec.peeked = false
+		if err = c.dgram.nextDatagram(); err != nil {
 			return
 		}
 	}
+	if c.ropts.Framed {
+		err = c.readFrame()
+	}
 	return
 }
 
+// readHeader starts reading a message (see readHeaderStart), and reads its header with fn.
+// Over datagrams, a message which cannot be read is skipped (as it cannot spill into
+// the next datagram), and the header of the next one is read instead.
+func (c *rpcCodec) readHeader(fn func() error) (err error) {
+	for {
+		if err = c.readHeaderStart(); err != nil {
+			return
+		}
+		if err = fn(); err == nil || c.dgram == nil {
+			return
+		}
+	}
+}
+
+// readFrame reads the payload of the next good frame into rframe. 
+// Corrupt frames, and junk between frames, are skipped.
+func (c *rpcCodec) readFrame() (err error) {
+	var h [frameHeaderLen]byte
+	for {
+		// scan for the frame marker
+		if _, err = io.ReadFull(c.br, h[:1]); err != nil {
+			return
+		}
+		if h[0] != frameMarker {
+			continue
+		}
+		// check the rest of the header before consuming it: if it is bad, 
+		// the marker was junk (or the header is corrupt), so scan on from the next byte
+		var hb []byte
+		if hb, err = c.br.Peek(frameHeaderLen - 1); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return
+		}
+		copy(h[1:], hb)
+		n := binary.BigEndian.Uint32(h[2:6])
+		if h[1] != 0 || // no flags are defined yet
+			crc32.ChecksumIEEE(h[:10]) != binary.BigEndian.Uint32(h[10:14]) ||
+			(c.ropts.MaxFrameLen > 0 && uint64(n) > uint64(c.ropts.MaxFrameLen)) {
+			continue
+		}
+		c.br.Discard(len(hb))
+		c.rframe.Reset()
+		if _, err = io.CopyN(c.rframe, c.br, int64(n)); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return
+		}
+		if crc32.ChecksumIEEE(c.rframe.Bytes()) == binary.BigEndian.Uint32(h[6:10]) {
+			return
+		}
+	}
+}
+
 func (c *rpcCodec) read(objs ...interface{}) (err error) {
 	for _, obj := range objs {
 		if err = c.dec.Decode(obj); err != nil {
@@ -152,58 +426,142 @@ func (c *rpcCodec) Close() error {
 }
 
 func (c *rpcCodec) ReadResponseBody(body interface{}) error {
-	return c.dec.Decode(body)
+	return c.readBody(body)
+}
+
+// readBody decodes the next value into body. 
+// net/rpc passes a nil body to discard it (e.g. for a response with an error), 
+// in which case it is read and discarded.
+func (c *rpcCodec) readBody(body interface{}) (err error) {
+	if body == nil {
+		err = c.dec.CopyValue(ioutil.Discard)
+	} else {
+		err = c.dec.Decode(body)
+	}
+	if err == nil && c.obs != nil {
+		c.obs(c.rmethod, c.rseq, c.cr.n)
+	}
+	return
+}
+
+// readHeaderEnd records the method and sequence number of the message being read, 
+// for the observer (which is called once its body is read).
+func (c *rpcCodec) readHeaderEnd(method string, seq uint64) {
+	c.rmethod, c.rseq = method, seq
 }
 
 // /////////////// Basic RPC Codec ///////////////////
-func (c *basicRpcCodec) WriteRequest(r *rpc.Request, body interface{}) error {
-	return c.write(r, body)
+func (c *basicRpcCodec) WriteRequest(r *rpc.Request, body interface{}) (err error) {
+	if err = c.write(r, body); err == nil {
+		c.observeWrite(r.ServiceMethod, r.Seq)
+	}
+	return
 }
 
-func (c *basicRpcCodec) WriteResponse(r *rpc.Response, body interface{}) error {
-	return c.write(r, body)
+// WriteResponse writes the response header and body.
+// A nil body (nil interface{} or typed nil pointer) is written as msgpack nil, 
+// which the client decodes into the reply as its zero value.
+func (c *basicRpcCodec) WriteResponse(r *rpc.Response, body interface{}) (err error) {
+	if c.ropts.ErrorIsStructured {
+		var moe interface{}
+		if r.Error != "" {
+			moe = r.Error
+			if c.ropts.EncodeError != nil {
+				moe = c.ropts.EncodeError(r.Error)
+			}
+		}
+		err = c.write(r, moe, body)
+	} else {
+		err = c.write(r, body)
+	}
+	if err == nil {
+		c.observeWrite(r.ServiceMethod, r.Seq)
+	}
+	return
 }
 
 func (c *basicRpcCodec) ReadRequestBody(body interface{}) error {
-	return c.dec.Decode(body)
+	return c.readBody(body)
 }
 
 func (c *basicRpcCodec) ReadResponseHeader(r *rpc.Response) error {
-	return c.maybeEOF(c.dec.Decode(r))
+	if err := c.readHeader(func() (err error) {
+		if err = c.dec.Decode(r); err == nil && c.ropts.ErrorIsStructured {
+			_, err = c.readStructuredError(&r.Error)
+		}
+		return
+	}); err != nil {
+		return c.maybeEOF(err)
+	}
+	c.readHeaderEnd(r.ServiceMethod, r.Seq)
+	return nil
 }
 
 func (c *basicRpcCodec) ReadRequestHeader(r *rpc.Request) error {
-	return c.maybeEOF(c.dec.Decode(r))
+	if err := c.readHeader(func() error { return c.dec.Decode(r) }); err != nil {
+		return c.maybeEOF(err)
+	}
+	c.readHeaderEnd(r.ServiceMethod, r.Seq)
+	return nil
 }
 
 // /////////////// Custom RPC Codec ///////////////////
-func (c *customRpcCodec) WriteRequest(r *rpc.Request, body interface{}) error {
-	return c.writeCustomBody(0, r.Seq, r.ServiceMethod, body)
+func (c *customRpcCodec) WriteRequest(r *rpc.Request, body interface{}) (err error) {
+	if err = c.writeCustomBody(0, r.Seq, r.ServiceMethod, body); err == nil && c.obs != nil {
+		// responses do not carry the method, so remember it for the observer
+		c.pendingMu.Lock()
+		if c.pending == nil {
+			c.pending = make(map[uint64]string)
+		}
+		c.pending[r.Seq] = r.ServiceMethod
+		c.pendingMu.Unlock()
+		c.observeWrite(r.ServiceMethod, r.Seq)
+	}
+	return
 }
 
-func (c *customRpcCodec) WriteResponse(r *rpc.Response, body interface{}) error {
-	return c.writeCustomBody(1, r.Seq, r.Error, body)
+func (c *customRpcCodec) WriteResponse(r *rpc.Response, body interface{}) (err error) {
+	if err = c.writeCustomBody(1, r.Seq, r.Error, body); err == nil {
+		c.observeWrite(r.ServiceMethod, r.Seq)
+	}
+	return
 }
 
 func (c *customRpcCodec) ReadRequestBody(body interface{}) error {
-	return c.dec.Decode(body)
+	return c.readBody(body)
 }
 
 func (c *customRpcCodec) ReadResponseHeader(r *rpc.Response) error {
-	return c.maybeEOF(c.parseCustomHeader(1, &r.Seq, &r.Error))
+	if err := c.readHeader(func() error { return c.parseCustomHeader(1, &r.Seq, &r.Error) }); err != nil {
+		return c.maybeEOF(err)
+	}
+	var method string
+	if c.obs != nil {
+		c.pendingMu.Lock()
+		method = c.pending[r.Seq]
+		delete(c.pending, r.Seq)
+		c.pendingMu.Unlock()
+	}
+	c.readHeaderEnd(method, r.Seq)
+	return nil
 }
 
 func (c *customRpcCodec) ReadRequestHeader(r *rpc.Request) error {
-	return c.maybeEOF(c.parseCustomHeader(0, &r.Seq, &r.ServiceMethod))
+	if err := c.readHeader(func() error { return c.parseCustomHeader(0, &r.Seq, &r.ServiceMethod) }); err != nil {
+		return c.maybeEOF(err)
+	}
+	c.readHeaderEnd(r.ServiceMethod, r.Seq)
+	return nil
 }
 
 func (c *customRpcCodec) parseCustomHeader(expectTypeByte byte, msgid *uint64, methodOrError *string) (err error) {
 
 	// We read the response header by hand 
 	// so that the body can be decoded on its own from the stream at a later time.
+	// The reads are buffered, so the small reads here don't each hit the connection.
 
 	bs := make([]byte, 1)
-	n, err := c.rwc.Read(bs)
+	n, err := c.r.Read(bs)
 	if err != nil {
 		return 
 	}
@@ -217,13 +575,41 @@ func (c *customRpcCodec) parseCustomHeader(expectTypeByte byte, msgid *uint64, m
 		return
 	}
 	var b byte
-	if err = c.read(&b, msgid, methodOrError); err != nil {
+	if err = c.read(&b, msgid); err != nil {
 		return
 	}
 	if b != expectTypeByte {
 		err = fmt.Errorf("Unexpected byte descriptor in header. Expecting %v. Received %v", expectTypeByte, b)
 		return
 	}
+	if expectTypeByte == 1 && c.ropts.ErrorIsStructured {
+		_, err = c.readStructuredError(methodOrError)
+	} else {
+		err = c.read(methodOrError)
+	}
+	return
+}
+
+// readStructuredError reads an error written with RPCOptions.ErrorIsStructured, 
+// and sets errstr from it (unless it is nil). 
+// serr is the error returned by RPCOptions.DecodeError (if any).
+func (c *rpcCodec) readStructuredError(errstr *string) (serr error, err error) {
+	var v interface{}
+	if err = c.read(&v); err != nil || v == nil {
+		return
+	}
+	if c.ropts.DecodeError != nil {
+		serr = c.ropts.DecodeError(v)
+	}
+	if serr != nil {
+		*errstr = serr.Error()
+	} else {
+		*errstr = fmt.Sprint(v)
+	}
+	if *errstr == "" {
+		// an empty string means no error to net/rpc
+		*errstr = fmt.Sprintf("%#v", v)
+	}
 	return
 }
 
@@ -233,12 +619,417 @@ func (c *customRpcCodec) writeCustomBody(typeByte byte, msgid uint64, methodOrEr
 	if typeByte == 1 {
 		if methodOrError == "" {
 			moe = nil
+		} else if c.ropts.ErrorIsStructured && c.ropts.EncodeError != nil {
+			moe = c.ropts.EncodeError(methodOrError)
 		}
 		if moe != nil && body != nil {
 			body = nil
 		}
 	}
 	r2 := []interface{}{ typeByte, uint32(msgid), moe, body }
-	return c.enc.Encode(r2)
+	return c.write(r2)
+}
+
+// /////////////// Spec RPC Conn (peer to peer) ///////////////////
+
+// SpecRpcHandler handles a request or notification received by a SpecRpcConn.
+// args holds the msgpack-encoded params (an array), which can be decoded with Unmarshal.
+// For a request, the result (or error) is sent back as the response. 
+// For a notification, they are ignored.
+type SpecRpcHandler func(args []byte) (result interface{}, err error)
+
+// SpecRpcConn is a connection on which both ends can send and receive requests 
+// (and notifications) of the custom (msgpack-rpc) protocol, for symmetric protocols 
+// where each peer is both a client and a server (e.g. Neovim's).
+// Messages are dispatched by their type: 0 (request), 1 (response) and 2 (notification).
+// 
+// Handlers are registered with Handle, and Serve reads and dispatches messages until 
+// the connection is closed. Each request is handled in its own goroutine, 
+// so a handler can call back the peer. Notifications are handled in order, in the 
+// Serve goroutine, so their handlers must not wait for a response (e.g. with Call).
+// 
+// Sample Usage:
+//   pc := msgpack.NewSpecRpcConn(conn, nil, nil)
+//   pc.Handle("add", func(args []byte) (interface{}, error) { ... })
+//   go pc.Serve()
+//   err = pc.Call("echo", []interface{}{"hello"}, &reply)
+type SpecRpcConn struct {
+	c        customRpcCodec
+	wmu      sync.Mutex // serializes writes of whole messages
+	mu       sync.Mutex // protects the fields below
+	seq      uint32
+	calls    map[uint32]*specRpcCall
+	handlers map[string]SpecRpcHandler
+	shutdown bool
+	closing  bool // if Close was called
+}
+
+type specRpcCall struct {
+	reply interface{}
+	done chan error
 }
 
+// NewSpecRpcConn returns a SpecRpcConn over conn. 
+// If nil RPCOptions is passed, we use DefaultRPCOptions.
+func NewSpecRpcConn(conn io.ReadWriteCloser, opts DecoderContainerResolver, ropts *RPCOptions) *SpecRpcConn {
+	return &SpecRpcConn{
+		c: customRpcCodec{ newRPCCodec(conn, opts, ropts) },
+		calls: make(map[uint32]*specRpcCall),
+		handlers: make(map[string]SpecRpcHandler),
+	}
+}
+
+// Handle registers fn to handle requests and notifications for method.
+func (p *SpecRpcConn) Handle(method string, fn SpecRpcHandler) {
+	p.mu.Lock()
+	p.handlers[method] = fn
+	p.mu.Unlock()
+}
+
+// Call sends a request for method with args (usually a slice of the params), 
+// and waits for the response, which is decoded into reply (if reply is not nil).
+// An error in the response is returned as an rpc.ServerError, or as the error 
+// returned by RPCOptions.DecodeError (see RPCOptions.ErrorIsStructured).
+// Serve must be running to read the response.
+func (p *SpecRpcConn) Call(method string, args interface{}, reply interface{}) (err error) {
+	call := &specRpcCall{reply, make(chan error, 1)}
+	p.mu.Lock()
+	if p.shutdown {
+		p.mu.Unlock()
+		return rpc.ErrShutdown
+	}
+	p.seq++
+	seq := p.seq
+	p.calls[seq] = call
+	p.mu.Unlock()
+	if err = p.writeMessage(0, seq, method, args); err != nil {
+		p.mu.Lock()
+		delete(p.calls, seq)
+		p.mu.Unlock()
+		return
+	}
+	return <-call.done
+}
+
+// Notify sends a notification for method with args. No response is sent for it.
+func (p *SpecRpcConn) Notify(method string, args interface{}) error {
+	p.wmu.Lock()
+	defer p.wmu.Unlock()
+	return p.c.write([]interface{}{ byte(2), method, args })
+}
+
+// Serve reads messages from the connection and dispatches them (to the handlers, 
+// or to the pending calls), until the connection is closed or an error occurs. 
+// Pending calls then fail with rpc.ErrShutdown. 
+// It returns nil if the connection was closed (by either end).
+func (p *SpecRpcConn) Serve() (err error) {
+	for err == nil {
+		err = p.readMessage()
+	}
+	p.mu.Lock()
+	p.shutdown = true
+	for seq, call := range p.calls {
+		call.done <- rpc.ErrShutdown
+		delete(p.calls, seq)
+	}
+	closing := p.closing
+	p.mu.Unlock()
+	if err = p.c.maybeEOF(err); err == io.EOF || closing {
+		err = nil
+	}
+	return
+}
+
+// Close closes the connection, which ends Serve.
+func (p *SpecRpcConn) Close() error {
+	p.mu.Lock()
+	p.closing = true
+	p.mu.Unlock()
+	return p.c.Close()
+}
+
+func (p *SpecRpcConn) writeMessage(typeByte byte, msgid uint32, methodOrError string, body interface{}) error {
+	p.wmu.Lock()
+	defer p.wmu.Unlock()
+	return p.c.writeCustomBody(typeByte, uint64(msgid), methodOrError, body)
+}
+
+// readMessage reads the next message, and dispatches it.
+func (p *SpecRpcConn) readMessage() (err error) {
+	return p.c.readHeader(p.dispatchMessage)
+}
+
+// dispatchMessage reads a message (once readHeaderStart was called), and dispatches it.
+func (p *SpecRpcConn) dispatchMessage() (err error) {
+	var n int
+	var typeByte byte
+	if err = func() (err error) {
+		defer panicToErr(&err)
+		n = p.c.dec.readContainerLen(0, true, ContainerList)
+		return
+	}(); err != nil {
+		return
+	}
+	if err = p.c.read(&typeByte); err != nil {
+		return
+	}
+	// requests and responses have 4 elements, notifications have 3
+	if !((typeByte <= 1 && n == 4) || (typeByte == 2 && n == 3)) {
+		return fmt.Errorf("Unexpected message: type: %v, with %v elements", typeByte, n)
+	}
+	var msgid uint32
+	var method string
+	switch typeByte {
+	case 0:
+		if err = p.c.read(&msgid, &method); err != nil {
+			return
+		}
+		var args bytes.Buffer
+		if err = p.c.dec.CopyValue(&args); err != nil {
+			return
+		}
+		go p.handleRequest(msgid, method, args.Bytes())
+	case 1:
+		var errstr string
+		var serr, rerr error
+		if err = p.c.read(&msgid); err != nil {
+			return
+		}
+		if p.c.ropts.ErrorIsStructured {
+			serr, err = p.c.readStructuredError(&errstr)
+		} else {
+			err = p.c.read(&errstr)
+		}
+		if err != nil {
+			return
+		}
+		p.mu.Lock()
+		call := p.calls[msgid]
+		delete(p.calls, msgid)
+		p.mu.Unlock()
+		if call == nil || call.reply == nil || errstr != "" {
+			err = p.c.dec.SkipValue()
+		} else {
+			// decode a copy, so a reply which does not fit call.reply only fails the call
+			var reply bytes.Buffer
+			if err = p.c.dec.CopyValue(&reply); err == nil {
+				rerr = NewDecoderWithOptions(&reply, p.c.dec.dam, p.c.dec.opts).Decode(call.reply)
+			}
+		}
+		if call != nil {
+			if serr != nil {
+				call.done <- serr
+			} else if errstr != "" {
+				call.done <- rpc.ServerError(errstr)
+			} else if err != nil {
+				call.done <- err
+			} else {
+				call.done <- rerr
+			}
+		}
+	case 2:
+		if err = p.c.read(&method); err != nil {
+			return
+		}
+		var args bytes.Buffer
+		if err = p.c.dec.CopyValue(&args); err != nil {
+			return
+		}
+		p.mu.Lock()
+		fn := p.handlers[method]
+		p.mu.Unlock()
+		if fn != nil {
+			fn(args.Bytes())
+		}
+	}
+	return
+}
+
+func (p *SpecRpcConn) handleRequest(msgid uint32, method string, args []byte) {
+	p.mu.Lock()
+	fn := p.handlers[method]
+	p.mu.Unlock()
+	var result interface{}
+	var err error
+	if fn == nil {
+		err = fmt.Errorf("rpc: can't find method %s", method)
+	} else {
+		result, err = fn(args)
+	}
+	var errstr string
+	if err != nil {
+		errstr = err.Error()
+	}
+	// a write error will also fail reading, which ends Serve
+	p.writeMessage(1, msgid, errstr, result)
+}
+
+// /////////////// Message Conn Adapter ///////////////////
+
+// MessageConn is a message-oriented connection, e.g. a websocket connection.
+// Its methods match those of a github.com/gorilla/websocket Conn, 
+// so one can be used directly without this package depending on it.
+type MessageConn interface {
+	ReadMessage() (messageType int, p []byte, err error)
+	WriteMessage(messageType int, data []byte) error
+	Close() error
+}
+
+// binaryMessage is the websocket message type for binary data messages.
+const binaryMessage = 2
+
+type messageConnRWC struct {
+	c  MessageConn
+	rb []byte        // unread part of the last message read
+	wb bytes.Buffer  // buffered writes, sent as one message on Flush
+}
+
+// NewMessageConnReadWriteCloser adapts a MessageConn (e.g. a websocket connection) 
+// into an io.ReadWriteCloser, suitable for the rpc codecs. 
+// 
+// Messages read are returned as a continuous stream of bytes, so a message can hold
+// one or more msgpack values. Only binary messages are read: reading a message of 
+// another type (e.g. text) is an error. Writes are buffered, and sent as a single binary message 
+// on Flush, which the rpc codecs call after writing each request or response.
+// 
+// Sample Usage:
+//   wsconn, err := upgrader.Upgrade(w, r, nil)
+//   rpc.ServeCodec(msgpack.NewCustomRPCServerCodec(msgpack.NewMessageConnReadWriteCloser(wsconn), nil))
+func NewMessageConnReadWriteCloser(c MessageConn) (io.ReadWriteCloser) {
+	return &messageConnRWC{c: c}
+}
+
+func (m *messageConnRWC) Read(p []byte) (n int, err error) {
+	for len(m.rb) == 0 {
+		var mt int
+		if mt, m.rb, err = m.c.ReadMessage(); err != nil {
+			return
+		}
+		if mt != binaryMessage {
+			m.rb = nil
+			return 0, fmt.Errorf("msgpack: unexpected message type: %d (expecting a binary message)", mt)
+		}
+	}
+	n = copy(p, m.rb)
+	m.rb = m.rb[n:]
+	return
+}
+
+func (m *messageConnRWC) Write(p []byte) (n int, err error) {
+	return m.wb.Write(p)
+}
+
+// Flush sends all buffered writes as one binary message.
+func (m *messageConnRWC) Flush() (err error) {
+	if m.wb.Len() == 0 {
+		return
+	}
+	err = m.c.WriteMessage(binaryMessage, m.wb.Bytes())
+	m.wb.Reset()
+	return
+}
+
+func (m *messageConnRWC) Close() error {
+	return m.c.Close()
+}
+
+// /////////////// Packet Conn Adapter ///////////////////
+
+// maxDatagramSize is the largest payload of a UDP datagram (over IPv4).
+const maxDatagramSize = 65507
+
+// errDatagramEnd is returned when reading past the end of a datagram.
+var errDatagramEnd = errors.New("msgpack: read past the end of the datagram")
+
+// datagramReader is implemented by connections on which each message is read from 
+// a datagram of its own. The rpc codecs call nextDatagram before reading each message.
+type datagramReader interface {
+	nextDatagram() error
+}
+
+type packetConnRWC struct {
+	pc   net.PacketConn
+	addr net.Addr
+	max  int
+	rbuf []byte       // buffer for the datagram being read
+	rb   []byte       // unread part of the last datagram read
+	bounded bool      // set by nextDatagram: reads stop at the end of the datagram
+	wb   bytes.Buffer // buffered writes, sent as one datagram on Flush
+}
+
+// NewPacketConnReadWriteCloser adapts a net.PacketConn (e.g. a UDP socket) into an 
+// io.ReadWriteCloser, suitable for the rpc codecs (e.g. for notifications over UDP 
+// with a SpecRpcConn). Each datagram holds one message: writes are 
+// buffered, and sent as a single datagram to addr on Flush, which the rpc codecs call 
+// after writing each message. A message is never split across datagrams: 
+// if it is larger than maxSize, Flush returns an error, and it is not sent. 
+// 
+// Datagrams are read from any address, and those larger than maxSize are dropped. 
+// Reading a message stops at the end of its datagram, so a truncated or garbage 
+// datagram (which any sender can send) is skipped by the rpc codecs, without 
+// affecting the messages of later datagrams. Used directly (e.g. with NewDecoder), 
+// Read blocks for the next datagram at the end of each one. 
+// If maxSize <= 0, the largest UDP payload (65507 bytes) is used. 
+// addr can be nil if nothing is written (e.g. to only receive notifications).
+// As datagrams may be lost or reordered, it is best suited to notifications.
+func NewPacketConnReadWriteCloser(pc net.PacketConn, addr net.Addr, maxSize int) (io.ReadWriteCloser) {
+	if maxSize <= 0 {
+		maxSize = maxDatagramSize
+	}
+	// one more byte than the max, to detect larger datagrams (which may be truncated)
+	return &packetConnRWC{pc: pc, addr: addr, max: maxSize, rbuf: make([]byte, maxSize+1)}
+}
+
+// nextDatagram reads the next datagram, dropping any unread part of the last one.
+func (p *packetConnRWC) nextDatagram() (err error) {
+	for {
+		var n int
+		if n, _, err = p.pc.ReadFrom(p.rbuf); err != nil {
+			return
+		}
+		if n <= p.max {
+			p.rb, p.bounded = p.rbuf[:n], true
+			return
+		}
+	}
+}
+
+// Read reads from the current datagram. At its end, it errors if the datagram was 
+// read by nextDatagram (by the rpc codecs), else it blocks for the next datagram.
+func (p *packetConnRWC) Read(bs []byte) (n int, err error) {
+	for len(p.rb) == 0 {
+		if p.bounded {
+			return 0, errDatagramEnd
+		}
+		if err = p.nextDatagram(); err != nil {
+			return
+		}
+		p.bounded = false
+	}
+	n = copy(bs, p.rb)
+	p.rb = p.rb[n:]
+	return
+}
+
+func (p *packetConnRWC) Write(bs []byte) (n int, err error) {
+	return p.wb.Write(bs)
+}
+
+// Flush sends all buffered writes as one datagram.
+func (p *packetConnRWC) Flush() (err error) {
+	defer p.wb.Reset()
+	switch {
+	case p.wb.Len() == 0:
+	case p.wb.Len() > p.max:
+		err = fmt.Errorf("msgpack: message of %d bytes exceeds max datagram size: %d", p.wb.Len(), p.max)
+	case p.addr == nil:
+		err = fmt.Errorf("msgpack: no address to send datagram to")
+	default:
+		_, err = p.pc.WriteTo(p.wb.Bytes(), p.addr)
+	}
+	return
+}
+
+func (p *packetConnRWC) Close() error {
+	return p.pc.Close()
+}